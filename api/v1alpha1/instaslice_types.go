@@ -33,20 +33,28 @@ type Placement struct {
 	Start int `json:"start"`
 }
 
-// Define the struct for allocation details
+// AllocationDetails is the placement and status of a slice, the spec of an InstasliceAllocation
 type AllocationDetails struct {
-	Profile          string `json:"profile"`
-	Start            uint32 `json:"start"`
-	Size             uint32 `json:"size"`
-	PodUUID          string `json:"podUUID"`
-	GPUUUID          string `json:"gpuUUID"`
-	Nodename         string `json:"nodename"`
-	Allocationstatus string `json:"allocationStatus"`
-	Giprofileid      int    `json:"giprofileid"`
-	CIProfileID      int    `json:"ciProfileid"`
-	CIEngProfileID   int    `json:"ciengprofileid"`
-	Namespace        string `json:"namespace"`
-	PodName          string `json:"podName"`
+	Profile          string           `json:"profile"`
+	Start            uint32           `json:"start"`
+	Size             uint32           `json:"size"`
+	PodUUID          string           `json:"podUUID"`
+	GPUUUID          string           `json:"gpuUUID"`
+	Nodename         string           `json:"nodename"`
+	Allocationstatus AllocationStatus `json:"allocationStatus"`
+	// AllocationStatusReason explains the last status change, e.g. why a slice failed.
+	AllocationStatusReason string `json:"allocationStatusReason,omitempty"`
+	Giprofileid            int    `json:"giprofileid"`
+	CIProfileID            int    `json:"ciProfileid"`
+	CIEngProfileID         int    `json:"ciengprofileid"`
+	Namespace              string `json:"namespace"`
+	PodName                string `json:"podName"`
+	// ContainerName is the container of the pod the slice is requested by.
+	ContainerName string `json:"containerName,omitempty"`
+	// ConfigMapName is the configmap the MIG device is published in for the container.
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// CapacityResource is the per pod extended resource the node advertises once the slices of the pod exist.
+	CapacityResource string `json:"capacityResource,omitempty"`
 }
 
 // Define the struct for allocation details
@@ -59,25 +67,105 @@ type PreparedDetails struct {
 	PodUUID  string `json:"podUUID"`
 	Giinfoid uint32 `json:"giinfo"`
 	Ciinfoid uint32 `json:"ciinfo"`
+	// GIRefCount is the number of compute instances, this one included, sharing the GPU instance of the slice.
+	GIRefCount int32 `json:"giRefCount,omitempty"`
+	// WarmPool is true for a slice created ahead of any pod by the warm pool of the node, it has no PodUUID
+	// until the controller hands it out to an allocation with the same placement.
+	WarmPool bool `json:"warmPool,omitempty"`
+	// Managed is true for a slice instaslice created, only those are destroyed once no allocation owns them.
+	// MIG devices discovered on the GPUs are left alone.
+	Managed bool `json:"managed,omitempty"`
 }
 
-// InstasliceSpec defines the desired state of Instaslice
+// InstasliceSpec is the GPU inventory of a node along with the slices realized on it,
+// allocations of pods are InstasliceAllocation objects.
 type InstasliceSpec struct {
 	MigGPUUUID map[string]string `json:"MigGPUUUID,omitempty"`
-	// GPUID, Profile, start, podUUID
-	Allocations map[string]AllocationDetails `json:"allocations,omitempty"`
 	//Prepared :  GPUID, Profile, start
-	Prepared     map[string]PreparedDetails `json:"prepared,omitempty"`
-	Migplacement []Mig                      `json:"migplacement,omitempty"`
+	Prepared map[string]PreparedDetails `json:"prepared,omitempty"`
+	// Migplacement are the MIG profiles and their placements of the first GPU of the node.
+	Migplacement []Mig `json:"migplacement,omitempty"`
+	// MigplacementByModel are the MIG profiles and their placements of every GPU model of the node,
+	// keyed by the model the GPUs have in MigGPUUUID.
+	MigplacementByModel map[string][]Mig `json:"migplacementByModel,omitempty"`
+	// GPUTopology is where every GPU of the node sits on its PCIe tree and NVLink fabric, keyed by GPU UUID.
+	GPUTopology map[string]GPUTopology `json:"gpuTopology,omitempty"`
+}
+
+// GPUTopology locates a GPU on the PCIe tree and NVLink fabric of its node
+type GPUTopology struct {
+	// PCIBusID is the PCI address of the GPU, e.g. 00000000:07:00.0
+	PCIBusID string `json:"pciBusID,omitempty"`
+	// NUMANode is the NUMA node the GPU is attached to, it is unset when the platform does not report one
+	NUMANode *int32 `json:"numaNode,omitempty"`
+	// NVLinkPeers are the UUIDs of the GPUs of the node reachable over NVLink
+	NVLinkPeers []string `json:"nvlinkPeers,omitempty"`
+}
+
+// Condition types reported on the Instaslice of a node.
+const (
+	// ConditionDiscovered is true once the daemonset discovered the GPUs and MIG placements of the node.
+	ConditionDiscovered = "Discovered"
+	// ConditionNVMLHealthy is true when the daemonset could initialize NVML on its last reconcile.
+	ConditionNVMLHealthy = "NVMLHealthy"
+	// ConditionReady is true when slices can be created on the node.
+	ConditionReady = "Ready"
+	// ConditionInSync is true when the MIG devices on the GPUs of the node match its prepared slices.
+	ConditionInSync = "InSync"
+)
+
+// SliceDriftKind is how a MIG device on the GPUs differs from the prepared slices of the node.
+// +kubebuilder:validation:Enum=Orphaned;Missing
+type SliceDriftKind string
+
+const (
+	// SliceDriftOrphaned is a MIG device no allocation owns, it is destroyed after a grace period.
+	SliceDriftOrphaned SliceDriftKind = "Orphaned"
+	// SliceDriftMissing is a prepared slice whose MIG device vanished from the GPU, e.g. after a GPU reset.
+	SliceDriftMissing SliceDriftKind = "Missing"
+)
+
+// SliceDrift is a MIG device the daemonset found out of sync with the prepared slices of the node
+type SliceDrift struct {
+	MigUUID string         `json:"migUUID"`
+	GPUUUID string         `json:"gpuUUID"`
+	Profile string         `json:"profile,omitempty"`
+	Kind    SliceDriftKind `json:"kind"`
+	// Since is when the daemonset first found the drift
+	Since metav1.Time `json:"since"`
+}
+
+// GPUSummary is the observed slice usage of a GPU on the node
+type GPUSummary struct {
+	GPUUUID string `json:"gpuUUID"`
+	Model   string `json:"model"`
+	// SlotsUsed is the number of memory slots taken by allocations and prepared slices
+	SlotsUsed int32 `json:"slotsUsed"`
+	SlotsFree int32 `json:"slotsFree"`
+	// LargestPlaceableProfile is the largest MIG profile that still fits on the GPU, empty when it is full
+	LargestPlaceableProfile string `json:"largestPlaceableProfile,omitempty"`
 }
 
 // InstasliceStatus defines the observed state of Instaslice
 type InstasliceStatus struct {
-	Processed string `json:"processed,omitempty"`
+	// Conditions are Discovered, NVMLHealthy, Ready and InSync
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+	// GPUs summarizes the slice usage of every GPU on the node, sorted by UUID
+	GPUs []GPUSummary `json:"gpus,omitempty"`
+	// Drift lists the MIG devices out of sync with the prepared slices of the node, sorted by MIG UUID
+	Drift []SliceDrift `json:"drift,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Models",type=string,JSONPath=`.status.gpus[*].model`,priority=1
+//+kubebuilder:printcolumn:name="Slots Used",type=string,JSONPath=`.status.gpus[*].slotsUsed`,priority=1
+//+kubebuilder:printcolumn:name="Slots Free",type=string,JSONPath=`.status.gpus[*].slotsFree`,priority=1
+//+kubebuilder:printcolumn:name="Largest Profile",type=string,JSONPath=`.status.gpus[*].largestPlaceableProfile`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Instaslice is the Schema for the instaslices API
 type Instaslice struct {
@@ -0,0 +1,104 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Labels set on every InstasliceAllocation so controller and daemonset can list the allocations they own.
+const (
+	// AllocationNodeLabel is the node the slice is placed on.
+	AllocationNodeLabel = "instaslice.codeflare.dev/node"
+	// AllocationPodUIDLabel is the UID of the pod the slice is requested by.
+	AllocationPodUIDLabel = "instaslice.codeflare.dev/pod-uid"
+)
+
+// AllocationStatus is the lifecycle state of an allocation.
+// +kubebuilder:validation:Enum=creating;created;ungated;failed;releasing;deleted
+type AllocationStatus string
+
+const (
+	// AllocationStatusCreating is set by the controller once the slice is placed, the daemonset realizes it.
+	AllocationStatusCreating AllocationStatus = "creating"
+	// AllocationStatusCreated is set by the daemonset once the slice exists on the GPU.
+	AllocationStatusCreated AllocationStatus = "created"
+	// AllocationStatusUngated is set by the controller once the pod is released to the scheduler.
+	AllocationStatusUngated AllocationStatus = "ungated"
+	// AllocationStatusFailed is set by the daemonset when the slice could not be realized, the reason says why.
+	AllocationStatusFailed AllocationStatus = "failed"
+	// AllocationStatusReleasing is set by the controller once the pod is deleted, the daemonset destroys the slice.
+	AllocationStatusReleasing AllocationStatus = "releasing"
+	// AllocationStatusDeleted is set by the daemonset once the slice is destroyed, right before the allocation is removed.
+	AllocationStatusDeleted AllocationStatus = "deleted"
+)
+
+// allocationTransitions lists the states an allocation may move to from each state.
+var allocationTransitions = map[AllocationStatus][]AllocationStatus{
+	"":                        {AllocationStatusCreating},
+	AllocationStatusCreating:  {AllocationStatusCreated, AllocationStatusFailed, AllocationStatusReleasing},
+	AllocationStatusCreated:   {AllocationStatusUngated, AllocationStatusFailed, AllocationStatusReleasing},
+	AllocationStatusUngated:   {AllocationStatusFailed, AllocationStatusReleasing},
+	AllocationStatusFailed:    {AllocationStatusReleasing},
+	AllocationStatusReleasing: {AllocationStatusDeleted},
+}
+
+// CanTransitionTo returns true when an allocation in state s may move to next, staying in the same state is allowed.
+func (s AllocationStatus) CanTransitionTo(next AllocationStatus) bool {
+	if s == next {
+		return true
+	}
+	for _, allowed := range allocationTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:printcolumn:name="Pod",type=string,JSONPath=`.spec.podName`
+//+kubebuilder:printcolumn:name="Container",type=string,JSONPath=`.spec.containerName`
+//+kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.spec.nodename`
+//+kubebuilder:printcolumn:name="Profile",type=string,JSONPath=`.spec.profile`
+//+kubebuilder:printcolumn:name="GPU",type=string,JSONPath=`.spec.gpuUUID`,priority=1
+//+kubebuilder:printcolumn:name="Start",type=integer,JSONPath=`.spec.start`,priority=1
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.spec.allocationStatus`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.spec.allocationStatusReason`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// InstasliceAllocation is a single MIG slice requested by a container of a pod. It lives in the
+// namespace of the pod, is owned by it and is named after the pod UID, container and request index.
+type InstasliceAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AllocationDetails `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// InstasliceAllocationList contains a list of InstasliceAllocation
+type InstasliceAllocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []InstasliceAllocation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&InstasliceAllocation{}, &InstasliceAllocationList{})
+}
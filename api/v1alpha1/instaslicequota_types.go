@@ -0,0 +1,67 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InstasliceQuotaSpec limits the slices the pods of a namespace may hold
+type InstasliceQuotaSpec struct {
+	// Profiles is the maximum number of slices of each MIG profile, e.g. 1g.5gb, profiles not listed are not limited
+	Profiles map[string]int32 `json:"profiles,omitempty"`
+	// MaxGPUSlots is the maximum number of GPU memory slots taken by all slices, unset is not limited
+	//+kubebuilder:validation:Minimum=0
+	MaxGPUSlots *int32 `json:"maxGPUSlots,omitempty"`
+}
+
+// InstasliceQuotaStatus is the usage of the namespace counted against the quota
+type InstasliceQuotaStatus struct {
+	// Profiles is the number of slices of each MIG profile held by pods of the namespace
+	Profiles map[string]int32 `json:"profiles,omitempty"`
+	// GPUSlots is the number of GPU memory slots taken by slices of the namespace
+	GPUSlots int32 `json:"gpuSlots"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Max Slots",type=integer,JSONPath=`.spec.maxGPUSlots`
+//+kubebuilder:printcolumn:name="Used Slots",type=integer,JSONPath=`.status.gpuSlots`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// InstasliceQuota limits the MIG slices the pods of its namespace may hold. Every quota of a namespace is
+// enforced, pods whose slices would exceed one of them stay gated until slices of the namespace are released.
+type InstasliceQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   InstasliceQuotaSpec   `json:"spec,omitempty"`
+	Status InstasliceQuotaStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// InstasliceQuotaList contains a list of InstasliceQuota
+type InstasliceQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []InstasliceQuota `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&InstasliceQuota{}, &InstasliceQuotaList{})
+}
@@ -21,6 +21,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -39,13 +40,53 @@ func (in *AllocationDetails) DeepCopy() *AllocationDetails {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GPUSummary) DeepCopyInto(out *GPUSummary) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GPUSummary.
+func (in *GPUSummary) DeepCopy() *GPUSummary {
+	if in == nil {
+		return nil
+	}
+	out := new(GPUSummary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GPUTopology) DeepCopyInto(out *GPUTopology) {
+	*out = *in
+	if in.NUMANode != nil {
+		in, out := &in.NUMANode, &out.NUMANode
+		*out = new(int32)
+		**out = **in
+	}
+	if in.NVLinkPeers != nil {
+		in, out := &in.NVLinkPeers, &out.NVLinkPeers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GPUTopology.
+func (in *GPUTopology) DeepCopy() *GPUTopology {
+	if in == nil {
+		return nil
+	}
+	out := new(GPUTopology)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Instaslice) DeepCopyInto(out *Instaslice) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Instaslice.
@@ -66,6 +107,64 @@ func (in *Instaslice) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstasliceAllocation) DeepCopyInto(out *InstasliceAllocation) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceAllocation.
+func (in *InstasliceAllocation) DeepCopy() *InstasliceAllocation {
+	if in == nil {
+		return nil
+	}
+	out := new(InstasliceAllocation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InstasliceAllocation) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstasliceAllocationList) DeepCopyInto(out *InstasliceAllocationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]InstasliceAllocation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceAllocationList.
+func (in *InstasliceAllocationList) DeepCopy() *InstasliceAllocationList {
+	if in == nil {
+		return nil
+	}
+	out := new(InstasliceAllocationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InstasliceAllocationList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InstasliceList) DeepCopyInto(out *InstasliceList) {
 	*out = *in
@@ -99,18 +198,119 @@ func (in *InstasliceList) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *InstasliceSpec) DeepCopyInto(out *InstasliceSpec) {
+func (in *InstasliceQuota) DeepCopyInto(out *InstasliceQuota) {
 	*out = *in
-	if in.MigGPUUUID != nil {
-		in, out := &in.MigGPUUUID, &out.MigGPUUUID
-		*out = make(map[string]string, len(*in))
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceQuota.
+func (in *InstasliceQuota) DeepCopy() *InstasliceQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(InstasliceQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InstasliceQuota) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstasliceQuotaList) DeepCopyInto(out *InstasliceQuotaList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]InstasliceQuota, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceQuotaList.
+func (in *InstasliceQuotaList) DeepCopy() *InstasliceQuotaList {
+	if in == nil {
+		return nil
+	}
+	out := new(InstasliceQuotaList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InstasliceQuotaList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstasliceQuotaSpec) DeepCopyInto(out *InstasliceQuotaSpec) {
+	*out = *in
+	if in.Profiles != nil {
+		in, out := &in.Profiles, &out.Profiles
+		*out = make(map[string]int32, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.MaxGPUSlots != nil {
+		in, out := &in.MaxGPUSlots, &out.MaxGPUSlots
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceQuotaSpec.
+func (in *InstasliceQuotaSpec) DeepCopy() *InstasliceQuotaSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(InstasliceQuotaSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstasliceQuotaStatus) DeepCopyInto(out *InstasliceQuotaStatus) {
+	*out = *in
+	if in.Profiles != nil {
+		in, out := &in.Profiles, &out.Profiles
+		*out = make(map[string]int32, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val
 		}
 	}
-	if in.Allocations != nil {
-		in, out := &in.Allocations, &out.Allocations
-		*out = make(map[string]AllocationDetails, len(*in))
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceQuotaStatus.
+func (in *InstasliceQuotaStatus) DeepCopy() *InstasliceQuotaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(InstasliceQuotaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstasliceSpec) DeepCopyInto(out *InstasliceSpec) {
+	*out = *in
+	if in.MigGPUUUID != nil {
+		in, out := &in.MigGPUUUID, &out.MigGPUUUID
+		*out = make(map[string]string, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val
 		}
@@ -129,6 +329,31 @@ func (in *InstasliceSpec) DeepCopyInto(out *InstasliceSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.MigplacementByModel != nil {
+		in, out := &in.MigplacementByModel, &out.MigplacementByModel
+		*out = make(map[string][]Mig, len(*in))
+		for key, val := range *in {
+			var outVal []Mig
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				inVal := (*in)[key]
+				in, out := &inVal, &outVal
+				*out = make([]Mig, len(*in))
+				for i := range *in {
+					(*in)[i].DeepCopyInto(&(*out)[i])
+				}
+			}
+			(*out)[key] = outVal
+		}
+	}
+	if in.GPUTopology != nil {
+		in, out := &in.GPUTopology, &out.GPUTopology
+		*out = make(map[string]GPUTopology, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceSpec.
@@ -144,6 +369,25 @@ func (in *InstasliceSpec) DeepCopy() *InstasliceSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InstasliceStatus) DeepCopyInto(out *InstasliceStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.GPUs != nil {
+		in, out := &in.GPUs, &out.GPUs
+		*out = make([]GPUSummary, len(*in))
+		copy(*out, *in)
+	}
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = make([]SliceDrift, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstasliceStatus.
@@ -205,3 +449,19 @@ func (in *PreparedDetails) DeepCopy() *PreparedDetails {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SliceDrift) DeepCopyInto(out *SliceDrift) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SliceDrift.
+func (in *SliceDrift) DeepCopy() *SliceDrift {
+	if in == nil {
+		return nil
+	}
+	out := new(SliceDrift)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -58,6 +59,10 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var allocationPolicy string
+	var instasliceNamespace string
+	var queueOrdering string
+	var queueBackfill bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -67,6 +72,15 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&allocationPolicy, "allocation-policy", controller.FirstFitPolicyName,
+		"The policy used to place slices on a GPU, one of firstfit, lefttoright, righttoleft or bestfit. "+
+			"Pods can override it with the instaslice.codeflare.dev/allocation-policy annotation.")
+	flag.StringVar(&instasliceNamespace, "instaslice-namespace", controller.DefaultInstasliceNamespace(),
+		"The namespace of the Instaslice objects, defaults to the "+controller.InstasliceNamespaceEnv+" environment variable.")
+	flag.StringVar(&queueOrdering, "queue-ordering", controller.PriorityQueueOrdering,
+		"The order gated pods are placed in, priority (then creation time) or fifo.")
+	flag.BoolVar(&queueBackfill, "queue-backfill", true,
+		"If set, pods behind the head of the admission queue are placed on slots it does not hold while it waits.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -75,6 +89,15 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if _, err := controller.NewAllocationPolicy(allocationPolicy); err != nil {
+		setupLog.Error(err, "invalid allocation policy")
+		os.Exit(1)
+	}
+	if queueOrdering != controller.PriorityQueueOrdering && queueOrdering != controller.FIFOQueueOrdering {
+		setupLog.Error(fmt.Errorf("unknown queue ordering %q", queueOrdering), "invalid queue ordering")
+		os.Exit(1)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -124,13 +147,33 @@ func main() {
 	}
 
 	if err = (&controller.InstasliceReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		DefaultPolicy: allocationPolicy,
+		Namespace:     instasliceNamespace,
+		Recorder:      mgr.GetEventRecorderFor("instaslice-controller"),
+		QueueOrdering: queueOrdering,
+		QueueBackfill: queueBackfill,
+		APIReader:     mgr.GetAPIReader(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Instaslice")
+		os.Exit(1)
+	}
+	if err = (&controller.InstasliceQuotaReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Instaslice")
+		setupLog.Error(err, "unable to create controller", "controller", "InstasliceQuota")
 		os.Exit(1)
 	}
 
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&controller.InstasliceWebhook{}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
+			os.Exit(1)
+		}
+	}
+
 	// if err = (&controller.InstaSliceDaemonsetReconciler{
 	// 	Client: mgr.GetClient(),
 	// 	Scheme: mgr.GetScheme(),
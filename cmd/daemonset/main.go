@@ -20,6 +20,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -58,6 +59,11 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var instasliceNamespace string
+	var emulateGpus string
+	var resyncInterval time.Duration
+	var orphanGracePeriod time.Duration
+	var warmPool string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8084", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8085", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -67,6 +73,16 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&instasliceNamespace, "instaslice-namespace", controller.DefaultInstasliceNamespace(),
+		"The namespace of the Instaslice objects, defaults to the "+controller.InstasliceNamespaceEnv+" environment variable.")
+	flag.StringVar(&emulateGpus, "emulate-gpus", "",
+		"Emulate the GPUs of a machine in memory instead of using NVML, e.g. "+controller.EmulatedDGXA100+" on nodes without GPUs.")
+	flag.DurationVar(&resyncInterval, "resync-interval", time.Minute,
+		"How often the MIG devices on the GPUs are compared with the prepared slices of the node, 0 disables the resync.")
+	flag.DurationVar(&orphanGracePeriod, "orphan-grace-period", 0,
+		"How long a slice instaslice created is kept once no allocation owns it before it is destroyed, 0 only reports it.")
+	flag.StringVar(&warmPool, "warm-pool", "",
+		"The slices kept ready per profile on the node for pods to get without waiting, e.g. 1g.5gb=2,3g.20gb=1.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -131,9 +147,33 @@ func main() {
 	// 	os.Exit(1)
 	// }
 
+	warmPoolProfiles, err := controller.ParseWarmPool(warmPool)
+	if err != nil {
+		setupLog.Error(err, "invalid warm pool")
+		os.Exit(1)
+	}
+
+	gpuBackend := controller.NewNVMLBackend()
+	if emulateGpus != "" {
+		gpuBackend, err = controller.NewEmulatedGPUBackend(emulateGpus, os.Getenv("NODE_NAME"))
+		if err != nil {
+			setupLog.Error(err, "unable to emulate GPUs")
+			os.Exit(1)
+		}
+		setupLog.Info("emulating GPUs, no slice is created on real hardware", "machine", emulateGpus)
+	}
+
 	if err = (&controller.InstaSliceDaemonsetReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		Namespace:             instasliceNamespace,
+		Recorder:              mgr.GetEventRecorderFor("instaslice-daemonset"),
+		GPU:                   gpuBackend,
+		AdvertiseMigResources: emulateGpus != "",
+		ResyncInterval:        resyncInterval,
+		OrphanGracePeriod:     orphanGracePeriod,
+		WarmPool:              warmPoolProfiles,
+		APIReader:             mgr.GetAPIReader(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "InstaSliceDaemonsetReconciler")
 		//os.Exit(1)
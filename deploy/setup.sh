@@ -60,6 +60,15 @@ echo "GPU operator installation commands executed successfully"
 
 kubectl apply -f ./deploy/custom-configmapwithprofiles.yaml
 
+# Install cert-manager, it provides the serving certificate for the InstaSlice pod webhook
+kubectl apply -f https://github.com/cert-manager/cert-manager/releases/download/v1.14.4/cert-manager.yaml
+
+# Check if cert-manager installation was successful
+if [ $? -ne 0 ]; then
+    echo "Failed to install cert-manager"
+    exit 1
+fi
+
 kubectl label node --all nvidia.com/device-plugin.config=update-capacity
 
 #for already deployed GPU operator
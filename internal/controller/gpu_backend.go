@@ -0,0 +1,426 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	nvdevice "github.com/NVIDIA/go-nvlib/pkg/nvlib/device"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// GPUBackend is how the daemonset discovers and slices the GPUs of its node.
+type GPUBackend interface {
+	// Init initializes the library talking to the GPUs, it is called before every batch of calls.
+	Init() error
+	// DiscoverGPUs returns the GPUs of the node in index order.
+	DiscoverGPUs() ([]GPU, error)
+	// ListPlacements returns the MIG profiles of the GPUs of the node with their possible placements keyed by GPU model.
+	ListPlacements() (map[string][]inferencev1alpha1.Mig, error)
+	// CreateSlice creates a GPU instance at the requested placement and a compute instance in it,
+	// a slice that cannot be completed is rolled back so nothing is left on the GPU when an error is returned.
+	// A request sharing the GPU instance reuses the one already at the placement and only rolls back its compute instance.
+	CreateSlice(request SliceRequest) (Slice, error)
+	// DestroySlice destroys a compute instance and, when destroyGI is true, the GPU instance holding it.
+	DestroySlice(gpuUUID string, giID, ciID uint32, destroyGI bool) error
+	// ListMigDevices returns the MIG devices that exist on the GPUs of the node keyed by MIG UUID.
+	ListMigDevices() (map[string]inferencev1alpha1.PreparedDetails, error)
+}
+
+// GPU is a GPU of the node.
+type GPU struct {
+	UUID     string
+	Model    string
+	Topology inferencev1alpha1.GPUTopology
+}
+
+// SliceRequest is a MIG slice to create on a GPU.
+type SliceRequest struct {
+	GPUUUID        string
+	Profile        string
+	GIProfileID    int
+	CIProfileID    int
+	CIEngProfileID int
+	Start          uint32
+	Size           uint32
+	// ShareGPUInstance asks for the compute instance to be created in the GPU instance already at the placement, if any.
+	ShareGPUInstance bool
+}
+
+// Slice is a MIG slice created on a GPU.
+type Slice struct {
+	MigUUID string
+	GIID    uint32
+	CIID    uint32
+}
+
+// nvmlError is an NVML call that did not succeed.
+type nvmlError struct {
+	operation string
+	ret       nvml.Return
+}
+
+func (e *nvmlError) Error() string {
+	return fmt.Sprintf("%s: %s", e.operation, e.ret.Error())
+}
+
+// newNvmlError counts the failed NVML call and returns it as an error.
+func newNvmlError(operation string, ret nvml.Return) error {
+	recordNvmlFailure(operation, ret)
+	return &nvmlError{operation: operation, ret: ret}
+}
+
+// nvmlBackend slices the GPUs of the node through NVML.
+type nvmlBackend struct {
+	lib      nvml.Interface
+	nvdevice nvdevice.Interface
+	// sysfs is where the PCI devices of the host are listed.
+	sysfs string
+}
+
+// NewNVMLBackend returns the backend that slices the GPUs of the node through the NVML library of the host.
+func NewNVMLBackend() GPUBackend {
+	lib := nvml.New()
+	return &nvmlBackend{lib: lib, nvdevice: nvdevice.New(nvdevice.WithNvml(lib)), sysfs: sysfsPCIDevices}
+}
+
+func (b *nvmlBackend) Init() error {
+	if ret := b.lib.Init(); ret != nvml.SUCCESS {
+		return newNvmlError("Init", ret)
+	}
+	return nil
+}
+
+func (b *nvmlBackend) DiscoverGPUs() ([]GPU, error) {
+	gpus, err := discoverGPUs(b.lib)
+	if err != nil {
+		return nil, err
+	}
+	// the topology only guides placement, GPUs without one can still be sliced
+	if err := discoverTopology(b.lib, b.sysfs, gpus); err != nil {
+		log.Log.Error(err, "unable to discover the topology of the GPUs")
+		for i := range gpus {
+			gpus[i].Topology = inferencev1alpha1.GPUTopology{}
+		}
+	}
+	return gpus, nil
+}
+
+func (b *nvmlBackend) ListPlacements() (map[string][]inferencev1alpha1.Mig, error) {
+	return listPlacements(b.lib)
+}
+
+func (b *nvmlBackend) CreateSlice(request SliceRequest) (Slice, error) {
+	device, gi, ci, sharedGI, err := createInstances(b.lib, request)
+	if err != nil {
+		return Slice{}, err
+	}
+	giInfo, ret := gi.GetInfo()
+	if ret != nvml.SUCCESS {
+		return Slice{}, rollbackSlice(gi, ci, sharedGI, newNvmlError("GpuInstanceGetInfo", ret))
+	}
+	ciInfo, ret := ci.GetInfo()
+	if ret != nvml.SUCCESS {
+		return Slice{}, rollbackSlice(gi, ci, sharedGI, newNvmlError("ComputeInstanceGetInfo", ret))
+	}
+	slice := Slice{GIID: giInfo.Id, CIID: ciInfo.Id}
+	migs, err := b.migDevices(device)
+	if err != nil {
+		return Slice{}, rollbackSlice(gi, ci, sharedGI, err)
+	}
+	for _, mig := range migs {
+		if mig.Giinfoid == slice.GIID && mig.Ciinfoid == slice.CIID {
+			slice.MigUUID = mig.MigUUID
+		}
+	}
+	if slice.MigUUID == "" {
+		return Slice{}, rollbackSlice(gi, ci, sharedGI, fmt.Errorf("no MIG device found for GPU instance %d and compute instance %d", slice.GIID, slice.CIID))
+	}
+	return slice, nil
+}
+
+func (b *nvmlBackend) DestroySlice(gpuUUID string, giID, ciID uint32, destroyGI bool) error {
+	device, ret := b.lib.DeviceGetHandleByUUID(gpuUUID)
+	if ret != nvml.SUCCESS {
+		return newNvmlError("DeviceGetHandleByUUID", ret)
+	}
+	gi, ret := device.GetGpuInstanceById(int(giID))
+	if ret != nvml.SUCCESS {
+		return newNvmlError("GetGpuInstanceById", ret)
+	}
+	ci, ret := gi.GetComputeInstanceById(int(ciID))
+	if ret != nvml.SUCCESS {
+		return newNvmlError("GetComputeInstanceById", ret)
+	}
+	if ret := ci.Destroy(); ret != nvml.SUCCESS {
+		return newNvmlError("DestroyComputeInstance", ret)
+	}
+	if !destroyGI {
+		return nil
+	}
+	if ret := gi.Destroy(); ret != nvml.SUCCESS {
+		return newNvmlError("DestroyGpuInstance", ret)
+	}
+	return nil
+}
+
+func (b *nvmlBackend) ListMigDevices() (map[string]inferencev1alpha1.PreparedDetails, error) {
+	count, ret := b.lib.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, newNvmlError("DeviceGetCount", ret)
+	}
+	migDevices := make(map[string]inferencev1alpha1.PreparedDetails)
+	for i := 0; i < count; i++ {
+		device, ret := b.lib.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("DeviceGetHandleByIndex", ret)
+		}
+		migs, err := b.migDevices(device)
+		if err != nil {
+			return nil, err
+		}
+		for _, mig := range migs {
+			migDevices[mig.MigUUID] = mig.PreparedDetails
+		}
+	}
+	return migDevices, nil
+}
+
+// migDevice is a MIG device found on a GPU.
+type migDevice struct {
+	inferencev1alpha1.PreparedDetails
+	MigUUID string
+}
+
+// migDevices returns the MIG devices of a GPU with the placement of their GPU instance.
+func (b *nvmlBackend) migDevices(device nvml.Device) ([]migDevice, error) {
+	uuid, ret := device.GetUUID()
+	if ret != nvml.SUCCESS {
+		return nil, newNvmlError("GetUUID", ret)
+	}
+	parent, err := b.nvdevice.NewDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	migs, err := parent.GetMigDevices()
+	if err != nil {
+		return nil, err
+	}
+	var found []migDevice
+	for _, mig := range migs {
+		migUUID, ret := mig.GetUUID()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetUUID", ret)
+		}
+		profile, err := mig.GetProfile()
+		if err != nil {
+			return nil, err
+		}
+		giID, ret := mig.GetGpuInstanceId()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetGpuInstanceId", ret)
+		}
+		ciID, ret := mig.GetComputeInstanceId()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetComputeInstanceId", ret)
+		}
+		gi, ret := device.GetGpuInstanceById(giID)
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetGpuInstanceById", ret)
+		}
+		giInfo, ret := gi.GetInfo()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GpuInstanceGetInfo", ret)
+		}
+		found = append(found, migDevice{
+			PreparedDetails: inferencev1alpha1.PreparedDetails{
+				Profile:  profile.GetInfo().String(),
+				Start:    giInfo.Placement.Start,
+				Size:     giInfo.Placement.Size,
+				Parent:   uuid,
+				Giinfoid: uint32(giID),
+				Ciinfoid: uint32(ciID),
+			},
+			MigUUID: migUUID,
+		})
+	}
+	return found, nil
+}
+
+// discoverGPUs returns the GPUs known to an NVML library in index order.
+func discoverGPUs(lib nvml.Interface) ([]GPU, error) {
+	count, ret := lib.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, newNvmlError("DeviceGetCount", ret)
+	}
+	var gpus []GPU
+	for i := 0; i < count; i++ {
+		device, ret := lib.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("DeviceGetHandleByIndex", ret)
+		}
+		uuid, ret := device.GetUUID()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetUUID", ret)
+		}
+		name, ret := device.GetName()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetName", ret)
+		}
+		gpus = append(gpus, GPU{UUID: uuid, Model: name})
+	}
+	return gpus, nil
+}
+
+// listPlacements returns the MIG profiles of the GPUs known to an NVML library with their possible placements keyed by
+// GPU model, the placements of a model are read from its first GPU.
+func listPlacements(lib nvml.Interface) (map[string][]inferencev1alpha1.Mig, error) {
+	count, ret := lib.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, newNvmlError("DeviceGetCount", ret)
+	}
+	placements := make(map[string][]inferencev1alpha1.Mig)
+	for i := 0; i < count; i++ {
+		device, ret := lib.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("DeviceGetHandleByIndex", ret)
+		}
+		model, ret := device.GetName()
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetName", ret)
+		}
+		if _, listed := placements[model]; listed {
+			continue
+		}
+		migs, err := listDevicePlacements(device)
+		if err != nil {
+			return nil, err
+		}
+		placements[model] = migs
+	}
+	return placements, nil
+}
+
+// listDevicePlacements returns the MIG profiles of a GPU with their possible placements.
+// Compute instance profiles share the placements of their GPU instance.
+func listDevicePlacements(device nvml.Device) ([]inferencev1alpha1.Mig, error) {
+	memory, ret := device.GetMemoryInfo()
+	if ret != nvml.SUCCESS {
+		return nil, newNvmlError("GetMemoryInfo", ret)
+	}
+	var migPlacements []inferencev1alpha1.Mig
+	for i := 0; i < nvml.GPU_INSTANCE_PROFILE_COUNT; i++ {
+		giProfileInfo, ret := device.GetGpuInstanceProfileInfo(i)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetGpuInstanceProfileInfo", ret)
+		}
+		profile := NewMigProfile(i, i, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED, giProfileInfo.SliceCount, giProfileInfo.SliceCount, giProfileInfo.MemorySizeMB, memory.Total)
+
+		giPossiblePlacements, ret := device.GetGpuInstancePossiblePlacements(&giProfileInfo)
+		if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, newNvmlError("GetGpuInstancePossiblePlacements", ret)
+		}
+		placementsForProfile := []inferencev1alpha1.Placement{}
+		for _, p := range giPossiblePlacements {
+			placementsForProfile = append(placementsForProfile, inferencev1alpha1.Placement{
+				Size:  int(p.Size),
+				Start: int(p.Start),
+			})
+		}
+		migPlacements = append(migPlacements, inferencev1alpha1.Mig{
+			Placements:     placementsForProfile,
+			Profile:        profile.String(),
+			Giprofileid:    i,
+			CIProfileID:    profile.CIProfileID,
+			CIEngProfileID: profile.CIEngProfileID,
+		})
+		migPlacements = append(migPlacements, computeInstanceProfiles(*profile, placementsForProfile)...)
+	}
+	return migPlacements, nil
+}
+
+// createInstances creates the GPU instance and the compute instance of a slice through an NVML library,
+// sharedGI is true when the compute instance went into a GPU instance that was already at the placement.
+func createInstances(lib nvml.Interface, request SliceRequest) (device nvml.Device, gi nvml.GpuInstance, ci nvml.ComputeInstance, sharedGI bool, err error) {
+	device, ret := lib.DeviceGetHandleByUUID(request.GPUUUID)
+	if ret != nvml.SUCCESS {
+		return nil, nil, nil, false, newNvmlError("DeviceGetHandleByUUID", ret)
+	}
+	giProfileInfo, ret := device.GetGpuInstanceProfileInfo(request.GIProfileID)
+	if ret != nvml.SUCCESS {
+		return nil, nil, nil, false, newNvmlError("GetGpuInstanceProfileInfo", ret)
+	}
+	placement := nvml.GpuInstancePlacement{Start: request.Start, Size: request.Size}
+	if request.ShareGPUInstance {
+		gis, ret := device.GetGpuInstances(&giProfileInfo)
+		if ret != nvml.SUCCESS {
+			return nil, nil, nil, false, newNvmlError("GetGpuInstances", ret)
+		}
+		for _, existing := range gis {
+			info, ret := existing.GetInfo()
+			if ret != nvml.SUCCESS {
+				return nil, nil, nil, false, newNvmlError("GpuInstanceGetInfo", ret)
+			}
+			if info.Placement == placement {
+				gi, sharedGI = existing, true
+			}
+		}
+	}
+	if gi == nil {
+		gi, ret = device.CreateGpuInstanceWithPlacement(&giProfileInfo, &placement)
+		if ret != nvml.SUCCESS {
+			return nil, nil, nil, false, newNvmlError("CreateGpuInstanceWithPlacement", ret)
+		}
+	}
+	ciProfileInfo, ret := gi.GetComputeInstanceProfileInfo(request.CIProfileID, request.CIEngProfileID)
+	if ret != nvml.SUCCESS {
+		return nil, nil, nil, false, rollbackSlice(gi, nil, sharedGI, newNvmlError("GetComputeInstanceProfileInfo", ret))
+	}
+	ci, ret = gi.CreateComputeInstance(&ciProfileInfo)
+	if ret != nvml.SUCCESS {
+		return nil, nil, nil, false, rollbackSlice(gi, nil, sharedGI, newNvmlError("CreateComputeInstance", ret))
+	}
+	return device, gi, ci, sharedGI, nil
+}
+
+// rollbackSlice destroys the compute instance, when there is one, and the GPU instance of a slice that could not
+// be completed because of err, a shared GPU instance is kept for the compute instances already in it.
+// The returned error is err along with the failure to roll back if any.
+func rollbackSlice(gi nvml.GpuInstance, ci nvml.ComputeInstance, sharedGI bool, err error) error {
+	if ci != nil {
+		if ret := ci.Destroy(); ret != nvml.SUCCESS {
+			return fmt.Errorf("%w, rolling back: %v", err, newNvmlError("DestroyComputeInstance", ret))
+		}
+	}
+	if sharedGI {
+		return err
+	}
+	if ret := gi.Destroy(); ret != nvml.SUCCESS {
+		return fmt.Errorf("%w, rolling back: %v", err, newNvmlError("DestroyGpuInstance", ret))
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
+	"github.com/google/uuid"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// dgxa100PCIBusIDs and dgxa100NUMANodes are where the GPUs of a DGX A100 sit, in index order.
+var (
+	dgxa100PCIBusIDs = []string{"00000000:07:00.0", "00000000:0F:00.0", "00000000:47:00.0", "00000000:4E:00.0",
+		"00000000:87:00.0", "00000000:90:00.0", "00000000:B7:00.0", "00000000:BD:00.0"}
+	dgxa100NUMANodes = []int32{3, 3, 1, 1, 7, 7, 5, 5}
+)
+
+// dgxa100Backend slices the GPUs of the NVML mock of a DGX A100 in memory.
+// The mock has no MIG devices, the backend keeps the slices it created and gives them their MIG UUIDs.
+type dgxa100Backend struct {
+	server *dgxa100.Server
+	mu     sync.Mutex
+	slices map[string]dgxa100Slice
+}
+
+// dgxa100Slice is a slice created on the mock with its instances.
+type dgxa100Slice struct {
+	details inferencev1alpha1.PreparedDetails
+	gi      nvml.GpuInstance
+	ci      nvml.ComputeInstance
+}
+
+// NewDGXA100Backend returns a backend emulating the eight A100 40GB GPUs of a DGX A100.
+func NewDGXA100Backend() GPUBackend {
+	return &dgxa100Backend{server: dgxa100.New(), slices: make(map[string]dgxa100Slice)}
+}
+
+func (b *dgxa100Backend) Init() error {
+	if ret := b.server.Init(); ret != nvml.SUCCESS {
+		return newNvmlError("Init", ret)
+	}
+	return nil
+}
+
+func (b *dgxa100Backend) DiscoverGPUs() ([]GPU, error) {
+	gpus, err := discoverGPUs(b.server)
+	if err != nil {
+		return nil, err
+	}
+	// the mock reports no PCI addresses nor NVLinks, use the topology of a DGX A100
+	for i := range gpus {
+		numaNode := dgxa100NUMANodes[i%len(dgxa100NUMANodes)]
+		gpus[i].Topology.PCIBusID = dgxa100PCIBusIDs[i%len(dgxa100PCIBusIDs)]
+		gpus[i].Topology.NUMANode = &numaNode
+		// every GPU reaches the others through the NVSwitches
+		for j := range gpus {
+			if j != i {
+				gpus[i].Topology.NVLinkPeers = append(gpus[i].Topology.NVLinkPeers, gpus[j].UUID)
+			}
+		}
+	}
+	return gpus, nil
+}
+
+func (b *dgxa100Backend) ListPlacements() (map[string][]inferencev1alpha1.Mig, error) {
+	return listPlacements(b.server)
+}
+
+func (b *dgxa100Backend) CreateSlice(request SliceRequest) (Slice, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// the mock places GPU instances anywhere, refuse overlapping placements like a GPU does
+	for _, existing := range b.slices {
+		if existing.details.Parent != request.GPUUUID ||
+			request.Start >= existing.details.Start+existing.details.Size || existing.details.Start >= request.Start+request.Size {
+			continue
+		}
+		if request.ShareGPUInstance && existing.details.Start == request.Start && existing.details.Size == request.Size {
+			if info, ret := existing.gi.GetInfo(); ret == nvml.SUCCESS && int(info.ProfileId) == request.GIProfileID {
+				continue
+			}
+		}
+		return Slice{}, newNvmlError("CreateGpuInstanceWithPlacement", nvml.ERROR_INSUFFICIENT_RESOURCES)
+	}
+	_, gi, ci, sharedGI, err := createInstances(b.server, request)
+	if err != nil {
+		return Slice{}, err
+	}
+	giInfo, ret := gi.GetInfo()
+	if ret != nvml.SUCCESS {
+		return Slice{}, rollbackSlice(gi, ci, sharedGI, newNvmlError("GpuInstanceGetInfo", ret))
+	}
+	ciInfo, ret := ci.GetInfo()
+	if ret != nvml.SUCCESS {
+		return Slice{}, rollbackSlice(gi, ci, sharedGI, newNvmlError("ComputeInstanceGetInfo", ret))
+	}
+	slice := Slice{MigUUID: "MIG-" + uuid.New().String(), GIID: giInfo.Id, CIID: ciInfo.Id}
+	b.slices[slice.MigUUID] = dgxa100Slice{
+		details: inferencev1alpha1.PreparedDetails{
+			Profile:  request.Profile,
+			Start:    request.Start,
+			Size:     request.Size,
+			Parent:   request.GPUUUID,
+			Giinfoid: slice.GIID,
+			Ciinfoid: slice.CIID,
+		},
+		gi: gi,
+		ci: ci,
+	}
+	return slice, nil
+}
+
+func (b *dgxa100Backend) DestroySlice(gpuUUID string, giID, ciID uint32, destroyGI bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for migUUID, slice := range b.slices {
+		if slice.details.Parent != gpuUUID || slice.details.Giinfoid != giID || slice.details.Ciinfoid != ciID {
+			continue
+		}
+		if ret := slice.ci.Destroy(); ret != nvml.SUCCESS {
+			return newNvmlError("DestroyComputeInstance", ret)
+		}
+		if destroyGI {
+			if ret := slice.gi.Destroy(); ret != nvml.SUCCESS {
+				return newNvmlError("DestroyGpuInstance", ret)
+			}
+		}
+		delete(b.slices, migUUID)
+		return nil
+	}
+	return newNvmlError("GetGpuInstanceById", nvml.ERROR_NOT_FOUND)
+}
+
+func (b *dgxa100Backend) ListMigDevices() (map[string]inferencev1alpha1.PreparedDetails, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	migDevices := make(map[string]inferencev1alpha1.PreparedDetails, len(b.slices))
+	for migUUID, slice := range b.slices {
+		migDevices[migUUID] = slice.details
+	}
+	return migDevices, nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDGXA100BackendCreateAndDestroySlice(t *testing.T) {
+	t.Parallel()
+	backend := NewDGXA100Backend()
+	assert.NoError(t, backend.Init())
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	assert.Len(t, gpus, 8)
+
+	request := SliceRequest{GPUUUID: gpus[0].UUID, Profile: "3g.20gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_3_SLICE,
+		CIProfileID: nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, Start: 4, Size: 4}
+	slice, err := backend.CreateSlice(request)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, slice.MigUUID)
+
+	// an overlapping placement on the same GPU is refused, the other GPUs are free
+	_, err = backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 6, Size: 1})
+	assert.EqualError(t, err, "CreateGpuInstanceWithPlacement: "+nvml.ERROR_INSUFFICIENT_RESOURCES.Error())
+	_, err = backend.CreateSlice(SliceRequest{GPUUUID: gpus[1].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 6, Size: 1})
+	assert.NoError(t, err)
+
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 2)
+	assert.Equal(t, gpus[0].UUID, migDevices[slice.MigUUID].Parent)
+	assert.Equal(t, "3g.20gb", migDevices[slice.MigUUID].Profile)
+	assert.Equal(t, uint32(4), migDevices[slice.MigUUID].Start)
+
+	assert.NoError(t, backend.DestroySlice(gpus[0].UUID, slice.GIID, slice.CIID, true))
+	assert.Error(t, backend.DestroySlice(gpus[0].UUID, slice.GIID, slice.CIID, true))
+	migDevices, err = backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.NotContains(t, migDevices, slice.MigUUID)
+}
+
+func TestDGXA100BackendUnknownGPU(t *testing.T) {
+	t.Parallel()
+	backend := NewDGXA100Backend()
+	_, err := backend.CreateSlice(SliceRequest{GPUUUID: "GPU-unknown", Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Size: 1})
+	assert.EqualError(t, err, "DeviceGetHandleByUUID: "+nvml.ERROR_INVALID_ARGUMENT.Error())
+}
+
+func TestDiscoverWithDGXA100Backend(t *testing.T) {
+	t.Parallel()
+	backend := NewDGXA100Backend()
+	reconciler := &InstaSliceDaemonsetReconciler{GPU: backend}
+
+	instaslice, gpuUUIDs, err := reconciler.discoverAvailableProfilesOnGpus()
+	assert.NoError(t, err)
+	assert.Len(t, gpuUUIDs, 8)
+	assert.Len(t, instaslice.Spec.MigGPUUUID, 8)
+	assert.Equal(t, "Mock NVIDIA A100-SXM4-40GB", instaslice.Spec.MigGPUUUID[gpuUUIDs[0]])
+	var profiles []string
+	for _, mig := range instaslice.Spec.Migplacement {
+		profiles = append(profiles, mig.Profile)
+	}
+	assert.Subset(t, profiles, []string{"1g.5gb", "2g.10gb", "3g.20gb", "4g.20gb", "7g.40gb"})
+	assert.Len(t, instaslice.Spec.GPUTopology, 8)
+	assert.Equal(t, "00000000:47:00.0", instaslice.Spec.GPUTopology[gpuUUIDs[2]].PCIBusID)
+	assert.Equal(t, int32(1), *instaslice.Spec.GPUTopology[gpuUUIDs[2]].NUMANode)
+	assert.Len(t, instaslice.Spec.GPUTopology[gpuUUIDs[2]].NVLinkPeers, 7)
+
+	// slices that exist before the daemonset starts are prepared entries of the node
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpuUUIDs[2], Profile: "7g.40gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_7_SLICE,
+		CIProfileID: nvml.COMPUTE_INSTANCE_PROFILE_7_SLICE, Start: 0, Size: 8})
+	assert.NoError(t, err)
+	assert.NoError(t, reconciler.discoverDanglingSlices(instaslice))
+	assert.Len(t, instaslice.Spec.Prepared, 1)
+	assert.Equal(t, gpuUUIDs[2], instaslice.Spec.Prepared[slice.MigUUID].Parent)
+	assert.Equal(t, slice.GIID, instaslice.Spec.Prepared[slice.MigUUID].Giinfoid)
+}
+
+// failComputeInstances makes the creation of compute instances on a GPU of the mock return ret.
+func failComputeInstances(backend GPUBackend, gpuIndex int, ret nvml.Return) *dgxa100.Device {
+	device := backend.(*dgxa100Backend).server.Devices[gpuIndex].(*dgxa100.Device)
+	createGpuInstance := device.CreateGpuInstanceWithPlacementFunc
+	device.CreateGpuInstanceWithPlacementFunc = func(info *nvml.GpuInstanceProfileInfo, placement *nvml.GpuInstancePlacement) (nvml.GpuInstance, nvml.Return) {
+		gi, giRet := createGpuInstance(info, placement)
+		gi.(*dgxa100.GpuInstance).CreateComputeInstanceFunc = func(*nvml.ComputeInstanceProfileInfo) (nvml.ComputeInstance, nvml.Return) {
+			return nil, ret
+		}
+		return gi, giRet
+	}
+	return device
+}
+
+func TestCreateSliceRollsBackGpuInstance(t *testing.T) {
+	t.Parallel()
+	backend := NewDGXA100Backend()
+	device := failComputeInstances(backend, 0, nvml.ERROR_INSUFFICIENT_RESOURCES)
+
+	_, err := backend.CreateSlice(SliceRequest{GPUUUID: device.UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 0, Size: 1})
+	assert.EqualError(t, err, "CreateComputeInstance: "+nvml.ERROR_INSUFFICIENT_RESOURCES.Error())
+	assert.Empty(t, device.GpuInstances)
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Empty(t, migDevices)
+
+	// a GPU instance that cannot be destroyed is reported along with the original failure
+	createGpuInstance := device.CreateGpuInstanceWithPlacementFunc
+	device.CreateGpuInstanceWithPlacementFunc = func(info *nvml.GpuInstanceProfileInfo, placement *nvml.GpuInstancePlacement) (nvml.GpuInstance, nvml.Return) {
+		gi, ret := createGpuInstance(info, placement)
+		gi.(*dgxa100.GpuInstance).DestroyFunc = func() nvml.Return { return nvml.ERROR_IN_USE }
+		return gi, ret
+	}
+	_, err = backend.CreateSlice(SliceRequest{GPUUUID: device.UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 0, Size: 1})
+	assert.EqualError(t, err, "CreateComputeInstance: "+nvml.ERROR_INSUFFICIENT_RESOURCES.Error()+", rolling back: DestroyGpuInstance: "+nvml.ERROR_IN_USE.Error())
+}
+
+func TestListPlacementsPerGPUModel(t *testing.T) {
+	t.Parallel()
+	server := dgxa100.New()
+	server.Devices[5].(*dgxa100.Device).Name = "Mock NVIDIA A100-SXM4-80GB"
+	server.Devices[5].(*dgxa100.Device).GetGpuInstanceProfileInfoFunc = func(profile int) (nvml.GpuInstanceProfileInfo, nvml.Return) {
+		if profile != nvml.GPU_INSTANCE_PROFILE_7_SLICE {
+			return nvml.GpuInstanceProfileInfo{}, nvml.ERROR_NOT_SUPPORTED
+		}
+		return nvml.GpuInstanceProfileInfo{Id: uint32(profile), SliceCount: 7, MemorySizeMB: 81920}, nvml.SUCCESS
+	}
+	placements, err := listPlacements(server)
+	assert.NoError(t, err)
+	assert.Len(t, placements, 2)
+	assert.Greater(t, len(placements["Mock NVIDIA A100-SXM4-40GB"]), 1)
+	assert.Equal(t, "7g.80gb", placements["Mock NVIDIA A100-SXM4-80GB"][0].Profile)
+}
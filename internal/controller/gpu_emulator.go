@@ -0,0 +1,90 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
+	"github.com/google/uuid"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// EmulatedDGXA100 emulates the eight A100 40GB GPUs of a DGX A100 with --emulate-gpus.
+const EmulatedDGXA100 = "dgxa100"
+
+// NewEmulatedGPUBackend returns a backend that emulates the GPUs of a machine in memory so the daemonset runs on
+// nodes without GPUs. The GPU UUIDs are derived from the node name so they survive a restart of the daemonset.
+func NewEmulatedGPUBackend(machine string, nodeName string) (GPUBackend, error) {
+	switch machine {
+	case EmulatedDGXA100:
+		backend := NewDGXA100Backend().(*dgxa100Backend)
+		for i, device := range backend.server.Devices {
+			device.(*dgxa100.Device).UUID = "GPU-" + uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%s/%d", nodeName, i))).String()
+		}
+		return backend, nil
+	}
+	return nil, fmt.Errorf("unsupported GPU emulation %q, supported machines are: %s", machine, EmulatedDGXA100)
+}
+
+// advertiseMigResources publishes the MIG slices of the node as nvidia.com/mig-<profile> capacity,
+// standing in for the NVIDIA device plugin when the GPUs of the node are emulated.
+func (r *InstaSliceDaemonsetReconciler) advertiseMigResources(ctx context.Context, nodeName string) error {
+	migDevices, err := r.GPU.ListMigDevices()
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to list MIG devices to advertise")
+		return err
+	}
+	node := &v1.Node{}
+	if err := r.Get(ctx, types.NamespacedName{Name: nodeName}, node); err != nil {
+		log.FromContext(ctx).Error(err, "unable to fetch Node")
+		return err
+	}
+	counts := make(map[string]int)
+	// profiles without slices left are advertised with no capacity
+	for resourceName := range node.Status.Capacity {
+		if strings.HasPrefix(resourceName.String(), migResourcePrefix) {
+			counts[resourceName.String()] = 0
+		}
+	}
+	for _, prepared := range migDevices {
+		counts[migResourcePrefix+prepared.Profile]++
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	capacity := make(map[string]string, len(counts))
+	for resourceName, count := range counts {
+		capacity[resourceName] = strconv.Itoa(count)
+	}
+	patch, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{"capacity": capacity}})
+	if err != nil {
+		return err
+	}
+	if err := r.Status().Patch(ctx, node, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		log.FromContext(ctx).Error(err, "unable to advertise MIG resources on Node")
+		return err
+	}
+	return nil
+}
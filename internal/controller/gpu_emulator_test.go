@@ -0,0 +1,86 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewEmulatedGPUBackend(t *testing.T) {
+	t.Parallel()
+	discover := func(nodeName string) []GPU {
+		backend, err := NewEmulatedGPUBackend(EmulatedDGXA100, nodeName)
+		assert.NoError(t, err)
+		gpus, err := backend.DiscoverGPUs()
+		assert.NoError(t, err)
+		return gpus
+	}
+	// a restarted daemonset finds the GPUs the controller placed slices on
+	assert.Equal(t, discover("node-1"), discover("node-1"))
+	assert.NotEqual(t, discover("node-1")[0].UUID, discover("node-2")[0].UUID)
+
+	_, err := NewEmulatedGPUBackend("dgxh100", "node-1")
+	assert.EqualError(t, err, `unsupported GPU emulation "dgxh100", supported machines are: dgxa100`)
+}
+
+func TestAdvertiseMigResources(t *testing.T) {
+	t.Parallel()
+	backend, err := NewEmulatedGPUBackend(EmulatedDGXA100, "node-1")
+	assert.NoError(t, err)
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status:     v1.NodeStatus{Capacity: v1.ResourceList{v1.ResourceCPU: resource.MustParse("8")}},
+	}
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(node).Build()
+	reconciler := &InstaSliceDaemonsetReconciler{Client: fakeClient, GPU: backend, AdvertiseMigResources: true}
+	capacity := func(resourceName string) int64 {
+		var updated v1.Node
+		assert.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-1"}, &updated))
+		quantity, exists := updated.Status.Capacity[v1.ResourceName(resourceName)]
+		assert.True(t, exists, resourceName)
+		return quantity.Value()
+	}
+
+	for i, gpu := range gpus[:2] {
+		_, err := backend.CreateSlice(SliceRequest{GPUUUID: gpu.UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: uint32(i), Size: 1})
+		assert.NoError(t, err)
+	}
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[2].UUID, Profile: "3g.20gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_3_SLICE,
+		CIProfileID: nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, Start: 0, Size: 4})
+	assert.NoError(t, err)
+	assert.NoError(t, reconciler.advertiseMigResources(context.Background(), "node-1"))
+	assert.Equal(t, int64(2), capacity("nvidia.com/mig-1g.5gb"))
+	assert.Equal(t, int64(1), capacity("nvidia.com/mig-3g.20gb"))
+	assert.Equal(t, int64(8), capacity("cpu"))
+
+	// a profile without slices left has no capacity
+	assert.NoError(t, backend.DestroySlice(gpus[2].UUID, slice.GIID, slice.CIID, true))
+	assert.NoError(t, reconciler.advertiseMigResources(context.Background(), "node-1"))
+	assert.Equal(t, int64(0), capacity("nvidia.com/mig-3g.20gb"))
+}
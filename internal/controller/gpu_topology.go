@@ -0,0 +1,131 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// sysfsPCIDevices is where the kernel lists the PCI devices of the host along with their NUMA node.
+const sysfsPCIDevices = "/sys/bus/pci/devices"
+
+// discoverTopology records the PCI address, the NUMA node and the NVLink peers of the GPUs known to an NVML library,
+// the NUMA nodes are read from the PCI devices listed under sysfs.
+// GPUs linked directly are peers, so are GPUs linked to the same NVSwitch.
+func discoverTopology(lib nvml.Interface, sysfs string, gpus []GPU) error {
+	gpuByBusID := make(map[string]int, len(gpus))
+	devices := make([]nvml.Device, len(gpus))
+	for i := range gpus {
+		device, ret := lib.DeviceGetHandleByUUID(gpus[i].UUID)
+		if ret != nvml.SUCCESS {
+			return newNvmlError("DeviceGetHandleByUUID", ret)
+		}
+		pciInfo, ret := device.GetPciInfo()
+		if ret != nvml.SUCCESS {
+			return newNvmlError("GetPciInfo", ret)
+		}
+		devices[i] = device
+		gpus[i].Topology.PCIBusID = pciBusID(pciInfo)
+		gpus[i].Topology.NUMANode = numaNodeOfPCIDevice(sysfs, gpus[i].Topology.PCIBusID)
+		gpuByBusID[strings.ToUpper(gpus[i].Topology.PCIBusID)] = i
+	}
+	peers := make([]map[int]bool, len(gpus))
+	switches := make(map[string]map[int]bool)
+	for i, device := range devices {
+		peers[i] = make(map[int]bool)
+		for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+			state, ret := device.GetNvLinkState(link)
+			if ret == nvml.ERROR_NOT_SUPPORTED || ret == nvml.ERROR_INVALID_ARGUMENT {
+				// the GPU has no more links
+				break
+			}
+			if ret != nvml.SUCCESS {
+				return newNvmlError("GetNvLinkState", ret)
+			}
+			if state != nvml.FEATURE_ENABLED {
+				continue
+			}
+			remote, ret := device.GetNvLinkRemotePciInfo(link)
+			if ret != nvml.SUCCESS {
+				return newNvmlError("GetNvLinkRemotePciInfo", ret)
+			}
+			remoteBusID := strings.ToUpper(pciBusID(remote))
+			if peer, isGPU := gpuByBusID[remoteBusID]; isGPU {
+				peers[i][peer] = true
+				continue
+			}
+			if switches[remoteBusID] == nil {
+				switches[remoteBusID] = make(map[int]bool)
+			}
+			switches[remoteBusID][i] = true
+		}
+	}
+	for _, linked := range switches {
+		for i := range linked {
+			for peer := range linked {
+				if peer != i {
+					peers[i][peer] = true
+				}
+			}
+		}
+	}
+	for i := range gpus {
+		for peer := range gpus {
+			if peers[i][peer] || peers[peer][i] {
+				gpus[i].Topology.NVLinkPeers = append(gpus[i].Topology.NVLinkPeers, gpus[peer].UUID)
+			}
+		}
+	}
+	return nil
+}
+
+// pciBusID returns the PCI address NVML reports for a device, e.g. 00000000:07:00.0.
+func pciBusID(info nvml.PciInfo) string {
+	var busID []byte
+	for _, c := range info.BusId {
+		if c == 0 {
+			break
+		}
+		busID = append(busID, byte(c))
+	}
+	return string(busID)
+}
+
+// numaNodeOfPCIDevice returns the NUMA node the kernel reports for a PCI device, nil when there is none.
+// NVML pads the PCI domain to 8 digits where sysfs uses 4.
+func numaNodeOfPCIDevice(sysfs string, busID string) *int32 {
+	domain, address, found := strings.Cut(busID, ":")
+	if !found || len(domain) < 4 {
+		return nil
+	}
+	name := strings.ToLower(domain[len(domain)-4:] + ":" + address)
+	content, err := os.ReadFile(filepath.Join(sysfs, name, "numa_node"))
+	if err != nil {
+		return nil
+	}
+	numaNode, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 32)
+	if err != nil || numaNode < 0 {
+		return nil
+	}
+	node := int32(numaNode)
+	return &node
+}
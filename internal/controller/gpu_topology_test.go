@@ -0,0 +1,98 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPciInfo(busID string) nvml.PciInfo {
+	var info nvml.PciInfo
+	for i, c := range busID {
+		info.BusId[i] = int8(c)
+	}
+	return info
+}
+
+func TestDiscoverTopology(t *testing.T) {
+	sysfs := t.TempDir()
+	for name, numaNode := range map[string]string{"0000:07:00.0": "0\n", "0000:0f:00.0": "1\n", "0000:47:00.0": "-1\n"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(sysfs, name), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(sysfs, name, "numa_node"), []byte(numaNode), 0o644))
+	}
+
+	// GPU 0 and 1 are bridged, GPU 2 and 3 share an NVSwitch, the other GPUs have no NVLink
+	server := dgxa100.New()
+	links := map[int][]string{0: {"00000000:0F:00.0"}, 1: {"00000000:07:00.0"}, 2: {"00000000:C0:00.0"}, 3: {"00000000:C0:00.0"}}
+	for i := range server.Devices {
+		device := server.Devices[i].(*dgxa100.Device)
+		busID := dgxa100PCIBusIDs[i]
+		remotes := links[i]
+		device.GetPciInfoFunc = func() (nvml.PciInfo, nvml.Return) { return testPciInfo(busID), nvml.SUCCESS }
+		device.GetNvLinkStateFunc = func(link int) (nvml.EnableState, nvml.Return) {
+			if link >= len(remotes) {
+				return nvml.FEATURE_DISABLED, nvml.ERROR_INVALID_ARGUMENT
+			}
+			return nvml.FEATURE_ENABLED, nvml.SUCCESS
+		}
+		device.GetNvLinkRemotePciInfoFunc = func(link int) (nvml.PciInfo, nvml.Return) { return testPciInfo(remotes[link]), nvml.SUCCESS }
+	}
+	gpus, err := discoverGPUs(server)
+	assert.NoError(t, err)
+
+	assert.NoError(t, discoverTopology(server, sysfs, gpus))
+	assert.Equal(t, "00000000:07:00.0", gpus[0].Topology.PCIBusID)
+	assert.Equal(t, int32(0), *gpus[0].Topology.NUMANode)
+	assert.Equal(t, int32(1), *gpus[1].Topology.NUMANode)
+	assert.Nil(t, gpus[2].Topology.NUMANode)
+	assert.Nil(t, gpus[4].Topology.NUMANode)
+	assert.Equal(t, []string{gpus[1].UUID}, gpus[0].Topology.NVLinkPeers)
+	assert.Equal(t, []string{gpus[0].UUID}, gpus[1].Topology.NVLinkPeers)
+	assert.Equal(t, []string{gpus[3].UUID}, gpus[2].Topology.NVLinkPeers)
+	assert.Empty(t, gpus[4].Topology.NVLinkPeers)
+}
+
+func TestDiscoverGPUsWithoutTopology(t *testing.T) {
+	server := dgxa100.New()
+	server.Devices[3].(*dgxa100.Device).GetPciInfoFunc = func() (nvml.PciInfo, nvml.Return) {
+		return nvml.PciInfo{}, nvml.ERROR_UNKNOWN
+	}
+	for i := range server.Devices {
+		if i != 3 {
+			busID := dgxa100PCIBusIDs[i]
+			server.Devices[i].(*dgxa100.Device).GetPciInfoFunc = func() (nvml.PciInfo, nvml.Return) { return testPciInfo(busID), nvml.SUCCESS }
+		}
+		server.Devices[i].(*dgxa100.Device).GetNvLinkStateFunc = func(int) (nvml.EnableState, nvml.Return) {
+			return nvml.FEATURE_DISABLED, nvml.ERROR_NOT_SUPPORTED
+		}
+	}
+	backend := &nvmlBackend{lib: server, sysfs: t.TempDir()}
+
+	// the GPUs are still reported when the topology of one of them cannot be read
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	assert.Len(t, gpus, 8)
+	for _, gpu := range gpus {
+		assert.Empty(t, gpu.Topology)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// newInstasliceAllocation returns the allocation object of a slice of the pod. The pod owns it so it is garbage
+// collected with the pod, the finalizer is removed by the daemonset once the slice is destroyed on the node.
+func newInstasliceAllocation(pod *v1.Pod, name string, allocation inferencev1alpha1.AllocationDetails) *inferencev1alpha1.InstasliceAllocation {
+	return &inferencev1alpha1.InstasliceAllocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				inferencev1alpha1.AllocationNodeLabel:   allocation.Nodename,
+				inferencev1alpha1.AllocationPodUIDLabel: string(pod.UID),
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(pod, v1.SchemeGroupVersion.WithKind("Pod"))},
+			Finalizers:      []string{gateName},
+		},
+		Spec: allocation,
+	}
+}
+
+// apiReader returns the reader of the objects placement and writes start from.
+func (r *InstasliceReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+// listPodAllocations returns the allocations of all slices requested by the pod.
+func (r *InstasliceReconciler) listPodAllocations(ctx context.Context, pod *v1.Pod) ([]inferencev1alpha1.InstasliceAllocation, error) {
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	if err := r.apiReader().List(ctx, &allocationList, client.InNamespace(pod.Namespace),
+		client.MatchingLabels{inferencev1alpha1.AllocationPodUIDLabel: string(pod.UID)}); err != nil {
+		return nil, err
+	}
+	return allocationList.Items, nil
+}
+
+// createAllocations creates the allocation objects of the pod, either all of them are created or none
+// so that the pod never waits on a partial set of slices.
+func (r *InstasliceReconciler) createAllocations(ctx context.Context, pod *v1.Pod, allocations map[string]inferencev1alpha1.AllocationDetails) error {
+	var created []*inferencev1alpha1.InstasliceAllocation
+	for _, name := range sortedAllocationNames(allocations) {
+		allocation := newInstasliceAllocation(pod, name, allocations[name])
+		err := r.Create(ctx, allocation)
+		if errors.IsAlreadyExists(err) {
+			// created by an earlier reconcile the cache has not caught up with yet
+			continue
+		}
+		if err != nil {
+			for _, rollback := range created {
+				errUpdating := updateAllocation(ctx, r.apiReader(), r.Client, client.ObjectKeyFromObject(rollback), func(allocation *inferencev1alpha1.InstasliceAllocation) bool {
+					return controllerutil.RemoveFinalizer(allocation, gateName)
+				})
+				if client.IgnoreNotFound(errUpdating) != nil {
+					log.FromContext(ctx).Error(errUpdating, "unable to remove finalizer of allocation", "allocation", rollback.Name)
+				}
+				if errDeleting := r.Delete(ctx, rollback); client.IgnoreNotFound(errDeleting) != nil {
+					log.FromContext(ctx).Error(errDeleting, "unable to roll back allocation", "allocation", rollback.Name)
+				}
+			}
+			return err
+		}
+		created = append(created, allocation)
+	}
+	return nil
+}
+
+// sortedAllocationNames returns the names of the allocations in a stable order.
+func sortedAllocationNames(allocations map[string]inferencev1alpha1.AllocationDetails) []string {
+	names := make([]string, 0, len(allocations))
+	for name := range allocations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transitionAllocation moves an allocation to the next status, rejecting transitions its lifecycle does not allow.
+func transitionAllocation(allocation *inferencev1alpha1.AllocationDetails, next inferencev1alpha1.AllocationStatus, reason string) error {
+	if !allocation.Allocationstatus.CanTransitionTo(next) {
+		return fmt.Errorf("illegal allocation status transition from %q to %q", allocation.Allocationstatus, next)
+	}
+	allocation.Allocationstatus = next
+	allocation.AllocationStatusReason = reason
+	return nil
+}
+
+// setAllocationStatus moves the latest version of an allocation to the next status.
+func setAllocationStatus(ctx context.Context, reader client.Reader, c client.Client, allocation *inferencev1alpha1.InstasliceAllocation, next inferencev1alpha1.AllocationStatus, reason string) error {
+	var errTransition error
+	err := updateAllocation(ctx, reader, c, client.ObjectKeyFromObject(allocation), func(latest *inferencev1alpha1.InstasliceAllocation) bool {
+		if latest.Spec.Allocationstatus == next && latest.Spec.AllocationStatusReason == reason {
+			return false
+		}
+		errTransition = transitionAllocation(&latest.Spec, next, reason)
+		return errTransition == nil
+	})
+	if errTransition != nil {
+		return errTransition
+	}
+	return err
+}
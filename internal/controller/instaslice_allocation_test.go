@@ -0,0 +1,327 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func newGatedTestPod(name string, uid types.UID) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: uid, Finalizers: []string{gateName}},
+		Spec: v1.PodSpec{
+			SchedulingGates: []v1.PodSchedulingGate{{Name: gateName}},
+			Containers: []v1.Container{{
+				Name: "vllm",
+				Resources: v1.ResourceRequirements{
+					Limits: v1.ResourceList{"nvidia.com/mig-3g.20gb": resource.MustParse("1")},
+				},
+			}},
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodPending,
+			Conditions: []v1.PodCondition{{Type: v1.PodScheduled, Message: "Scheduling is blocked due to non-empty scheduling gates"}},
+		},
+	}
+}
+
+func TestNewInstasliceAllocation(t *testing.T) {
+	pod := newGatedTestPod("vllm", "pod-1")
+	allocation := newInstasliceAllocation(pod, "pod-1-vllm-0", inferencev1alpha1.AllocationDetails{Nodename: "node-1", PodUUID: "pod-1"})
+
+	assert.Equal(t, "default", allocation.Namespace)
+	assert.Equal(t, "node-1", allocation.Labels[inferencev1alpha1.AllocationNodeLabel])
+	assert.Equal(t, "pod-1", allocation.Labels[inferencev1alpha1.AllocationPodUIDLabel])
+	assert.Equal(t, []string{gateName}, allocation.Finalizers)
+	assert.Equal(t, "Pod", allocation.OwnerReferences[0].Kind)
+	assert.Equal(t, types.UID("pod-1"), allocation.OwnerReferences[0].UID)
+}
+
+func TestReconcileAllocatesAndUngatesPod(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("vllm", "pod-1")
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), pod).Build()
+	recorder := record.NewFakeRecorder(100)
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}}
+
+	_, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "pod-1-vllm-0", allocations[0].Name)
+	assert.Equal(t, "node-1", allocations[0].Spec.Nodename)
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreating, allocations[0].Spec.Allocationstatus)
+	// one event on the pod and one on the Instaslice of the node
+	assert.Equal(t, "Normal SliceAllocated allocated 3g.20gb slice for container vllm on node node-1 GPU GPU-1 start 0", <-recorder.Events)
+	assert.Contains(t, <-recorder.Events, "of pod default/vllm")
+
+	// the daemonset realized the slice
+	assert.NoError(t, setAllocationStatus(ctx, r.Client, r.Client, &allocations[0], inferencev1alpha1.AllocationStatusCreated, ""))
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+
+	var ungatedPod v1.Pod
+	assert.NoError(t, fakeClient.Get(ctx, req.NamespacedName, &ungatedPod))
+	assert.Empty(t, ungatedPod.Spec.SchedulingGates)
+	assert.Equal(t, "Normal Ungated all 1 slices created, pod released to the scheduler", <-recorder.Events)
+	allocations, err = r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, inferencev1alpha1.AllocationStatusUngated, allocations[0].Spec.Allocationstatus)
+}
+
+func TestReconcileReleasesFailedAllocationsAndPlacesPodAgain(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("vllm", "pod-1")
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), pod).Build()
+	recorder := record.NewFakeRecorder(100)
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}}
+
+	_, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	<-recorder.Events
+	<-recorder.Events
+
+	// the daemonset could not realize the slice
+	assert.NoError(t, setAllocationStatus(ctx, r.Client, r.Client, &allocations[0], inferencev1alpha1.AllocationStatusFailed, "nvml: insufficient resources"))
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "Warning SliceFailed slice 3g.20gb for container vllm failed on node node-1: nvml: insufficient resources, releasing the slices of the pod to place it again",
+		<-recorder.Events)
+	allocations, err = r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, inferencev1alpha1.AllocationStatusReleasing, allocations[0].Spec.Allocationstatus)
+	assert.Equal(t, "SliceFailed", allocations[0].Spec.AllocationStatusReason)
+
+	// the daemonset removed the released allocation, the pod is placed again
+	allocations[0].Finalizers = nil
+	assert.NoError(t, fakeClient.Update(ctx, &allocations[0]))
+	assert.NoError(t, fakeClient.Delete(ctx, &allocations[0]))
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	allocations, err = r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreating, allocations[0].Spec.Allocationstatus)
+	var gatedPod v1.Pod
+	assert.NoError(t, fakeClient.Get(ctx, req.NamespacedName, &gatedPod))
+	assert.NotEmpty(t, gatedPod.Spec.SchedulingGates)
+}
+
+func TestReconcilePlacesAroundExistingAllocations(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	existing := newGatedTestPod("other", "pod-0")
+	existingAllocation := newInstasliceAllocation(existing, "pod-0-vllm-0", inferencev1alpha1.AllocationDetails{
+		Nodename: "node-1", PodUUID: "pod-0", GPUUUID: "GPU-1", Profile: "3g.20gb", Start: 0, Size: 4, Allocationstatus: inferencev1alpha1.AllocationStatusUngated,
+	})
+	pod := newGatedTestPod("vllm", "pod-1")
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), existingAllocation, pod).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: record.NewFakeRecorder(100)}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, uint32(4), allocations[0].Spec.Start)
+}
+
+func TestReconcilePlacesPodsBackToBackWithLaggingCache(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	first, second := newGatedTestPod("first", "pod-1"), newGatedTestPod("second", "pod-2")
+	apiServer := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), first, second).Build()
+	// the cache never sees the allocations created through it
+	cache := interceptor.NewClient(apiServer.(client.WithWatch), interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if _, isAllocationList := list.(*inferencev1alpha1.InstasliceAllocationList); isAllocationList {
+				return nil
+			}
+			return c.List(ctx, list, opts...)
+		},
+	})
+	r := &InstasliceReconciler{Client: cache, Scheme: s, Recorder: record.NewFakeRecorder(100), APIReader: apiServer}
+	t.Cleanup(func() {
+		pendingPods.remove(client.ObjectKeyFromObject(first))
+		pendingPods.remove(client.ObjectKeyFromObject(second))
+	})
+
+	for _, pod := range []*v1.Pod{first, second} {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(pod)})
+		assert.NoError(t, err)
+	}
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	assert.NoError(t, apiServer.List(ctx, &allocationList))
+	assert.Len(t, allocationList.Items, 2)
+	starts := map[string]uint32{}
+	for _, allocation := range allocationList.Items {
+		starts[allocation.Spec.PodUUID] = allocation.Spec.Start
+	}
+	assert.Equal(t, map[string]uint32{"pod-1": 0, "pod-2": 4}, starts)
+}
+
+func TestPodMapFunc(t *testing.T) {
+	r := &InstasliceReconciler{}
+	allocation := newInstasliceAllocation(newGatedTestPod("vllm", "pod-1"), "pod-1-vllm-0",
+		inferencev1alpha1.AllocationDetails{PodName: "vllm", Allocationstatus: inferencev1alpha1.AllocationStatusCreating})
+	assert.Empty(t, r.podMapFunc(context.Background(), allocation))
+
+	allocation.Spec.Allocationstatus = inferencev1alpha1.AllocationStatusCreated
+	assert.Equal(t, "vllm", r.podMapFunc(context.Background(), allocation)[0].Name)
+}
+
+func TestReconcileUsesInstaslicesOfItsNamespace(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	otherNode := newTestNode("node-1", "GPU-1")
+	node := newTestNode("node-2", "GPU-2")
+	node.Namespace = "instaslicev2-system"
+	pod := newGatedTestPod("vllm", "pod-1")
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(otherNode.Instaslice, node.Instaslice, newKubeNode("node-1"), newKubeNode("node-2"), pod).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Namespace: "instaslicev2-system", Recorder: record.NewFakeRecorder(100)}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "node-2", allocations[0].Spec.Nodename)
+}
+
+func TestTransitionAllocation(t *testing.T) {
+	tests := []struct {
+		from, to inferencev1alpha1.AllocationStatus
+		allowed  bool
+	}{
+		{"", inferencev1alpha1.AllocationStatusCreating, true},
+		{inferencev1alpha1.AllocationStatusCreating, inferencev1alpha1.AllocationStatusCreated, true},
+		{inferencev1alpha1.AllocationStatusCreating, inferencev1alpha1.AllocationStatusFailed, true},
+		{inferencev1alpha1.AllocationStatusCreated, inferencev1alpha1.AllocationStatusUngated, true},
+		{inferencev1alpha1.AllocationStatusUngated, inferencev1alpha1.AllocationStatusReleasing, true},
+		{inferencev1alpha1.AllocationStatusFailed, inferencev1alpha1.AllocationStatusReleasing, true},
+		{inferencev1alpha1.AllocationStatusReleasing, inferencev1alpha1.AllocationStatusDeleted, true},
+		{inferencev1alpha1.AllocationStatusCreated, inferencev1alpha1.AllocationStatusCreated, true},
+		{inferencev1alpha1.AllocationStatusDeleted, inferencev1alpha1.AllocationStatusCreated, false},
+		{inferencev1alpha1.AllocationStatusDeleted, inferencev1alpha1.AllocationStatusReleasing, false},
+		{inferencev1alpha1.AllocationStatusUngated, inferencev1alpha1.AllocationStatusCreated, false},
+		{inferencev1alpha1.AllocationStatusFailed, inferencev1alpha1.AllocationStatusCreated, false},
+		{inferencev1alpha1.AllocationStatusCreating, inferencev1alpha1.AllocationStatusDeleted, false},
+	}
+	for _, tt := range tests {
+		allocation := inferencev1alpha1.AllocationDetails{Allocationstatus: tt.from}
+		err := transitionAllocation(&allocation, tt.to, "reason")
+		if tt.allowed {
+			assert.NoError(t, err, "%q -> %q", tt.from, tt.to)
+			assert.Equal(t, tt.to, allocation.Allocationstatus)
+			assert.Equal(t, "reason", allocation.AllocationStatusReason)
+		} else {
+			assert.Error(t, err, "%q -> %q", tt.from, tt.to)
+			assert.Equal(t, tt.from, allocation.Allocationstatus)
+		}
+	}
+}
+
+func TestSetAllocationStatusRejectsIllegalTransition(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	allocation := newInstasliceAllocation(newGatedTestPod("vllm", "pod-1"), "pod-1-vllm-0",
+		inferencev1alpha1.AllocationDetails{PodName: "vllm", Allocationstatus: inferencev1alpha1.AllocationStatusDeleted})
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).WithObjects(allocation).Build()
+
+	assert.Error(t, setAllocationStatus(ctx, fakeClient, fakeClient, allocation, inferencev1alpha1.AllocationStatusCreated, ""))
+	var latest inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, fakeClient.Get(ctx, client.ObjectKeyFromObject(allocation), &latest))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusDeleted, latest.Spec.Allocationstatus)
+}
+
+func TestReconcileReleasesAllocationsOfDeletedPod(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("vllm", "pod-1")
+	pod.Spec.SchedulingGates = nil
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	ungated := newInstasliceAllocation(pod, "pod-1-vllm-0", inferencev1alpha1.AllocationDetails{
+		PodName: "vllm", PodUUID: "pod-1", Allocationstatus: inferencev1alpha1.AllocationStatusUngated,
+	})
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).WithObjects(pod, ungated).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: record.NewFakeRecorder(100)}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, inferencev1alpha1.AllocationStatusReleasing, allocations[0].Spec.Allocationstatus)
+	assert.Equal(t, "PodDeleted", allocations[0].Spec.AllocationStatusReason)
+}
+
+func TestReconcileRecordsInsufficientCapacity(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("vllm", "pod-1")
+	pod.Spec.Containers[0].Resources.Limits = v1.ResourceList{"nvidia.com/mig-7g.40gb": resource.MustParse("2")}
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), pod).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	assert.Contains(t, <-recorder.Events, "Warning InsufficientCapacity no node has room for the 2 slices requested by the pod")
+
+	// the pod is requeued while it waits, the event is not repeated
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.Empty(t, recorder.Events)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// computeInstanceProfilePattern matches the Nc.Mg.Xgb profiles of a compute instance of N compute slices
+// in a GPU instance of M compute slices, several of them share the GPU instance and its memory.
+var computeInstanceProfilePattern = regexp.MustCompile(`^(\d+)c\.(\d+)g\.\d+gb`)
+
+// computeInstanceProfileSlices is the number of compute slices of the compute instance profiles of NVML.
+var computeInstanceProfileSlices = map[int]int{
+	nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE: 1,
+	nvml.COMPUTE_INSTANCE_PROFILE_2_SLICE: 2,
+	nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE: 3,
+	nvml.COMPUTE_INSTANCE_PROFILE_4_SLICE: 4,
+	nvml.COMPUTE_INSTANCE_PROFILE_6_SLICE: 6,
+	nvml.COMPUTE_INSTANCE_PROFILE_7_SLICE: 7,
+	nvml.COMPUTE_INSTANCE_PROFILE_8_SLICE: 8,
+}
+
+// computeInstanceSlices returns the compute slices of a compute instance profile and of its GPU instance,
+// ok is false for profiles whose compute instance takes the whole GPU instance.
+func computeInstanceSlices(profileName string) (ciSlices, giSlices int, ok bool) {
+	match := computeInstanceProfilePattern.FindStringSubmatch(profileName)
+	if match == nil {
+		return 0, 0, false
+	}
+	ciSlices, _ = strconv.Atoi(match[1])
+	giSlices, _ = strconv.Atoi(match[2])
+	return ciSlices, giSlices, true
+}
+
+// computeInstanceProfiles returns the compute instance profiles smaller than a GPU instance profile. NVML cannot list
+// them without creating the GPU instance, so like go-nvlib they are derived from the layout of the compute slices.
+func computeInstanceProfiles(gi MigProfile, placements []inferencev1alpha1.Placement) []inferencev1alpha1.Mig {
+	ciProfileIDs := make([]int, 0, len(computeInstanceProfileSlices))
+	for ciProfileID := range computeInstanceProfileSlices {
+		ciProfileIDs = append(ciProfileIDs, ciProfileID)
+	}
+	sort.Ints(ciProfileIDs)
+	var migs []inferencev1alpha1.Mig
+	for _, ciProfileID := range ciProfileIDs {
+		slices := computeInstanceProfileSlices[ciProfileID]
+		if slices >= gi.G || slices*2 > gi.G+1 {
+			continue
+		}
+		profile := gi
+		profile.C = slices
+		profile.CIProfileID = ciProfileID
+		profile.CIEngProfileID = nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED
+		migs = append(migs, inferencev1alpha1.Mig{
+			Placements:     placements,
+			Profile:        profile.String(),
+			Giprofileid:    profile.GIProfileID,
+			CIProfileID:    profile.CIProfileID,
+			CIEngProfileID: profile.CIEngProfileID,
+		})
+	}
+	return migs
+}
+
+// sharedGPUInstanceStart returns the start of a GPU instance of the GPU whose compute instances leave room for
+// one more of the profile. Only GPU instances holding nothing but compute instances of the same GPU instance
+// profile are shared.
+func sharedGPUInstanceStart(node *gpuNode, gpuUUID string, profileName string) (uint32, bool) {
+	ciSlices, giSlices, ok := computeInstanceSlices(profileName)
+	if !ok {
+		return 0, false
+	}
+	var giProfileID int
+	var placements []inferencev1alpha1.Placement
+	for _, mig := range gpuMigPlacements(node.Instaslice, gpuUUID) {
+		if mig.Profile == profileName {
+			giProfileID = mig.Giprofileid
+			placements = append(placements, mig.Placements...)
+		}
+	}
+	sort.Slice(placements, func(i, j int) bool { return placements[i].Start < placements[j].Start })
+	for _, placement := range placements {
+		start, size := uint32(placement.Start), uint32(placement.Size)
+		used, shareable := 0, true
+		for _, prepared := range node.Spec.Prepared {
+			if prepared.Parent == gpuUUID && prepared.PodUUID == "" && prepared.Start == start && prepared.Size == size {
+				shareable = false
+			}
+		}
+		for _, allocation := range node.allocations {
+			if allocation.GPUUUID != gpuUUID || allocation.Start != start || allocation.Size != size {
+				continue
+			}
+			allocationSlices, _, isComputeInstance := computeInstanceSlices(allocation.Profile)
+			if !isComputeInstance || allocation.Giprofileid != giProfileID {
+				shareable = false
+				break
+			}
+			used += allocationSlices
+		}
+		if shareable && used > 0 && used+ciSlices <= giSlices {
+			return start, true
+		}
+	}
+	return 0, false
+}
+
+// gpuInstanceKey identifies a GPU instance on the GPUs of a node.
+func gpuInstanceKey(gpuUUID string, giID uint32) string {
+	return fmt.Sprintf("%s/%d", gpuUUID, giID)
+}
+
+// gpuInstanceRefCounts counts the compute instances of every GPU instance of a set of MIG devices.
+func gpuInstanceRefCounts(devices map[string]inferencev1alpha1.PreparedDetails) map[string]int32 {
+	refCounts := make(map[string]int32)
+	for _, device := range devices {
+		refCounts[gpuInstanceKey(device.Parent, device.Giinfoid)]++
+	}
+	return refCounts
+}
+
+// syncGPUInstanceRefCounts records on every prepared slice of the Instaslice how many compute instances share its GPU instance.
+func syncGPUInstanceRefCounts(ctx context.Context, c client.Client, instaslice *inferencev1alpha1.Instaslice) error {
+	refCounts := gpuInstanceRefCounts(instaslice.Spec.Prepared)
+	for migUUID, prepared := range instaslice.Spec.Prepared {
+		refCount := refCounts[gpuInstanceKey(prepared.Parent, prepared.Giinfoid)]
+		if prepared.GIRefCount == refCount {
+			continue
+		}
+		prepared.GIRefCount = refCount
+		if err := patchPreparedEntry(ctx, c, instaslice, migUUID, &prepared); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// sharedSliceRequest is a compute instance of 1c.3g.20gb in the GPU instance starting at slot 4 of a GPU.
+func sharedSliceRequest(gpuUUID string) SliceRequest {
+	return SliceRequest{GPUUUID: gpuUUID, Profile: "1c.3g.20gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_3_SLICE,
+		CIProfileID: nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, Start: 4, Size: 4, ShareGPUInstance: true}
+}
+
+func TestListComputeInstanceProfiles(t *testing.T) {
+	t.Parallel()
+	backend := NewDGXA100Backend()
+	assert.NoError(t, backend.Init())
+	placements, err := backend.ListPlacements()
+	assert.NoError(t, err)
+	assert.Len(t, placements, 1)
+	byProfile := make(map[string]inferencev1alpha1.Mig)
+	for _, mig := range placements["Mock NVIDIA A100-SXM4-40GB"] {
+		byProfile[mig.Profile] = mig
+	}
+	for _, profile := range []string{"1c.2g.10gb", "1c.3g.20gb", "2c.3g.20gb", "1c.4g.20gb", "2c.4g.20gb", "1c.7g.40gb", "4c.7g.40gb"} {
+		assert.Contains(t, byProfile, profile)
+	}
+	for _, profile := range []string{"3c.4g.20gb", "1c.1g.5gb", "7c.7g.40gb"} {
+		assert.NotContains(t, byProfile, profile)
+	}
+	assert.Equal(t, nvml.GPU_INSTANCE_PROFILE_3_SLICE, byProfile["2c.3g.20gb"].Giprofileid)
+	assert.Equal(t, nvml.COMPUTE_INSTANCE_PROFILE_2_SLICE, byProfile["2c.3g.20gb"].CIProfileID)
+	assert.Equal(t, byProfile["3g.20gb"].Placements, byProfile["2c.3g.20gb"].Placements)
+}
+
+func TestDGXA100BackendSharesGPUInstance(t *testing.T) {
+	t.Parallel()
+	backend := NewDGXA100Backend()
+	assert.NoError(t, backend.Init())
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	device := backend.(*dgxa100Backend).server.Devices[0].(*dgxa100.Device)
+
+	first, err := backend.CreateSlice(sharedSliceRequest(gpus[0].UUID))
+	assert.NoError(t, err)
+	second, err := backend.CreateSlice(sharedSliceRequest(gpus[0].UUID))
+	assert.NoError(t, err)
+	assert.Equal(t, first.GIID, second.GIID)
+	assert.NotEqual(t, first.CIID, second.CIID)
+	assert.NotEqual(t, first.MigUUID, second.MigUUID)
+	assert.Len(t, device.GpuInstances, 1)
+	// a whole GPU instance still may not overlap the shared one
+	_, err = backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "3g.20gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_3_SLICE,
+		CIProfileID: nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, Start: 4, Size: 4})
+	assert.Error(t, err)
+
+	assert.NoError(t, backend.DestroySlice(gpus[0].UUID, first.GIID, first.CIID, false))
+	assert.Len(t, device.GpuInstances, 1)
+	assert.NoError(t, backend.DestroySlice(gpus[0].UUID, second.GIID, second.CIID, true))
+	assert.Len(t, device.GpuInstances, 0)
+}
+
+func TestPlaceComputeInstancesInSharedGPUInstance(t *testing.T) {
+	r := &InstasliceReconciler{}
+	for _, policy := range []AllocationPolicy{&LeftToRightPolicy{}, &BestFitPolicy{}} {
+		node := newTestNode("node-1", "GPU-1")
+		node.Spec.Migplacement = append(node.Spec.Migplacement,
+			inferencev1alpha1.Mig{Profile: "1c.3g.20gb", Giprofileid: 2, CIProfileID: 0, Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 4}, {Start: 4, Size: 4}}},
+			inferencev1alpha1.Mig{Profile: "2c.3g.20gb", Giprofileid: 2, CIProfileID: 1, Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 4}, {Start: 4, Size: 4}}})
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "vllm", Namespace: "default", UID: "pod-1"}}
+		requests := []sliceRequest{
+			{containerName: "model", profileName: "1c.3g.20gb"},
+			{containerName: "model", profileName: "2c.3g.20gb", index: 1},
+			{containerName: "model", profileName: "2c.3g.20gb", index: 2},
+		}
+
+		_, allocations, err := r.findNodeForSlices(context.Background(), []gpuNode{*node}, requests, policy, pod)
+		assert.NoError(t, err)
+		// the 3 compute slices of a GPU instance are shared by the first two requests, the third takes a new one
+		assert.Equal(t, allocations["pod-1-model-0"].Start, allocations["pod-1-model-1"].Start)
+		assert.NotEqual(t, allocations["pod-1-model-0"].Start, allocations["pod-1-model-2"].Start)
+		assert.Equal(t, uint32(4), allocations["pod-1-model-2"].Size)
+	}
+}
+
+func TestExtractComputeInstanceProfileNames(t *testing.T) {
+	limits := v1.ResourceList{"nvidia.com/mig-1c.3g.20gb": resource.MustParse("2"), "nvidia.com/mig-1g.5gb": resource.MustParse("1")}
+	assert.Equal(t, []string{"1c.3g.20gb", "1c.3g.20gb", "1g.5gb"}, extractProfileNames(limits))
+}
+
+func TestCleanUpSharedGPUInstance(t *testing.T) {
+	ctx := context.Background()
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	device := backend.(*dgxa100Backend).server.Devices[0].(*dgxa100.Device)
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(&inferencev1alpha1.Instaslice{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}).Build()
+	reconciler := &InstaSliceDaemonsetReconciler{Client: fakeClient, Scheme: s, GPU: backend}
+	os.Setenv("NODE_NAME", "node-1")
+	defer os.Unsetenv("NODE_NAME")
+
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "node-1"}, &instaslice))
+	slices := map[string]Slice{}
+	for _, podUUID := range []string{"pod-1", "pod-2"} {
+		slice, err := backend.CreateSlice(sharedSliceRequest(gpus[0].UUID))
+		assert.NoError(t, err)
+		slices[podUUID] = slice
+		allocation := inferencev1alpha1.AllocationDetails{PodUUID: podUUID, Start: 4, Size: 4}
+		assert.NoError(t, reconciler.createPreparedEntry(ctx, "1c.3g.20gb", allocation, gpus[0].UUID, slice.GIID, slice.CIID, &instaslice, slice.MigUUID))
+	}
+	assert.Equal(t, int32(2), instaslice.Spec.Prepared[slices["pod-1"].MigUUID].GIRefCount)
+	assert.Equal(t, int32(2), instaslice.Spec.Prepared[slices["pod-2"].MigUUID].GIRefCount)
+
+	// the GPU instance outlives the first compute instance released
+	assert.NoError(t, reconciler.cleanUp(ctx, "pod-1"))
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "node-1"}, &instaslice))
+	assert.Len(t, instaslice.Spec.Prepared, 1)
+	assert.Equal(t, int32(1), instaslice.Spec.Prepared[slices["pod-2"].MigUUID].GIRefCount)
+	assert.Len(t, device.GpuInstances, 1)
+
+	assert.NoError(t, reconciler.cleanUp(ctx, "pod-2"))
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "node-1"}, &instaslice))
+	assert.Empty(t, instaslice.Spec.Prepared)
+	assert.Len(t, device.GpuInstances, 0)
+}
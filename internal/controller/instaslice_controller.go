@@ -19,8 +19,11 @@ package controller
 import (
 	"context"
 	"fmt"
+	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
@@ -29,6 +32,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -42,10 +46,55 @@ type InstasliceReconciler struct {
 	client.Client
 	Scheme     *runtime.Scheme
 	kubeClient *kubernetes.Clientset
+	// DefaultPolicy is the allocation policy name used for pods without the policy annotation.
+	DefaultPolicy string
+	// Namespace is where the Instaslice objects of the nodes live.
+	Namespace string
+	// Recorder emits the allocation steps as events on pods and Instaslice objects.
+	Recorder record.EventRecorder
+	// QueueOrdering is how the admission queue orders gated pods, by priority unless it is fifo.
+	QueueOrdering string
+	// QueueBackfill lets pods behind the head of the admission queue take placements it does not hold.
+	QueueBackfill bool
+	// reservations holds the placements freed by preemption for higher priority pods
+	// and the placement held for the head of the admission queue.
+	reservations preemptionReservations
+	// queue orders the gated pods waiting for their slices to be placed.
+	queue admissionQueue
+	// placing serializes placement so pods reconciled concurrently never get the same slots.
+	placing sync.Mutex
+	// reservationsRestored is set once the reservations recorded on the gated pods are loaded, guarded by placing.
+	reservationsRestored bool
+	// APIReader reads the allocations placement and writes start from without going through the cache, which may
+	// not have caught up yet with the allocations created for the pods placed just before. Client is used when nil.
+	APIReader client.Reader
 }
 
-// AllocationPolicy interface with a single method
+const (
+	FirstFitPolicyName    = "firstfit"
+	LeftToRightPolicyName = "lefttoright"
+	RightToLeftPolicyName = "righttoleft"
+	BestFitPolicyName     = "bestfit"
+	// allocationPolicyAnnotation lets a pod override the allocation policy of the controller.
+	allocationPolicyAnnotation = "instaslice.codeflare.dev/allocation-policy"
+	// InstasliceNamespaceEnv holds the namespace of the Instaslice objects, it is set from the namespace
+	// the controller and daemonset are deployed in.
+	InstasliceNamespaceEnv = "INSTASLICE_NAMESPACE"
+)
+
+// DefaultInstasliceNamespace returns the namespace of the Instaslice objects from the environment,
+// falling back to the default namespace.
+func DefaultInstasliceNamespace() string {
+	if namespace := os.Getenv(InstasliceNamespaceEnv); namespace != "" {
+		return namespace
+	}
+	return "default"
+}
+
+// AllocationPolicy decides where a slice is placed on a GPU and builds the allocation for it.
 type AllocationPolicy interface {
+	// SortPlacementStarts orders the discovered start indexes of a profile, the first free one is allocated.
+	SortPlacementStarts(starts []int)
 	SetAllocationDetails(profileName string, newStart, size uint32, podUUID string, nodename string, processed string, discoveredGiprofile int, Ciprofileid int, Ciengprofileid int, namespace string, podName string, gpuUuid string) *inferencev1alpha1.AllocationDetails
 }
 
@@ -58,20 +107,26 @@ type FirstFitPolicy struct{}
 //+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslices,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslices/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslices/finalizers,verbs=update
+//+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instasliceallocations,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslicequotas,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=pods/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=pods/eviction,verbs=create
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;create;update;patch;delete
 
-func (r *InstasliceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *InstasliceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	defer func() { recordRequeue("instaslice", result, err) }()
 
-	var policy AllocationPolicy
-	policy = &FirstFitPolicy{}
 	pod := &v1.Pod{}
 	var isPodGated = false
-	err := r.Get(ctx, req.NamespacedName, pod)
+	err = r.Get(ctx, req.NamespacedName, pod)
 	if err != nil {
 		// Error fetching the Pod
 		if errors.IsNotFound(err) {
 			log.FromContext(ctx).Error(err, "unable to fetch pod might be deleted")
+			pendingPods.remove(req.NamespacedName)
+			r.queue.remove(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		log.FromContext(ctx).Error(err, "unable to fetch pod")
@@ -79,12 +134,12 @@ func (r *InstasliceReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 
 	isPodGated = checkIfPodGated(pod, isPodGated)
-
-	var instasliceList inferencev1alpha1.InstasliceList
-
-	if err := r.List(ctx, &instasliceList, &client.ListOptions{}); err != nil {
-		log.FromContext(ctx).Error(err, "Error listing Instaslice")
+	if !isPodGated || !pod.DeletionTimestamp.IsZero() {
+		pendingPods.remove(req.NamespacedName)
+		r.queue.remove(req.NamespacedName)
+		r.reservations.remove(pod.UID)
 	}
+
 	// handles graceful termination of pods, wait for about 30 seconds from the time deletiontimestamp is set on the pod
 	if !pod.DeletionTimestamp.IsZero() && isPodGated {
 		if controllerutil.RemoveFinalizer(pod, "org.instaslice/accelarator") {
@@ -97,195 +152,415 @@ func (r *InstasliceReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 	}
 	if !pod.DeletionTimestamp.IsZero() {
-		log.FromContext(ctx).Info("set status to deleted for ", "pod", pod.Name)
+		log.FromContext(ctx).Info("set status to releasing for ", "pod", pod.Name)
 		if controllerutil.ContainsFinalizer(pod, "org.instaslice/accelarator") {
-			for _, instaslice := range instasliceList.Items {
-				for podUuid, allocation := range instaslice.Spec.Allocations {
-					if podUuid == string(pod.UID) {
-						elapsed := time.Since(pod.DeletionTimestamp.Time)
-						if elapsed > 30*time.Second {
-							if controllerutil.RemoveFinalizer(pod, "org.instaslice/accelarator") {
-								if err := r.Update(ctx, pod); err != nil {
-									log.FromContext(ctx).Info("unable to update removal of finalizer, retrying")
-									return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
-								}
-								log.FromContext(ctx).Info("finalizer deleted")
-								allocation.Allocationstatus = "deleted"
-								var updateInstasliceObject inferencev1alpha1.Instaslice
-								typeNamespacedName := types.NamespacedName{
-									Name:      instaslice.Name,
-									Namespace: "default", // TODO: modify
-								}
-								err := r.Get(ctx, typeNamespacedName, &updateInstasliceObject)
-								if err != nil {
-									log.FromContext(ctx).Error(err, "error getting latest instaslice object")
-								}
-								updateInstasliceObject.Spec.Allocations[podUuid] = allocation
-								errUpdatingInstaslice := r.Update(ctx, &updateInstasliceObject)
-								if errUpdatingInstaslice != nil {
-									log.FromContext(ctx).Info("unable to set instaslice to state deleted for ", "pod", allocation.PodName)
-									return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
-								}
-							}
-
-						} else {
-							remainingTime := 30*time.Second - elapsed
-							return ctrl.Result{RequeueAfter: remainingTime}, nil
-						}
-					}
+			podAllocations, err := r.listPodAllocations(ctx, pod)
+			if err != nil {
+				log.FromContext(ctx).Error(err, "Error listing allocations for ", "pod", pod.Name)
+				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+			}
+			if len(podAllocations) > 0 {
+				elapsed := time.Since(pod.DeletionTimestamp.Time)
+				if elapsed <= 30*time.Second {
+					remainingTime := 30*time.Second - elapsed
+					return ctrl.Result{RequeueAfter: remainingTime}, nil
+				}
+			}
+			// all slices of the pod are released before the finalizer goes away so none are leaked
+			for i := range podAllocations {
+				if podAllocations[i].Spec.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted {
+					continue
+				}
+				if err := setAllocationStatus(ctx, r.apiReader(), r.Client, &podAllocations[i], inferencev1alpha1.AllocationStatusReleasing, "PodDeleted"); err != nil {
+					log.FromContext(ctx).Error(err, "unable to set allocation to state releasing for ", "pod", pod.Name)
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 				}
-
+			}
+			if controllerutil.RemoveFinalizer(pod, "org.instaslice/accelarator") {
+				if err := r.Update(ctx, pod); err != nil {
+					log.FromContext(ctx).Info("unable to update removal of finalizer, retrying")
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+				}
+				log.FromContext(ctx).Info("finalizer deleted")
 			}
 		}
 		//exit after handling deletion event for a pod.
 		return ctrl.Result{}, nil
 	}
 
-	// find allocation in the cluster for the pod
-	// set allocationstatus to creating when controller adds the allocation
-	// check for allocationstatus as created when daemonset is done realizing the slice on the GPU node.
+	// find allocations in the cluster for the pod, one per MIG slice requested by its containers
+	// set allocationstatus to creating when controller adds the allocations
+	// check for allocationstatus as created when daemonset is done realizing all slices on the GPU node.
 	// set allocationstatus to ungated and ungate the pod so that the workload can begin execution.
 	if isPodGated {
-		//Assume pod only has one container with one GPU requests
-		if len(pod.Spec.Containers) != 1 {
-			return ctrl.Result{}, fmt.Errorf("multiple containers per pod not supported")
-		}
-		limits := pod.Spec.Containers[0].Resources.Limits
-		profileName := r.extractProfileName(limits)
-		for _, instaslice := range instasliceList.Items {
-			for podUuid, allocations := range instaslice.Spec.Allocations {
-				if allocations.Allocationstatus == "created" && allocations.PodUUID == string(pod.UID) {
-					pod := r.unGatePod(pod)
-					errForUngating := r.Update(ctx, pod)
-					if errForUngating != nil {
-						//pod updates are retried as controller is the only entiting working on pod updates.
-						return ctrl.Result{Requeue: true}, nil
-					}
-					allocations.Allocationstatus = "ungated"
-					instaslice.Spec.Allocations[podUuid] = allocations
-					var updateInstasliceObject inferencev1alpha1.Instaslice
-					typeNamespacedName := types.NamespacedName{
-						Name:      instaslice.Name,
-						Namespace: "default", // TODO: modify
-					}
-					err := r.Get(ctx, typeNamespacedName, &updateInstasliceObject)
-					if err != nil {
-						log.FromContext(ctx).Error(err, "error getting latest instaslice object")
-					}
-					if updateInstasliceObject.Spec.Allocations == nil {
-						updateInstasliceObject.Spec.Allocations = make(map[string]inferencev1alpha1.AllocationDetails)
-					}
-					updateInstasliceObject.Spec.Allocations[podUuid] = allocations
-					if err := r.Update(ctx, &updateInstasliceObject); err != nil {
-						log.FromContext(ctx).Error(err, "Error updating instaslice allocations")
-						return ctrl.Result{Requeue: true}, nil
-					}
+		requests := podSliceRequests(pod)
+		if len(requests) == 0 {
+			log.FromContext(ctx).Info("no MIG slice requested by ", "pod", pod.Name)
+			return ctrl.Result{}, nil
+		}
+		var profiles []string
+		for _, request := range requests {
+			profiles = append(profiles, request.displayName())
+		}
+		pendingPods.set(req.NamespacedName, profiles)
+		policy := r.policyForPod(ctx, pod)
+		podAllocations, err := r.listPodAllocations(ctx, pod)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Error listing allocations for ", "pod", pod.Name)
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		if len(podAllocations) > 0 {
+			r.queue.remove(req.NamespacedName)
+			for _, allocation := range podAllocations {
+				if allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusFailed {
+					//the slices of the pod are released so it is placed again once the daemonset removed its allocations.
+					log.FromContext(ctx).Info("slice failed for ", "pod", pod.Name, "allocation", allocation.Name, "reason", allocation.Spec.AllocationStatusReason)
+					return r.releaseFailedAllocations(ctx, pod, podAllocations, allocation)
+				}
+				if allocation.Spec.Allocationstatus != inferencev1alpha1.AllocationStatusCreated {
+					//daemonset is yet to realize the slices, it will enqueue the pod once created.
 					return ctrl.Result{}, nil
 				}
 			}
-		}
-		//pod does not have an allocation yet, make allocation
-		//Find the node
-		podHasNodeAllocation := false
-		for _, instaslice := range instasliceList.Items {
-			//Find the GPU on the node and the GPU index where the slice can be created
-			allocDetails, err := r.findDeviceForASlice(&instaslice, profileName, policy, pod)
-			if err != nil {
-				log.FromContext(ctx).Info("sufficient capacity not available to allocate GPU for ", "pod", pod.Name, "node", instaslice.Name)
-				continue
-			}
-			podHasNodeAllocation = true
-			for _, item := range instaslice.Spec.Prepared {
-				if item.Parent == allocDetails.GPUUUID && item.Size == allocDetails.Size && item.Start == allocDetails.Start {
-					log.FromContext(ctx).Info("prepared allocation is yet to be deleted, retrying new allocation")
-					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
-				}
+			pod := r.unGatePod(pod)
+			delete(pod.Annotations, queuePositionAnnotation)
+			delete(pod.Annotations, reservationAnnotation)
+			errForUngating := r.Update(ctx, pod)
+			if errForUngating != nil {
+				//pod updates are retried as controller is the only entiting working on pod updates.
+				return ctrl.Result{Requeue: true}, nil
 			}
-			if podHasNodeAllocation {
-				var updateInstasliceObject inferencev1alpha1.Instaslice
-				typeNamespacedName := types.NamespacedName{
-					Name:      instaslice.Name,
-					Namespace: "default", // TODO: modify
-				}
-				err := r.Get(ctx, typeNamespacedName, &updateInstasliceObject)
-				if err != nil {
-					log.FromContext(ctx).Error(err, "error getting latest instaslice object")
-				}
-				log.FromContext(ctx).Info("allocation obtained for ", "pod", allocDetails.PodName)
-				if updateInstasliceObject.Spec.Allocations == nil {
-					updateInstasliceObject.Spec.Allocations = make(map[string]inferencev1alpha1.AllocationDetails)
-				}
-				updateInstasliceObject.Spec.Allocations[string(pod.UID)] = *allocDetails
-				if err := r.Update(ctx, &updateInstasliceObject); err != nil {
+			for i := range podAllocations {
+				if err := setAllocationStatus(ctx, r.apiReader(), r.Client, &podAllocations[i], inferencev1alpha1.AllocationStatusUngated, ""); err != nil {
 					log.FromContext(ctx).Error(err, "Error updating instaslice allocations")
 					return ctrl.Result{Requeue: true}, nil
 				}
-			} else {
-				log.FromContext(ctx).Info("requeuing, cluster does not have resources for ", "pod", pod.Name)
-				return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
 			}
+			r.Recorder.Eventf(pod, v1.EventTypeNormal, EventReasonUngated, "all %d slices created, pod released to the scheduler", len(podAllocations))
+			pendingPods.remove(req.NamespacedName)
+			observeAllocationLatency(stageUngated, pod.CreationTimestamp.Time)
+			return ctrl.Result{}, nil
+		}
+
+		//pod waits in the admission queue until its slices are placed
+		r.queue.add(pod)
+		position, ahead := r.queue.position(req.NamespacedName, r.QueueOrdering)
+		if err := r.setQueuePosition(ctx, pod, position); err != nil {
+			log.FromContext(ctx).Error(err, "unable to set queue position of ", "pod", pod.Name)
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		r.placing.Lock()
+		defer r.placing.Unlock()
+		if err := r.restoreReservations(ctx); err != nil {
+			log.FromContext(ctx).Error(err, "Error restoring reservations")
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		var instasliceList inferencev1alpha1.InstasliceList
+		if err := r.List(ctx, &instasliceList, client.InNamespace(r.Namespace)); err != nil {
+			log.FromContext(ctx).Error(err, "Error listing Instaslice")
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		var allocationList inferencev1alpha1.InstasliceAllocationList
+		if err := r.apiReader().List(ctx, &allocationList, &client.ListOptions{}); err != nil {
+			log.FromContext(ctx).Error(err, "Error listing allocations")
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		//pod does not have allocations yet, the slices it requests have to fit in the quotas of its namespace
+		violation, err := r.checkQuotas(ctx, pod.Namespace, requestedUsage(requests, instasliceList.Items), allocationList.Items)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Error checking quotas for ", "pod", pod.Name)
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 		}
-		//if the cluster does not have suitable node, requeue request
-		if !podHasNodeAllocation {
+		if violation != "" {
+			log.FromContext(ctx).Info("quota exceeded for ", "pod", pod.Name, "reason", violation)
+			r.recordQueueEvent(pod, v1.EventTypeWarning, EventReasonQuotaExceeded, violation)
+			r.queue.setBlocked(req.NamespacedName, true)
+			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+		}
+		r.queue.setBlocked(req.NamespacedName, false)
+		if blocker, exists := r.queueBlocker(ahead); exists {
+			log.FromContext(ctx).Info("waiting in admission queue for ", "pod", pod.Name, "position", position, "behind", blocker.pod)
+			r.recordQueueEvent(pod, v1.EventTypeNormal, EventReasonQueued, fmt.Sprintf("position %d in the admission queue, waiting for pod %s to be placed", position, blocker.pod))
+			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+		}
+		//make allocations
+		//Find the node, GPUs on the node and the GPU indexes where all slices of the pod can be created
+		nodes, mismatches, err := r.schedulableNodes(ctx, pod, newGpuNodes(instasliceList.Items, allocationList.Items))
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Error listing nodes")
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		if len(nodes) == 0 {
+			//node labels and taints may change, the pod does not hold the head of the queue meanwhile
+			log.FromContext(ctx).Info("no node matches the scheduling constraints of ", "pod", pod.Name, "mismatches", mismatches)
+			r.recordQueueEvent(pod, v1.EventTypeWarning, EventReasonNoMatchingNode, fmt.Sprintf("no node with GPUs matches the scheduling constraints of the pod: %s", strings.Join(mismatches, "; ")))
+			r.queue.setBlocked(req.NamespacedName, true)
+			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+		}
+		r.reservations.holdOnNodes(nodes, pod.UID)
+		node, allocations, err := r.findNodeForSlices(ctx, nodes, requests, policy, pod)
+		if err != nil {
+			if r.preemptForPod(ctx, pod, nodes, requests, policy) {
+				//the pod is placed once the slices of the preempted pods are released
+				return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+			}
+			//the head of the queue is placed once the slices overlapping the placement it holds are released
+			r.reserveHeadOfLine(ctx, pod, nodes, requests, policy)
 			log.FromContext(ctx).Info("no suitable node found in cluster for ", "pod", pod.Name)
+			r.recordQueueEvent(pod, v1.EventTypeWarning, EventReasonInsufficientCapacity, fmt.Sprintf("no node has room for the %d slices requested by the pod: %v", len(requests), err))
 			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
 		}
-
+		//slices requested by size are charged by the profiles they got on the chosen node
+		violation, err = r.checkQuotas(ctx, pod.Namespace, allocationsUsage(allocations), allocationList.Items)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Error checking quotas for ", "pod", pod.Name)
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+		if violation != "" {
+			log.FromContext(ctx).Info("quota exceeded for ", "pod", pod.Name, "reason", violation)
+			r.recordQueueEvent(pod, v1.EventTypeWarning, EventReasonQuotaExceeded, violation)
+			r.queue.setBlocked(req.NamespacedName, true)
+			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+		}
+		for _, allocDetails := range allocations {
+			for _, item := range node.Spec.Prepared {
+				if isWarmSlice(item) {
+					continue
+				}
+				if item.Parent == allocDetails.GPUUUID && item.Size == allocDetails.Size && item.Start == allocDetails.Start {
+					log.FromContext(ctx).Info("prepared allocation is yet to be deleted, retrying new allocation")
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+				}
+			}
+		}
+		log.FromContext(ctx).Info("allocation obtained for ", "pod", pod.Name, "node", node.Name, "slices", len(allocations))
+		if err := r.createAllocations(ctx, pod, allocations); err != nil {
+			log.FromContext(ctx).Error(err, "Error creating instaslice allocations")
+			return ctrl.Result{Requeue: true}, nil
+		}
+		r.releaseReservation(ctx, pod)
+		r.queue.remove(req.NamespacedName)
+		for _, name := range sortedAllocationNames(allocations) {
+			allocation := allocations[name]
+			message := fmt.Sprintf("allocated %s slice for container %s on node %s GPU %s start %d",
+				allocation.Profile, allocation.ContainerName, allocation.Nodename, allocation.GPUUUID, allocation.Start)
+			r.Recorder.Event(pod, v1.EventTypeNormal, EventReasonSliceAllocated, message)
+			r.Recorder.Eventf(node.Instaslice, v1.EventTypeNormal, EventReasonSliceAllocated, "%s of pod %s/%s", message, pod.Namespace, pod.Name)
+		}
+		observeAllocationLatency(stageCreating, pod.CreationTimestamp.Time)
 	}
 
 	// no gated pod or dangling reference found
 	return ctrl.Result{}, nil
 }
 
-func (r *InstasliceReconciler) findDeviceForASlice(instaslice *inferencev1alpha1.Instaslice, profileName string, policy AllocationPolicy, pod *v1.Pod) (*inferencev1alpha1.AllocationDetails, error) {
-	//TODO: discover this value, this may work for A100 and H100 for now.
-	for gpuuuid, _ := range instaslice.Spec.MigGPUUUID {
-		if instaslice.Spec.Allocations == nil {
-			instaslice.Spec.Allocations = make(map[string]inferencev1alpha1.AllocationDetails)
+// sliceRequest is a single MIG slice requested by a container of a pod, a container asking for
+// more than one slice of a profile produces one request per slice. A request for a size has no
+// profile until it is resolved against the profiles of a node.
+type sliceRequest struct {
+	containerName string
+	profileName   string
+	size          *sliceSize
+	index         int
+}
+
+// displayName returns the profile of the request, or the size it asks for when it has none yet.
+func (s sliceRequest) displayName() string {
+	if s.profileName == "" && s.size != nil {
+		return s.size.String()
+	}
+	return s.profileName
+}
+
+// allocationKey returns the key of the allocation of the request in the Instaslice.
+func (s sliceRequest) allocationKey(pod *v1.Pod) string {
+	return fmt.Sprintf("%s-%s-%d", pod.UID, s.containerName, s.index)
+}
+
+// podSliceRequests returns the slices requested by all containers of the pod, a slice requested
+// by size through the pod annotations goes to the first container.
+func podSliceRequests(pod *v1.Pod) []sliceRequest {
+	var requests []sliceRequest
+	for _, container := range pod.Spec.Containers {
+		for i, profileName := range extractProfileNames(container.Resources.Limits) {
+			requests = append(requests, sliceRequest{containerName: container.Name, profileName: profileName, index: i})
+		}
+	}
+	size, err := podSliceSize(pod)
+	if err != nil {
+		log.Log.Error(err, "ignoring slice size requested by ", "pod", pod.Name)
+	}
+	if size != nil && len(pod.Spec.Containers) > 0 {
+		container := pod.Spec.Containers[0]
+		index := len(extractProfileNames(container.Resources.Limits))
+		requests = append(requests, sliceRequest{containerName: container.Name, size: size, index: index})
+	}
+	return requests
+}
+
+// findNodeForSlices picks the node all slices of the pod will be created on along with their allocations
+// keyed by allocation name. A pod runs on a single node so every request has to fit there, policies that
+// do not compare placements take the first node handing out the most slices of its warm pool.
+func (r *InstasliceReconciler) findNodeForSlices(ctx context.Context, nodes []gpuNode, requests []sliceRequest, policy AllocationPolicy, pod *v1.Pod) (*gpuNode, map[string]inferencev1alpha1.AllocationDetails, error) {
+	selector, isSelector := policy.(PlacementSelector)
+	var candidates []gpuNode
+	allocationsByNode := make(map[string]map[string]inferencev1alpha1.AllocationDetails)
+	var firstFit *gpuNode
+	mostClaimed := 0
+	for i := range nodes {
+		allocations, err := r.placeSlicesOnNode(&nodes[i], requests, policy, pod)
+		if err != nil {
+			log.FromContext(ctx).Info("sufficient capacity not available to allocate GPU for ", "pod", pod.Name, "node", nodes[i].Name)
+			continue
+		}
+		candidates = append(candidates, nodes[i])
+		allocationsByNode[nodes[i].Name] = allocations
+		if isSelector {
+			continue
+		}
+		claimed := warmSlicesClaimed(&nodes[i], allocations)
+		if claimed == len(allocations) {
+			return &nodes[i], allocations, nil
+		}
+		if firstFit == nil || claimed > mostClaimed {
+			firstFit, mostClaimed = &nodes[i], claimed
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("failed to find node with allocatable gpu")
+	}
+	if !isSelector {
+		return firstFit, allocationsByNode[firstFit.Name], nil
+	}
+	// the selector ranks the nodes able to host every slice by how well all slices fit on each of them,
+	// slices requested by size got the profile of the node they are placed on
+	node, err := selector.SelectNode(candidates, allocationsByNode)
+	if err != nil {
+		return nil, nil, err
+	}
+	return node, allocationsByNode[node.Name], nil
+}
+
+// placeSlicesOnNode allocates the requests on the node, the slices of a pod asking for a topology
+// are all placed on the first group of GPUs of the node they fit on. Requests for a size get the
+// smallest profile of the node that satisfies them.
+func (r *InstasliceReconciler) placeSlicesOnNode(original *gpuNode, requests []sliceRequest, policy AllocationPolicy, pod *v1.Pod) (map[string]inferencev1alpha1.AllocationDetails, error) {
+	requests, err := resolveSliceRequests(original.Instaslice, requests)
+	if err != nil {
+		return nil, err
+	}
+	topology, exists := pod.Annotations[topologyAnnotation]
+	if !exists {
+		return r.placeSlicesOnGPUs(original, requests, policy, pod)
+	}
+	groups, err := topologyGroups(original.Instaslice, topology)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if allocations, err := r.placeSlicesOnGPUs(original.withGPUs(group), requests, policy, pod); err == nil {
+			return allocations, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s group of GPUs has room for all slices", topology)
+}
+
+// placeSlicesOnGPUs allocates the requests one after another on a copy of the node so
+// later requests see the slots taken by earlier ones. A request that does not fit next to
+// the warm pool of the node takes the place of its slices.
+func (r *InstasliceReconciler) placeSlicesOnGPUs(original *gpuNode, requests []sliceRequest, policy AllocationPolicy, pod *v1.Pod) (map[string]inferencev1alpha1.AllocationDetails, error) {
+	node := original.copyWithAllocations()
+	allocations := make(map[string]inferencev1alpha1.AllocationDetails)
+	for _, request := range requests {
+		allocDetails, err := r.placeSlice(node, request.profileName, policy, pod)
+		if err != nil {
+			if allocDetails, err = r.placeSlice(node.withoutWarmPool(), request.profileName, policy, pod); err != nil {
+				return nil, err
+			}
+		}
+		allocDetails.ContainerName = request.containerName
+		allocDetails.ConfigMapName = sliceConfigMapName(pod, request.containerName)
+		allocDetails.CapacityResource = string(podCapacityResource(pod))
+		key := request.allocationKey(pod)
+		node.allocations[key] = *allocDetails
+		allocations[key] = *allocDetails
+	}
+	return allocations, nil
+}
+
+// placeSlice allocates a slice of the profile on a GPU of the node.
+func (r *InstasliceReconciler) placeSlice(node *gpuNode, profileName string, policy AllocationPolicy, pod *v1.Pod) (*inferencev1alpha1.AllocationDetails, error) {
+	if selector, ok := policy.(PlacementSelector); ok {
+		candidate, err := selector.SelectPlacement([]gpuNode{*node}, profileName)
+		if err != nil {
+			return nil, err
 		}
-		newStart := r.getStartIndexFromPreparedState(instaslice, gpuuuid, profileName)
-		//size cannot be 9 atleast for A100s 40GB/80GB and H100 variants
-		notValidIndex := uint32(9)
-		if newStart == notValidIndex {
+		return r.newAllocationForPlacement(node.Instaslice, profileName, candidate.gpuUUID, candidate.start, policy, pod), nil
+	}
+	return r.findDeviceForASlice(node, profileName, policy, pod)
+}
+
+func (r *InstasliceReconciler) findDeviceForASlice(node *gpuNode, profileName string, policy AllocationPolicy, pod *v1.Pod) (*inferencev1alpha1.AllocationDetails, error) {
+	// map order is random, GPUs are tried in UUID order so the policies place slices the same way on every reconcile
+	gpuUUIDs := make([]string, 0, len(node.Spec.MigGPUUUID))
+	for gpuUUID := range node.Spec.MigGPUUUID {
+		gpuUUIDs = append(gpuUUIDs, gpuUUID)
+	}
+	sort.Strings(gpuUUIDs)
+	for _, gpuuuid := range gpuUUIDs {
+		newStart, found := r.getStartIndexFromPreparedState(node, gpuuuid, profileName, policy)
+		if !found {
 			//Move to next GPU
 			continue
 		}
-		size, discoveredGiprofile, Ciprofileid, Ciengprofileid := r.extractGpuProfile(instaslice, profileName)
-		allocDetails := policy.SetAllocationDetails(profileName, uint32(newStart), uint32(size),
-			string(pod.UID), instaslice.Name, "creating", discoveredGiprofile,
-			Ciprofileid, Ciengprofileid, pod.Namespace, pod.Name, gpuuuid)
-		//instaslice.Spec.Allocations[string(pod.UID)] = *allocDetails
-		return allocDetails, nil
+		return r.newAllocationForPlacement(node.Instaslice, profileName, gpuuuid, newStart, policy, pod), nil
 	}
 
 	return nil, fmt.Errorf("failed to find allocatable gpu")
 }
 
-// Extract profile name from the container limits spec
-func (*InstasliceReconciler) extractProfileName(limits v1.ResourceList) string {
-	profileName := ""
-	for k, _ := range limits {
-		if strings.Contains(k.String(), "nvidia") {
+// newAllocationForPlacement builds the allocation of a pod for a slice starting at start on a GPU of the node.
+func (r *InstasliceReconciler) newAllocationForPlacement(instaslice *inferencev1alpha1.Instaslice, profileName string, gpuuuid string, start uint32, policy AllocationPolicy, pod *v1.Pod) *inferencev1alpha1.AllocationDetails {
+	size, discoveredGiprofile, Ciprofileid, Ciengprofileid := r.extractGpuProfile(instaslice, gpuuuid, profileName)
+	return policy.SetAllocationDetails(profileName, start, uint32(size),
+		string(pod.UID), instaslice.Name, string(inferencev1alpha1.AllocationStatusCreating), discoveredGiprofile,
+		Ciprofileid, Ciengprofileid, pod.Namespace, pod.Name, gpuuuid)
+}
 
-			re := regexp.MustCompile(`(\d+g\.\d+gb)`)
-			match := re.FindStringSubmatch(k.String())
-			if len(match) > 1 {
-				profileName = match[1]
-			} else {
-				log.Log.Info("No match found")
-			}
+// Extract profile names from the container limits spec, a profile is repeated once per requested slice.
+// Compute instance profiles keep their Nc. prefix.
+func extractProfileNames(limits v1.ResourceList) []string {
+	re := regexp.MustCompile(`((?:\d+c\.)?\d+g\.\d+gb)`)
+	var resourceNames []string
+	for k := range limits {
+		if strings.Contains(k.String(), "nvidia") {
+			resourceNames = append(resourceNames, k.String())
+		}
+	}
+	// map order is random, keep the request indexes stable across reconciles
+	sort.Strings(resourceNames)
+	var profileNames []string
+	for _, resourceName := range resourceNames {
+		match := re.FindStringSubmatch(resourceName)
+		if len(match) <= 1 {
+			log.Log.Info("No match found")
+			continue
+		}
+		quantity := limits[v1.ResourceName(resourceName)]
+		for i := int64(0); i < quantity.Value(); i++ {
+			profileNames = append(profileNames, match[1])
 		}
 	}
-	return profileName
+	return profileNames
 }
 
 // Extract NVML specific attributes for GPUs, this will change for different generations of the GPU.
-func (*InstasliceReconciler) extractGpuProfile(instaslice *inferencev1alpha1.Instaslice, profileName string) (int, int, int, int) {
+func (*InstasliceReconciler) extractGpuProfile(instaslice *inferencev1alpha1.Instaslice, gpuUUID string, profileName string) (int, int, int, int) {
 	var size int
 	var discoveredGiprofile int
 	var Ciprofileid int
 	var Ciengprofileid int
-	for _, item := range instaslice.Spec.Migplacement {
+	for _, item := range gpuMigPlacements(instaslice, gpuUUID) {
 		if item.Profile == profileName {
 			for _, aPlacement := range item.Placements {
 				size = aPlacement.Size
@@ -300,87 +575,31 @@ func (*InstasliceReconciler) extractGpuProfile(instaslice *inferencev1alpha1.Ins
 }
 
 // accounting logic that finds the correct GPU and index where a slice could be placed.
-func (*InstasliceReconciler) getStartIndexFromPreparedState(instaslice *inferencev1alpha1.Instaslice, gpuUUID string, profileName string) uint32 {
-	//TODO: generalize, A100 and H100 have 8 indexes for 3g and 7g and 7 for rest, so go with 8 and we are bounded by
-	//only valid placement indexes for a profile.
-	var gpuAllocatedIndex [8]uint32
-	// clean slate init
-	for i := range gpuAllocatedIndex {
-		gpuAllocatedIndex[i] = 0
-	}
-	//TODO: remove this once we start using GPU operator with device plugin fix
-	for _, item := range instaslice.Spec.Prepared {
-		if item.Parent == gpuUUID && item.PodUUID == "" {
-
-			for i := 0; i < int(item.Size); i++ {
-				gpuAllocatedIndex[int(item.Start)+i] = 1
-			}
-
-		}
+// Slot count and valid placements come from the placements discovered for the model of the GPU so any GPU model is supported,
+// found is false when no placement of the profile fits on the GPU.
+func (*InstasliceReconciler) getStartIndexFromPreparedState(node *gpuNode, gpuUUID string, profileName string, policy AllocationPolicy) (uint32, bool) {
+	// a slice of the warm pool is handed out without waiting for a new slice to be created
+	if start, warm := warmSliceStart(node, gpuUUID, profileName); warm {
+		return start, true
 	}
-
-	for _, item := range instaslice.Spec.Allocations {
-		if item.GPUUUID == gpuUUID {
-			for i := 0; i < int(item.Size); i++ {
-				gpuAllocatedIndex[int(item.Start)+i] = 1
-			}
-		}
+	// compute instances fill a GPU instance that is already there before taking a new placement
+	if start, shared := sharedGPUInstanceStart(node, gpuUUID, profileName); shared {
+		return start, true
 	}
-
-	var neededContinousSlot int
+	slots := gpuSlotOccupancy(node, gpuUUID)
+	placementSize := make(map[int]int)
 	var possiblePlacements []int
-	for _, placement := range instaslice.Spec.Migplacement {
-		if placement.Profile == profileName {
-			neededContinousSlot = placement.Placements[0].Size
-			for _, placement := range placement.Placements {
-				possiblePlacements = append(possiblePlacements, placement.Start)
-			}
-			break
-		}
+	for _, placement := range profilePlacements(node.Instaslice, gpuUUID, profileName) {
+		placementSize[placement.Start] = placement.Size
+		possiblePlacements = append(possiblePlacements, placement.Start)
 	}
-	//TODO: generalize for other hardware models like A30, no slices can be placed on 9th index
-	//if we return 9 then assume no valid index is found.
-	var newStart = uint32(9)
-	for _, value := range possiblePlacements {
-		if gpuAllocatedIndex[value] == 0 {
-			if neededContinousSlot == 1 {
-				newStart = uint32(value)
-				break
-			}
-			if neededContinousSlot == 2 {
-				if value+neededContinousSlot < len(gpuAllocatedIndex) {
-					if gpuAllocatedIndex[value] == 0 && gpuAllocatedIndex[value+1] == 0 {
-						newStart = uint32(value)
-						break
-					}
-				}
-
-			}
-			if neededContinousSlot == 4 {
-				if value+neededContinousSlot < len(gpuAllocatedIndex) {
-					if gpuAllocatedIndex[value] == 0 && gpuAllocatedIndex[value+1] == 0 && gpuAllocatedIndex[value+2] == 0 && gpuAllocatedIndex[value+3] == 0 {
-						newStart = uint32(value)
-						break
-					}
-				}
-			}
-
-			if neededContinousSlot == 8 {
-				//special case
-				if value+neededContinousSlot < len(gpuAllocatedIndex) {
-					if gpuAllocatedIndex[value] == 0 && gpuAllocatedIndex[value+1] == 0 &&
-						gpuAllocatedIndex[value+2] == 0 && gpuAllocatedIndex[value+3] == 0 &&
-						gpuAllocatedIndex[value+4] == 0 && gpuAllocatedIndex[value+5] == 0 &&
-						gpuAllocatedIndex[value+6] == 0 && gpuAllocatedIndex[value+7] == 0 {
-						newStart = uint32(value)
-					}
-				}
-			}
+	policy.SortPlacementStarts(possiblePlacements)
+	for _, start := range possiblePlacements {
+		if placementFits(slots, start, placementSize[start]) {
+			return uint32(start), true
 		}
-
 	}
-
-	return newStart
+	return 0, false
 }
 
 func checkIfPodGated(pod *v1.Pod, isPodGated bool) bool {
@@ -394,12 +613,16 @@ func checkIfPodGated(pod *v1.Pod, isPodGated bool) bool {
 	return isPodGated
 }
 
-// podMapFunc maps pods to instaslice created allocations
+// podMapFunc maps created allocations to the pod they belong to and deleted allocations to the head of the
+// admission queue, which gets the first chance at the released slots
 func (r *InstasliceReconciler) podMapFunc(ctx context.Context, obj client.Object) []reconcile.Request {
-	instaslice := obj.(*inferencev1alpha1.Instaslice)
-	for _, allocation := range instaslice.Spec.Allocations {
-		if allocation.Allocationstatus == "created" {
-			return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: allocation.Namespace, Name: allocation.PodName}}}
+	allocation := obj.(*inferencev1alpha1.InstasliceAllocation)
+	if allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusCreated {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: allocation.Namespace, Name: allocation.Spec.PodName}}}
+	}
+	if allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted {
+		if head, exists := r.queue.head(r.QueueOrdering); exists {
+			return []reconcile.Request{{NamespacedName: head.pod}}
 		}
 	}
 
@@ -419,10 +642,27 @@ func (r *InstasliceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1.Pod{}).Named("InstaSlice-controller").
-		Watches(&inferencev1alpha1.Instaslice{}, handler.EnqueueRequestsFromMapFunc(r.podMapFunc)).
+		Watches(&inferencev1alpha1.InstasliceAllocation{}, handler.EnqueueRequestsFromMapFunc(r.podMapFunc)).
 		Complete(r)
 }
 
+// releaseFailedAllocations records why a slice of a gated pod failed and releases every allocation of the pod,
+// their slots stay taken until the daemonset destroyed the slices and deleted the allocations.
+func (r *InstasliceReconciler) releaseFailedAllocations(ctx context.Context, pod *v1.Pod, podAllocations []inferencev1alpha1.InstasliceAllocation, failed inferencev1alpha1.InstasliceAllocation) (ctrl.Result, error) {
+	r.Recorder.Eventf(pod, v1.EventTypeWarning, EventReasonSliceFailed, "slice %s for container %s failed on node %s: %s, releasing the slices of the pod to place it again",
+		failed.Spec.Profile, failed.Spec.ContainerName, failed.Spec.Nodename, failed.Spec.AllocationStatusReason)
+	for i := range podAllocations {
+		if podAllocations[i].Spec.Allocationstatus == inferencev1alpha1.AllocationStatusReleasing || podAllocations[i].Spec.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted {
+			continue
+		}
+		if err := setAllocationStatus(ctx, r.apiReader(), r.Client, &podAllocations[i], inferencev1alpha1.AllocationStatusReleasing, "SliceFailed"); err != nil {
+			log.FromContext(ctx).Error(err, "unable to release failed allocation for ", "pod", pod.Name, "allocation", podAllocations[i].Name)
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
 func (r *InstasliceReconciler) unGatePod(podUpdate *v1.Pod) *v1.Pod {
 	for i, gate := range podUpdate.Spec.SchedulingGates {
 		if gate.Name == "org.instaslice/accelarator" {
@@ -432,8 +672,38 @@ func (r *InstasliceReconciler) unGatePod(podUpdate *v1.Pod) *v1.Pod {
 	return podUpdate
 }
 
-// Policy based allocation - FirstFit
-func (r *FirstFitPolicy) SetAllocationDetails(profileName string, newStart, size uint32, podUUID, nodename string,
+// NewAllocationPolicy returns the allocation policy registered under name.
+func NewAllocationPolicy(name string) (AllocationPolicy, error) {
+	switch name {
+	case FirstFitPolicyName:
+		return &FirstFitPolicy{}, nil
+	case LeftToRightPolicyName:
+		return &LeftToRightPolicy{}, nil
+	case RightToLeftPolicyName:
+		return &RightToLeftPolicy{}, nil
+	case BestFitPolicyName:
+		return &BestFitPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation policy %q", name)
+}
+
+// policyForPod returns the policy requested by the pod annotation, falling back to the controller default.
+func (r *InstasliceReconciler) policyForPod(ctx context.Context, pod *v1.Pod) AllocationPolicy {
+	if name, exists := pod.Annotations[allocationPolicyAnnotation]; exists {
+		policy, err := NewAllocationPolicy(name)
+		if err == nil {
+			return policy
+		}
+		log.FromContext(ctx).Error(err, "ignoring allocation policy annotation for ", "pod", pod.Name)
+	}
+	policy, err := NewAllocationPolicy(r.DefaultPolicy)
+	if err != nil {
+		return &FirstFitPolicy{}
+	}
+	return policy
+}
+
+func newAllocationDetails(profileName string, newStart, size uint32, podUUID, nodename string,
 	processed string, discoveredGiprofile int, Ciprofileid int, Ciengprofileid int,
 	namespace string, podName string, gpuUuid string) *inferencev1alpha1.AllocationDetails {
 	return &inferencev1alpha1.AllocationDetails{
@@ -442,7 +712,7 @@ func (r *FirstFitPolicy) SetAllocationDetails(profileName string, newStart, size
 		Size:             uint32(size),
 		PodUUID:          podUUID,
 		Nodename:         nodename,
-		Allocationstatus: processed,
+		Allocationstatus: inferencev1alpha1.AllocationStatus(processed),
 		Giprofileid:      discoveredGiprofile,
 		CIProfileID:      Ciprofileid,
 		CIEngProfileID:   Ciengprofileid,
@@ -452,20 +722,40 @@ func (r *FirstFitPolicy) SetAllocationDetails(profileName string, newStart, size
 	}
 }
 
-// Policy based allocation - LeftToRIght
+// Policy based allocation - FirstFit, placements are tried in the order NVML reported them.
+func (r *FirstFitPolicy) SortPlacementStarts(starts []int) {}
+
+func (r *FirstFitPolicy) SetAllocationDetails(profileName string, newStart, size uint32, podUUID, nodename string,
+	processed string, discoveredGiprofile int, Ciprofileid int, Ciengprofileid int,
+	namespace string, podName string, gpuUuid string) *inferencev1alpha1.AllocationDetails {
+	return newAllocationDetails(profileName, newStart, size, podUUID, nodename, processed, discoveredGiprofile,
+		Ciprofileid, Ciengprofileid, namespace, podName, gpuUuid)
+}
+
+// Policy based allocation - LeftToRight, the lowest free start index is used so the
+// high end of the GPU stays free for large placements.
+func (l *LeftToRightPolicy) SortPlacementStarts(starts []int) {
+	sort.Ints(starts)
+}
+
 func (l *LeftToRightPolicy) SetAllocationDetails(profileName string, newStart, size uint32, podUUID, nodename string,
 	processed string, discoveredGiprofile int, Ciprofileid int, Ciengprofileid int,
 	namespace string, podName string, gpuUuid string) *inferencev1alpha1.AllocationDetails {
-	// Implement the left-to-right policy here
-	return &inferencev1alpha1.AllocationDetails{}
+	return newAllocationDetails(profileName, newStart, size, podUUID, nodename, processed, discoveredGiprofile,
+		Ciprofileid, Ciengprofileid, namespace, podName, gpuUuid)
+}
+
+// Policy based allocation - RightToLeft, the highest free start index is used so the
+// low end of the GPU stays free for large placements.
+func (l *RightToLeftPolicy) SortPlacementStarts(starts []int) {
+	sort.Sort(sort.Reverse(sort.IntSlice(starts)))
 }
 
-// Policy based allocation - RigghToLeft
 func (l *RightToLeftPolicy) SetAllocationDetails(profileName string, newStart, size uint32, podUUID, nodename string,
 	processed string, discoveredGiprofile int, Ciprofileid int, Ciengprofileid int,
 	namespace string, podName string, gpuUuid string) *inferencev1alpha1.AllocationDetails {
-	// Implement the left-to-right policy here
-	return &inferencev1alpha1.AllocationDetails{}
+	return newAllocationDetails(profileName, newStart, size, podUUID, nodename, processed, discoveredGiprofile,
+		Ciprofileid, Ciengprofileid, namespace, podName, gpuUuid)
 }
 
 func isPodDeletionProcessed(str string, arr []string) bool {
@@ -18,11 +18,16 @@ package controller
 
 import (
 	"context"
+	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -69,8 +74,9 @@ var _ = Describe("Instaslice Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &InstasliceReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -82,3 +88,215 @@ var _ = Describe("Instaslice Controller", func() {
 		})
 	})
 })
+
+// newKubeNode returns the Node object backing the Instaslice of a test node.
+func newKubeNode(nodeName string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}}
+}
+
+// newTestNode returns a node with A100-40GB GPUs using the placements NVML reports and no allocations.
+func newTestNode(nodeName string, gpus ...string) *gpuNode {
+	migGPUUUID := map[string]string{}
+	for _, gpu := range gpus {
+		migGPUUUID[gpu] = "NVIDIA A100-PCIE-40GB"
+	}
+	instaslice := &inferencev1alpha1.Instaslice{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName, Namespace: "default"},
+		Spec: inferencev1alpha1.InstasliceSpec{
+			MigGPUUUID: migGPUUUID,
+			Migplacement: []inferencev1alpha1.Mig{
+				{Profile: "1g.5gb", Giprofileid: 0, CIProfileID: 0, Placements: []inferencev1alpha1.Placement{
+					{Start: 0, Size: 1}, {Start: 1, Size: 1}, {Start: 2, Size: 1}, {Start: 3, Size: 1},
+					{Start: 4, Size: 1}, {Start: 5, Size: 1}, {Start: 6, Size: 1}}},
+				{Profile: "2g.10gb", Giprofileid: 1, CIProfileID: 1, Placements: []inferencev1alpha1.Placement{
+					{Start: 0, Size: 2}, {Start: 2, Size: 2}, {Start: 4, Size: 2}}},
+				{Profile: "3g.20gb", Giprofileid: 2, CIProfileID: 2, Placements: []inferencev1alpha1.Placement{
+					{Start: 0, Size: 4}, {Start: 4, Size: 4}}},
+				{Profile: "4g.20gb", Giprofileid: 3, CIProfileID: 3, Placements: []inferencev1alpha1.Placement{
+					{Start: 0, Size: 4}}},
+				{Profile: "7g.40gb", Giprofileid: 4, CIProfileID: 4, Placements: []inferencev1alpha1.Placement{
+					{Start: 0, Size: 8}}},
+			},
+		},
+	}
+	return &gpuNode{Instaslice: instaslice, allocations: map[string]inferencev1alpha1.AllocationDetails{}}
+}
+
+func TestAllocationPolicyPlacementOrder(t *testing.T) {
+	r := &InstasliceReconciler{}
+	instaslice := newTestNode("node-1", "GPU-1")
+	startFor := func(profileName string, policy AllocationPolicy) uint32 {
+		start, found := r.getStartIndexFromPreparedState(instaslice, "GPU-1", profileName, policy)
+		assert.True(t, found)
+		return start
+	}
+
+	assert.Equal(t, uint32(0), startFor("1g.5gb", &FirstFitPolicy{}))
+	assert.Equal(t, uint32(0), startFor("1g.5gb", &LeftToRightPolicy{}))
+	assert.Equal(t, uint32(6), startFor("1g.5gb", &RightToLeftPolicy{}))
+	assert.Equal(t, uint32(4), startFor("3g.20gb", &RightToLeftPolicy{}))
+
+	instaslice.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "1g.5gb", Start: 6, Size: 1},
+		"pod-2": {PodUUID: "pod-2", GPUUUID: "GPU-1", Profile: "1g.5gb", Start: 0, Size: 1},
+	}
+	assert.Equal(t, uint32(1), startFor("1g.5gb", &LeftToRightPolicy{}))
+	assert.Equal(t, uint32(5), startFor("1g.5gb", &RightToLeftPolicy{}))
+}
+
+func TestFindDeviceForASliceTriesGPUsInOrder(t *testing.T) {
+	r := &InstasliceReconciler{}
+	pod := newGatedTestPod("vllm", "pod-1")
+	node := newTestNode("node-1", "GPU-3", "GPU-1", "GPU-2")
+	node.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-0": {PodUUID: "pod-0", GPUUUID: "GPU-1", Profile: "7g.40gb", Start: 0, Size: 8},
+	}
+	// map iteration order is random, every run has to land on the same GPU
+	for i := 0; i < 20; i++ {
+		for _, policy := range []AllocationPolicy{&LeftToRightPolicy{}, &RightToLeftPolicy{}} {
+			allocation, err := r.findDeviceForASlice(node, "1g.5gb", policy, pod)
+			assert.NoError(t, err)
+			assert.Equal(t, "GPU-2", allocation.GPUUUID)
+		}
+	}
+	allocation, err := r.findDeviceForASlice(node, "1g.5gb", &RightToLeftPolicy{}, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(6), allocation.Start)
+}
+
+func TestGetStartIndexFromPreparedStateA30(t *testing.T) {
+	r := &InstasliceReconciler{}
+	instaslice := &gpuNode{Instaslice: &inferencev1alpha1.Instaslice{
+		Spec: inferencev1alpha1.InstasliceSpec{
+			MigGPUUUID: map[string]string{"GPU-1": "NVIDIA A30"},
+			Migplacement: []inferencev1alpha1.Mig{
+				{Profile: "1g.6gb", Placements: []inferencev1alpha1.Placement{
+					{Start: 0, Size: 1}, {Start: 1, Size: 1}, {Start: 2, Size: 1}, {Start: 3, Size: 1}}},
+				{Profile: "2g.12gb", Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 2}, {Start: 2, Size: 2}}},
+				{Profile: "4g.24gb", Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 4}}},
+			},
+		},
+	}}
+	instaslice.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "2g.12gb", Start: 0, Size: 2},
+	}
+
+	start, found := r.getStartIndexFromPreparedState(instaslice, "GPU-1", "2g.12gb", &FirstFitPolicy{})
+	assert.True(t, found)
+	assert.Equal(t, uint32(2), start)
+	start, found = r.getStartIndexFromPreparedState(instaslice, "GPU-1", "1g.6gb", &FirstFitPolicy{})
+	assert.True(t, found)
+	assert.Equal(t, uint32(2), start)
+	_, found = r.getStartIndexFromPreparedState(instaslice, "GPU-1", "4g.24gb", &FirstFitPolicy{})
+	assert.False(t, found)
+	_, found = r.getStartIndexFromPreparedState(instaslice, "GPU-1", "unknown", &FirstFitPolicy{})
+	assert.False(t, found)
+}
+
+func TestGetStartIndexFromPreparedStateOddSizes(t *testing.T) {
+	r := &InstasliceReconciler{}
+	instaslice := &gpuNode{Instaslice: &inferencev1alpha1.Instaslice{
+		Spec: inferencev1alpha1.InstasliceSpec{
+			MigGPUUUID: map[string]string{"GPU-1": "test"},
+			Migplacement: []inferencev1alpha1.Mig{
+				{Profile: "3g.24gb", Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 3}, {Start: 3, Size: 3}, {Start: 6, Size: 3}}},
+				{Profile: "6g.48gb", Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 6}, {Start: 6, Size: 6}}},
+			},
+		},
+	}}
+	instaslice.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "3g.24gb", Start: 3, Size: 3},
+	}
+
+	start, found := r.getStartIndexFromPreparedState(instaslice, "GPU-1", "6g.48gb", &FirstFitPolicy{})
+	assert.True(t, found)
+	assert.Equal(t, uint32(6), start)
+	start, found = r.getStartIndexFromPreparedState(instaslice, "GPU-1", "3g.24gb", &RightToLeftPolicy{})
+	assert.True(t, found)
+	assert.Equal(t, uint32(6), start)
+}
+
+func TestPolicyForPod(t *testing.T) {
+	ctx := context.Background()
+	r := &InstasliceReconciler{DefaultPolicy: RightToLeftPolicyName}
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-1"}}
+	assert.IsType(t, &RightToLeftPolicy{}, r.policyForPod(ctx, pod))
+
+	pod.Annotations = map[string]string{allocationPolicyAnnotation: LeftToRightPolicyName}
+	assert.IsType(t, &LeftToRightPolicy{}, r.policyForPod(ctx, pod))
+
+	pod.Annotations[allocationPolicyAnnotation] = "unknown"
+	assert.IsType(t, &RightToLeftPolicy{}, r.policyForPod(ctx, pod))
+
+	_, err := NewAllocationPolicy("unknown")
+	assert.Error(t, err)
+}
+
+func TestPodSliceRequests(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "vllm", Namespace: "default", UID: "pod-1"},
+		Spec: v1.PodSpec{Containers: []v1.Container{
+			{
+				Name: "model",
+				Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+					"nvidia.com/mig-3g.20gb": resource.MustParse("1"),
+					"nvidia.com/mig-1g.5gb":  resource.MustParse("2"),
+				}},
+			},
+			{Name: "sidecar"},
+			{
+				Name: "tokenizer",
+				Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+					"nvidia.com/mig-1g.5gb": resource.MustParse("1"),
+					v1.ResourceCPU:          resource.MustParse("1"),
+				}},
+			},
+		}},
+	}
+
+	requests := podSliceRequests(pod)
+	assert.Equal(t, []sliceRequest{
+		{containerName: "model", profileName: "1g.5gb", index: 0},
+		{containerName: "model", profileName: "1g.5gb", index: 1},
+		{containerName: "model", profileName: "3g.20gb", index: 2},
+		{containerName: "tokenizer", profileName: "1g.5gb", index: 0},
+	}, requests)
+	assert.Equal(t, "pod-1-model-2", requests[2].allocationKey(pod))
+	assert.Equal(t, "vllm-tokenizer", sliceConfigMapName(pod, "tokenizer"))
+}
+
+func TestFindNodeForSlicesMultipleRequests(t *testing.T) {
+	r := &InstasliceReconciler{}
+	smallNode := newTestNode("node-a", "GPU-A")
+	smallNode.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-A", Profile: "3g.20gb", Start: 0, Size: 4},
+	}
+	largeNode := newTestNode("node-b", "GPU-B")
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "vllm", Namespace: "default", UID: "pod-2"}}
+	requests := []sliceRequest{
+		{containerName: "model", profileName: "3g.20gb"},
+		{containerName: "tokenizer", profileName: "1g.5gb"},
+		{containerName: "tokenizer", profileName: "1g.5gb", index: 1},
+	}
+
+	// node-a has room for the 3g slice but not for the 1g slices next to it
+	instaslice, allocations, err := r.findNodeForSlices(context.Background(),
+		[]gpuNode{*smallNode, *largeNode}, requests, &LeftToRightPolicy{}, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-b", instaslice.Name)
+	assert.Len(t, allocations, 3)
+	model := allocations["pod-2-model-0"]
+	assert.Equal(t, uint32(0), model.Start)
+	assert.Equal(t, "model", model.ContainerName)
+	assert.Equal(t, "vllm", model.ConfigMapName)
+	assert.Equal(t, uint32(4), allocations["pod-2-tokenizer-0"].Start)
+	assert.Equal(t, uint32(5), allocations["pod-2-tokenizer-1"].Start)
+	// the candidate nodes are not modified while placing
+	assert.Len(t, largeNode.allocations, 0)
+
+	requests = append(requests, sliceRequest{containerName: "tokenizer", profileName: "3g.20gb", index: 2})
+	_, _, err = r.findNodeForSlices(context.Background(),
+		[]gpuNode{*smallNode, *largeNode}, requests, &LeftToRightPolicy{}, pod)
+	assert.Error(t, err)
+}
@@ -22,22 +22,31 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	nvdevice "github.com/NVIDIA/go-nvlib/pkg/nvlib/device"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -47,22 +56,43 @@ type InstaSliceDaemonsetReconciler struct {
 	Scheme     *runtime.Scheme
 	kubeClient *kubernetes.Clientset
 	NodeName   string
+	// Namespace is where the Instaslice objects of the nodes live.
+	Namespace string
+	// Recorder emits the slices created and released on the node as events on pods and the Instaslice.
+	Recorder record.EventRecorder
+	// GPU creates and destroys the slices on the GPUs of the node.
+	GPU GPUBackend
+	// AdvertiseMigResources publishes the slices of the node as MIG resources on the node,
+	// it stands in for the NVIDIA device plugin when the GPUs are emulated.
+	AdvertiseMigResources bool
+	// ResyncInterval is how often the MIG devices on the GPUs are compared with the prepared slices of the node,
+	// zero disables the resync.
+	ResyncInterval time.Duration
+	// OrphanGracePeriod is how long a slice instaslice created is kept once no allocation owns it before it is
+	// destroyed, 0 only reports orphaned slices.
+	OrphanGracePeriod time.Duration
+	// WarmPool is the number of slices kept ready per profile on the node, the controller hands them out
+	// to pods without waiting for the slice to be created.
+	WarmPool map[string]int
+	// APIReader reads the objects the writes of the daemonset start from without going through the cache,
+	// Client is used when it is nil.
+	APIReader client.Reader
+	// prepared caches the slices realized for the allocations of the node.
+	prepared preparedMigCache
+	// orphanedSince is when the resync first found each MIG device no allocation owns.
+	orphanedSince map[string]time.Time
+	// lastResync is when the slices of the node were last resynced.
+	lastResync time.Time
 }
 
 //+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslices,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslices/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslices/finalizers,verbs=update
+//+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instasliceallocations,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=nodes/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
-
-var discoveredGpusOnHost []string
-
-// Additional handler used for making NVML calls.
-type deviceHandler struct {
-	nvdevice nvdevice.Interface
-	nvml     nvml.Interface
-}
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 type MigProfile struct {
 	C              int
@@ -84,160 +114,150 @@ const (
 	AttributeMediaExtensions = "me"
 )
 
-type preparedMig struct {
-	gid     uint32
-	miguuid string
-	cid     uint32
-}
-
-var cachedPreparedMig = make(map[string]preparedMig)
-
-func (r *InstaSliceDaemonsetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *InstaSliceDaemonsetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	defer func() { recordRequeue("instaslice-daemonset", result, err) }()
 
 	nodeName := os.Getenv("NODE_NAME")
 	nsName := types.NamespacedName{
 		Name:      nodeName,
-		Namespace: "default",
+		Namespace: r.Namespace,
 	}
 	var instaslice inferencev1alpha1.Instaslice
 	if err := r.Get(ctx, nsName, &instaslice); err != nil {
 		log.FromContext(ctx).Error(err, "Error listing Instaslice")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	if err := r.List(ctx, &allocationList, client.MatchingLabels{inferencev1alpha1.AllocationNodeLabel: nodeName}); err != nil {
+		log.FromContext(ctx).Error(err, "Error listing allocations")
+		return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+	}
+	if r.ResyncInterval > 0 && time.Since(r.lastResync) >= r.ResyncInterval {
+		// a drift such as a slice vanished in a GPU reset may block the allocations handled below
+		if errResyncing := r.resyncSlices(ctx, &instaslice, allocationList.Items); errResyncing != nil {
+			log.FromContext(ctx).Error(errResyncing, "unable to resync slices of the node")
+		} else {
+			r.lastResync = time.Now()
+		}
 	}
 
-	for _, allocations := range instaslice.Spec.Allocations {
-		if allocations.Allocationstatus == "creating" {
-			//Assume pod only has one container with one GPU request
-			log.FromContext(ctx).Info("creating allocation for ", "pod", allocations.PodName)
-			var podUUID = allocations.PodUUID
-			ret := nvml.Init()
-			if ret != nvml.SUCCESS {
-				log.FromContext(ctx).Error(ret, "Unable to initialize NVML")
+	for _, allocationObject := range allocationList.Items {
+		allocationKey := allocationObject.Name
+		allocations := allocationObject.Spec
+		if allocations.Allocationstatus == inferencev1alpha1.AllocationStatusCreating && allocationObject.DeletionTimestamp.IsZero() {
+			//each allocation is a single slice requested by a container of the pod
+			log.FromContext(ctx).Info("creating allocation for ", "pod", allocations.PodName, "container", allocations.ContainerName)
+			if errInitializing := r.GPU.Init(); errInitializing != nil {
+				log.FromContext(ctx).Error(errInitializing, "Unable to initialize NVML")
 			}
 
-			availableGpus, ret := nvml.DeviceGetCount()
-			if ret != nvml.SUCCESS {
-				log.FromContext(ctx).Error(ret, "Unable to get device count")
-			}
-
-			if errCreatingInstaSliceResource := r.createInstaSliceResource(ctx, nodeName, allocations.PodName); errCreatingInstaSliceResource != nil {
+			if errCreatingInstaSliceResource := r.createInstaSliceResource(ctx, nodeName, allocationCapacityResource(allocations)); errCreatingInstaSliceResource != nil {
 				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 			}
 
-			deviceForMig, profileName, Giprofileid, Ciprofileid, CiEngProfileid := r.getAllocation(instaslice, allocations.PodUUID)
+			profileName := allocations.Profile
 			placement := nvml.GpuInstancePlacement{}
-			for i := 0; i < availableGpus; i++ {
-				existingAllocations := instaslice.Spec.Allocations[podUUID]
-
-				device, ret := nvml.DeviceGetHandleByIndex(i)
-				if ret != nvml.SUCCESS {
-					log.FromContext(ctx).Error(ret, "Unable to get device at index")
+			//TODO: any GPU can fail creating CI and GI
+			if _, exists := r.prepared.get(allocationKey); !exists {
+				// a slice realized before the daemonset restarted is adopted instead of created twice
+				migDevices, errListingMigDevices := r.GPU.ListMigDevices()
+				if errListingMigDevices != nil {
+					log.FromContext(ctx).Error(errListingMigDevices, "unable to list MIG devices for ", "pod", allocations.PodName)
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 				}
+				r.adoptRealizedSlice(ctx, &allocationObject, &instaslice, migDevices)
+			}
+			if _, exists := r.prepared.get(allocationKey); !exists {
+				log.FromContext(ctx).Info("Slice does not exists on GPU for ", "pod", allocations.PodName)
 
-				uuid, ret := device.GetUUID()
-				if ret != nvml.SUCCESS {
-					log.FromContext(ctx).Error(ret, "Unable to get uuid of device at index")
-				}
-				if deviceForMig != uuid {
-					continue
+				updatedPlacement, err := r.getAllocationsToprepare(ctx, placement, instaslice, allocations)
+				if err != nil {
+					log.FromContext(ctx).Error(err, "prepared already exists for ", "pod", allocations.PodName)
+					return ctrl.Result{}, nil
 				}
 
-				//Move to next GPU as this is not the selected GPU by the controller.
-				if allocations.GPUUUID != uuid {
-					continue
+				// slices of the warm pool make room for the slice, they are created again elsewhere once it is settled
+				if errReclaiming := r.reclaimWarmSlices(ctx, &instaslice, allocations.GPUUUID, updatedPlacement.Start, updatedPlacement.Size); errReclaiming != nil {
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 				}
-				//TODO: any GPU can fail creating CI and GI
-				if _, exists := cachedPreparedMig[allocations.PodName]; !exists {
-					var giInfo nvml.GpuInstanceInfo
-					log.FromContext(ctx).Info("Slice does not exists on GPU for ", "pod", allocations.PodName)
-
-					device, retCodeForDevice := nvml.DeviceGetHandleByUUID(uuid)
-
-					if retCodeForDevice != nvml.SUCCESS {
-						log.FromContext(ctx).Error(ret, "error getting GPU device handle")
-					}
-
-					giProfileInfo, retCodeForGi := device.GetGpuInstanceProfileInfo(Giprofileid)
-					if retCodeForGi != nvml.SUCCESS {
-						log.FromContext(ctx).Error(retCodeForGi, "error getting GPU instance profile info", "giProfileInfo", giProfileInfo, "retCodeForGi", retCodeForGi)
-					}
-
-					log.FromContext(ctx).Info("The profile id is", "giProfileInfo", giProfileInfo.Id, "Memory", giProfileInfo.MemorySizeMB, "pod", podUUID)
-
-					updatedPlacement, err := r.getAllocationsToprepare(ctx, placement, instaslice, allocations.PodUUID)
-					if err != nil {
-						log.FromContext(ctx).Error(err, "prepared already exists for ", "pod", allocations.PodName)
-						return ctrl.Result{}, nil
-					}
 
-					gi, retCodeForGiWithPlacement := device.CreateGpuInstanceWithPlacement(&giProfileInfo, &updatedPlacement)
-					if retCodeForGiWithPlacement != nvml.SUCCESS {
-						log.FromContext(ctx).Error(retCodeForGiWithPlacement, "error creating GPU instance for ", "gi", &gi)
-					}
-					giInfo, retForGiInfor := gi.GetInfo()
-					if retForGiInfor != nvml.SUCCESS {
-						log.FromContext(ctx).Error(retForGiInfor, "error getting GPU instance info for ", "giInfo", &giInfo)
-						//TODO: clean up GI and then return
-					}
-					//TODO: figure out the compute slice scenario, I think Kubernetes does not support this use case yet
-					ciProfileInfo, retCodeForCiProfile := gi.GetComputeInstanceProfileInfo(Ciprofileid, CiEngProfileid)
-					if retCodeForCiProfile != nvml.SUCCESS {
-						log.FromContext(ctx).Error(retCodeForCiProfile, "error getting Compute instance profile info for ", "ciProfileInfo", ciProfileInfo)
-					}
-					ci, retCodeForComputeInstance := gi.CreateComputeInstance(&ciProfileInfo)
-					if retCodeForComputeInstance != nvml.SUCCESS {
-						log.FromContext(ctx).Error(retCodeForComputeInstance, "error creating Compute instance for ", "ci", ci)
-					}
-
-					//get created mig details
-					giId, migUUID, ciId := r.getCreatedSliceDetails(ctx, giInfo, ret, device, uuid, profileName)
-					cachedPreparedMig[allocations.PodName] = preparedMig{gid: giId, miguuid: migUUID, cid: ciId}
+				// compute instances of a Nc.Mg.Xgb profile go into the GPU instance already at the placement
+				_, _, isComputeInstance := computeInstanceSlices(profileName)
+				slice, errCreatingSlice := r.GPU.CreateSlice(SliceRequest{
+					GPUUUID:          allocations.GPUUUID,
+					Profile:          profileName,
+					GIProfileID:      allocations.Giprofileid,
+					CIProfileID:      allocations.CIProfileID,
+					CIEngProfileID:   allocations.CIEngProfileID,
+					Start:            updatedPlacement.Start,
+					Size:             updatedPlacement.Size,
+					ShareGPUInstance: isComputeInstance,
+				})
+				if errCreatingSlice != nil {
+					log.FromContext(ctx).Error(errCreatingSlice, "error creating slice for ", "pod", allocations.PodName, "container", allocations.ContainerName)
+					return r.failAllocation(ctx, &instaslice, &allocationObject, errCreatingSlice.Error())
 				}
+				log.FromContext(ctx).Info("Prepared details", "giId", slice.GIID, "migUUID", slice.MigUUID, "ciId", slice.CIID)
+				r.prepared.set(allocationKey, preparedMig{gid: slice.GIID, miguuid: slice.MigUUID, cid: slice.CIID})
+			}
 
-				createdSliceDetails := cachedPreparedMig[allocations.PodName]
-				log.FromContext(ctx).Info("The created cache details loaded are for allocation ", "pod name", allocations.PodName, "slice details", createdSliceDetails)
+			createdSliceDetails, _ := r.prepared.get(allocationKey)
+			log.FromContext(ctx).Info("The created cache details loaded are for allocation ", "pod name", allocations.PodName, "slice details", createdSliceDetails)
+			// the device plugin already knows the slices of the warm pool
+			fromWarmPool := isWarmSlice(instaslice.Spec.Prepared[createdSliceDetails.miguuid])
 
-				if errCreatingConfigMap := r.createConfigMap(ctx, createdSliceDetails.miguuid, existingAllocations.Namespace, existingAllocations.PodName); errCreatingConfigMap != nil {
-					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
-				}
+			if errCreatingConfigMap := r.createConfigMap(ctx, createdSliceDetails.miguuid, allocations.Namespace, allocationConfigMapName(allocations)); errCreatingConfigMap != nil {
+				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+			}
 
-				if errAddingPrepared := r.createPreparedEntry(ctx, profileName, podUUID, allocations.GPUUUID, createdSliceDetails.gid, createdSliceDetails.cid, &instaslice, createdSliceDetails.miguuid); errAddingPrepared != nil {
-					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
-				}
-				nodeName := os.Getenv("NODE_NAME")
+			if errAddingPrepared := r.createPreparedEntry(ctx, profileName, allocations, allocations.GPUUUID, createdSliceDetails.gid, createdSliceDetails.cid, &instaslice, createdSliceDetails.miguuid); errAddingPrepared != nil {
+				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+			}
+			if !fromWarmPool {
 				if errUpdatingNodeCapacity := r.updateNodeCapacity(ctx, nodeName); errUpdatingNodeCapacity != nil {
 					return ctrl.Result{Requeue: true}, nil
 				}
-				var updateInstasliceObject inferencev1alpha1.Instaslice
-				typeNamespacedName := types.NamespacedName{
-					Name:      instaslice.Name,
-					Namespace: "default", // TODO: modify
-				}
-				err := r.Get(ctx, typeNamespacedName, &updateInstasliceObject)
-				if err != nil {
-					log.FromContext(ctx).Error(err, "error getting latest instaslice object")
-				}
-				existingAllocations.Allocationstatus = "created"
-				updateInstasliceObject.Spec.Allocations[podUUID] = existingAllocations
-				errForUpdate := r.Update(ctx, &updateInstasliceObject)
-				if errForUpdate != nil {
-					log.FromContext(ctx).Error(errForUpdate, "error adding prepared statement\n")
+			}
+			if r.AdvertiseMigResources {
+				if errAdvertising := r.advertiseMigResources(ctx, nodeName); errAdvertising != nil {
 					return ctrl.Result{Requeue: true}, nil
 				}
-
-				return ctrl.Result{}, nil
-
 			}
+			errForUpdate := setAllocationStatus(ctx, r.apiReader(), r.Client, &allocationObject, inferencev1alpha1.AllocationStatusCreated, "")
+			if errForUpdate != nil {
+				log.FromContext(ctx).Error(errForUpdate, "error setting allocation to created\n")
+				return ctrl.Result{Requeue: true}, nil
+			}
+			observeAllocationLatency(stageCreated, allocationObject.CreationTimestamp.Time)
+			message := fmt.Sprintf("created %s slice %s for container %s on GPU %s", profileName, createdSliceDetails.miguuid, allocations.ContainerName, allocations.GPUUUID)
+			if fromWarmPool {
+				message = fmt.Sprintf("handed out %s slice %s of the warm pool to container %s on GPU %s", profileName, createdSliceDetails.miguuid, allocations.ContainerName, allocations.GPUUUID)
+			}
+			r.Recorder.Event(allocationPod(allocations), v1.EventTypeNormal, EventReasonSliceCreated, message)
+			r.Recorder.Eventf(&instaslice, v1.EventTypeNormal, EventReasonSliceCreated, "%s of pod %s/%s", message, allocations.Namespace, allocations.PodName)
 
+			return ctrl.Result{}, nil
 		}
 		//TODO: if cm and instaslice resource does not exists, then slice was never created, can early terminate
-		if allocations.Allocationstatus == "deleted" {
+		//allocations deleted without going through the controller, e.g. garbage collected with the pod, are cleaned up too
+		if allocations.Allocationstatus == inferencev1alpha1.AllocationStatusReleasing || allocations.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted ||
+			!allocationObject.DeletionTimestamp.IsZero() {
 			log.FromContext(ctx).Info("Performing cleanup ", "pod", allocations.PodName)
-			if errDeletingCm := r.deleteConfigMap(ctx, allocations.PodName, allocations.Namespace); errDeletingCm != nil {
-				log.FromContext(ctx).Error(errDeletingCm, "error deleting configmap for ", "pod", allocations.PodName)
-				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+			//cleanUp releases every slice of the pod at once, remove the configmaps of all its containers first
+			podAllocationKeys := make(map[string]string)
+			for _, podAllocation := range allocationList.Items {
+				if podAllocation.Spec.PodUUID == allocations.PodUUID {
+					podAllocationKeys[podAllocation.Name] = allocationConfigMapName(podAllocation.Spec)
+				}
+			}
+			for _, configMapName := range podAllocationKeys {
+				if errDeletingCm := r.deleteConfigMap(ctx, configMapName, allocations.Namespace); errDeletingCm != nil {
+					log.FromContext(ctx).Error(errDeletingCm, "error deleting configmap for ", "pod", allocations.PodName)
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+				}
 			}
 
-			if errDeletingInstaSliceResource := r.cleanUpInstaSliceResource(ctx, allocations.PodName); errDeletingInstaSliceResource != nil {
+			if errDeletingInstaSliceResource := r.cleanUpInstaSliceResource(ctx, allocationCapacityResource(allocations)); errDeletingInstaSliceResource != nil {
 				log.FromContext(ctx).Error(errDeletingInstaSliceResource, "Error deleting InstaSlice resource object")
 				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 			}
@@ -246,24 +266,20 @@ func (r *InstaSliceDaemonsetReconciler) Reconcile(ctx context.Context, req ctrl.
 			if errUpdatingNodeCapacity := r.updateNodeCapacity(ctx, nodeName); errUpdatingNodeCapacity != nil {
 				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 			}
-			deletePrepared := r.cleanUpCiAndGi(ctx, allocations.PodUUID, instaslice)
-			log.FromContext(ctx).Info("Done deleting ci and gi for ", "pod", allocations.PodName)
-			delete(cachedPreparedMig, allocations.PodName)
-			var updateInstasliceObject inferencev1alpha1.Instaslice
-			typeNamespacedName := types.NamespacedName{
-				Name:      instaslice.Name,
-				Namespace: "default", // TODO: modify
+			if errCleaningUp := r.cleanUp(ctx, allocations.PodUUID); errCleaningUp != nil {
+				log.FromContext(ctx).Error(errCleaningUp, "Error updating InstaSlice object for ", "pod", allocations.PodName)
+				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 			}
-			err := r.Get(ctx, typeNamespacedName, &updateInstasliceObject)
-			if err != nil {
-				log.FromContext(ctx).Error(err, "error getting latest instaslice object")
+			log.FromContext(ctx).Info("Done deleting ci and gi for ", "pod", allocations.PodName)
+			if r.AdvertiseMigResources {
+				if errAdvertising := r.advertiseMigResources(ctx, nodeName); errAdvertising != nil {
+					return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+				}
 			}
-			delete(updateInstasliceObject.Spec.Prepared, deletePrepared)
-			delete(updateInstasliceObject.Spec.Allocations, allocations.PodUUID)
-			errUpdatingAllocation := r.Update(ctx, &updateInstasliceObject)
-			if errUpdatingAllocation != nil {
-				log.FromContext(ctx).Error(errUpdatingAllocation, "Error updating InstaSlice object for ", "pod", allocations.PodName)
-				return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+			r.Recorder.Eventf(allocationPod(allocations), v1.EventTypeNormal, EventReasonSliceReleased, "released %d slices on node %s", len(podAllocationKeys), nodeName)
+			r.Recorder.Eventf(&instaslice, v1.EventTypeNormal, EventReasonSliceReleased, "released %d slices of pod %s/%s", len(podAllocationKeys), allocations.Namespace, allocations.PodName)
+			for key := range podAllocationKeys {
+				r.prepared.delete(key)
 			}
 
 			return ctrl.Result{}, nil
@@ -271,22 +287,36 @@ func (r *InstaSliceDaemonsetReconciler) Reconcile(ctx context.Context, req ctrl.
 
 	}
 
+	// every allocation is settled, refill the warm pool before publishing the observed GPU state of the node
+	if errMaintaining := r.maintainWarmPool(ctx, &instaslice, allocationList.Items); errMaintaining != nil {
+		log.FromContext(ctx).Error(errMaintaining, "unable to maintain the warm pool of the node")
+	}
+	if errUpdatingStatus := r.refreshStatus(ctx, &instaslice, allocationList.Items); errUpdatingStatus != nil {
+		return ctrl.Result{Requeue: true}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
-func (r *InstaSliceDaemonsetReconciler) createInstaSliceResource(ctx context.Context, nodeName string, podName string) error {
+// apiReader returns the reader of the objects the writes of the daemonset start from.
+func (r *InstaSliceDaemonsetReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+func (r *InstaSliceDaemonsetReconciler) createInstaSliceResource(ctx context.Context, nodeName string, capacityKey v1.ResourceName) error {
 	node := &v1.Node{}
 	if err := r.Get(ctx, types.NamespacedName{Name: nodeName}, node); err != nil {
 		log.FromContext(ctx).Error(err, "unable to fetch Node")
 		return err
 	}
-	capacityKey := "org.instaslice/" + podName
 	//desiredCapacity := resource.MustParse("1")
-	if _, exists := node.Status.Capacity[v1.ResourceName(capacityKey)]; exists {
+	if _, exists := node.Status.Capacity[capacityKey]; exists {
 		log.FromContext(ctx).Info("Node already patched with ", "capacity", capacityKey)
 		return nil
 	}
-	patchData, err := createPatchData("org.instaslice/"+podName, "1")
+	patchData, err := createPatchData(string(capacityKey), "1")
 	if err != nil {
 		log.FromContext(ctx).Error(err, "unable to create correct json for patching node")
 		return err
@@ -299,122 +329,141 @@ func (r *InstaSliceDaemonsetReconciler) createInstaSliceResource(ctx context.Con
 	return nil
 }
 
-func (r *InstaSliceDaemonsetReconciler) getAllocationsToprepare(ctx context.Context, placement nvml.GpuInstancePlacement, instaslice inferencev1alpha1.Instaslice, podUuid string) (nvml.GpuInstancePlacement, error) {
-	allocationExists := false
-	for _, v := range instaslice.Spec.Allocations {
+func (r *InstaSliceDaemonsetReconciler) getAllocationsToprepare(ctx context.Context, placement nvml.GpuInstancePlacement, instaslice inferencev1alpha1.Instaslice, v inferencev1alpha1.AllocationDetails) (nvml.GpuInstancePlacement, error) {
+	if v.Allocationstatus == inferencev1alpha1.AllocationStatusCreating {
+		allocationExists := false
+		// compute instances of a pod may share a placement, the prepared cache tells them apart
+		_, _, isComputeInstance := computeInstanceSlices(v.Profile)
 		for _, prepared := range instaslice.Spec.Prepared {
-			if prepared.PodUUID == podUuid {
+			if isComputeInstance {
+				break
+			}
+			if prepared.PodUUID == v.PodUUID && prepared.Parent == v.GPUUUID && prepared.Start == v.Start && prepared.Size == v.Size {
 				allocationExists = true
 			}
 		}
 		if !allocationExists {
-			if v.Allocationstatus == "creating" && v.PodUUID == podUuid {
-				placement.Size = v.Size
-				placement.Start = v.Start
-				return placement, nil
-			}
+			placement.Size = v.Size
+			placement.Start = v.Start
+			return placement, nil
 		}
 	}
 	//TODO: handle empty placement object
-	log.FromContext(ctx).Info("placement not found for ", "podUuid", podUuid)
+	log.FromContext(ctx).Info("placement not found for ", "pod", v.PodName, "container", v.ContainerName)
 	return placement, fmt.Errorf("got prepared slice wait for object to be updated")
 }
 
-func (*InstaSliceDaemonsetReconciler) getCreatedSliceDetails(ctx context.Context, giInfo nvml.GpuInstanceInfo, ret nvml.Return, device nvml.Device, uuid string, profileName string) (uint32, string, uint32) {
-
-	h := &deviceHandler{}
-	h.nvml = nvml.New()
-	h.nvdevice = nvdevice.New(nvdevice.WithNvml(h.nvml))
-
-	ret1 := h.nvml.Init()
-	if ret1 != nvml.SUCCESS {
-		log.FromContext(ctx).Error(ret, "Unable to initialize NVML")
+// failAllocation marks an allocation that could not be realized on the node as failed, it is released with its pod.
+func (r *InstaSliceDaemonsetReconciler) failAllocation(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, allocation *inferencev1alpha1.InstasliceAllocation, reason string) (ctrl.Result, error) {
+	if err := r.markAllocationFailed(ctx, instaslice, allocation, reason); err != nil {
+		return ctrl.Result{Requeue: true}, nil
 	}
-	nvlibParentDevice, err := h.nvdevice.NewDevice(device)
-	if err != nil {
-		log.FromContext(ctx).Error(err, "unable to get nvlib GPU parent device for MIG UUID")
+	return ctrl.Result{}, nil
+}
+
+// markAllocationFailed records why the slice of an allocation failed on its pod and the Instaslice and sets it to failed.
+func (r *InstaSliceDaemonsetReconciler) markAllocationFailed(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, allocation *inferencev1alpha1.InstasliceAllocation, reason string) error {
+	r.Recorder.Eventf(allocationPod(allocation.Spec), v1.EventTypeWarning, EventReasonNVMLError, "slice %s for container %s failed: %s", allocation.Spec.Profile, allocation.Spec.ContainerName, reason)
+	r.Recorder.Eventf(instaslice, v1.EventTypeWarning, EventReasonNVMLError, "slice %s of pod %s/%s failed: %s", allocation.Spec.Profile, allocation.Namespace, allocation.Spec.PodName, reason)
+	if err := setAllocationStatus(ctx, r.apiReader(), r.Client, allocation, inferencev1alpha1.AllocationStatusFailed, reason); err != nil {
+		log.FromContext(ctx).Error(err, "error setting allocation to failed", "allocation", allocation.Name)
+		return err
 	}
-	migs, err := nvlibParentDevice.GetMigDevices()
-	if err != nil {
-		log.FromContext(ctx).Error(err, "unable to get MIG devices on GPU")
+	return nil
+}
+
+// cleanUp destroys the slices realized for a pod, removes their prepared entries from the Instaslice
+// object of this node and releases the allocation objects of the pod.
+func (r *InstaSliceDaemonsetReconciler) cleanUp(ctx context.Context, podUuid string) error {
+	nodeName := os.Getenv("NODE_NAME")
+	var instasliceList inferencev1alpha1.InstasliceList
+	if err := r.List(ctx, &instasliceList, client.InNamespace(r.Namespace)); err != nil {
+		log.FromContext(ctx).Error(err, "Error listing Instaslice")
+		return err
 	}
-	for _, mig := range migs {
-		obtainedProfileName, _ := mig.GetProfile()
-		giID, ret := mig.GetGpuInstanceId()
-		if ret != nvml.SUCCESS {
-			log.FromContext(ctx).Error(ret, "error getting GPU instance ID for MIG device")
+	for _, instaslice := range instasliceList.Items {
+		if instaslice.Name != nodeName {
+			continue
 		}
-		gpuInstance, err1 := device.GetGpuInstanceById(giID)
-		if err1 != nvml.SUCCESS {
-			log.FromContext(ctx).Error(err1, "Unable to get GPU instance")
+		// the prepared entries and the finalizers of the allocations stay until every slice is destroyed
+		if err := r.cleanUpCiAndGi(ctx, podUuid, &instaslice); err != nil {
+			return err
 		}
-
-		if profileName == obtainedProfileName.String() && giID == int(giInfo.Id) {
-			realizedMig, _ := mig.GetUUID()
-			migCid, _ := mig.GetComputeInstanceId()
-			ci, _ := gpuInstance.GetComputeInstanceById(migCid)
-			ciMigInfo, _ := ci.GetInfo()
-			log.FromContext(ctx).Info("device id is", "migUUID", giInfo.Device)
-			log.FromContext(ctx).Info("Prepared details", "giId", giInfo.Id, "migUUID", realizedMig, "ciId", ciMigInfo.Id)
-			return giInfo.Id, realizedMig, ciMigInfo.Id
+		if err := syncGPUInstanceRefCounts(ctx, r.Client, &instaslice); err != nil {
+			return err
 		}
-	}
-	//TODO: handle this error
-	return 0, "", 0
-}
-
-func (r *InstaSliceDaemonsetReconciler) getAllocation(instaslice inferencev1alpha1.Instaslice, podUuid string) (string, string, int, int, int) {
-
-	for _, v := range instaslice.Spec.Allocations {
-		if v.Allocationstatus == "creating" && v.PodUUID == podUuid {
-			return v.GPUUUID, v.Profile, v.Giprofileid, v.CIProfileID, v.CIEngProfileID
+		var allocationList inferencev1alpha1.InstasliceAllocationList
+		if err := r.List(ctx, &allocationList, client.MatchingLabels{inferencev1alpha1.AllocationPodUIDLabel: podUuid}); err != nil {
+			return err
+		}
+		for i := range allocationList.Items {
+			allocation := &allocationList.Items[i]
+			errRemovingFinalizer := updateAllocation(ctx, r.apiReader(), r.Client, client.ObjectKeyFromObject(allocation), func(latest *inferencev1alpha1.InstasliceAllocation) bool {
+				// allocations garbage collected with their pod did not go through releasing in the controller
+				if latest.Spec.Allocationstatus.CanTransitionTo(inferencev1alpha1.AllocationStatusReleasing) {
+					if err := transitionAllocation(&latest.Spec, inferencev1alpha1.AllocationStatusReleasing, "PodDeleted"); err != nil {
+						log.FromContext(ctx).Error(err, "unable to set allocation to releasing", "allocation", latest.Name)
+					}
+				}
+				if err := transitionAllocation(&latest.Spec, inferencev1alpha1.AllocationStatusDeleted, "SliceDestroyed"); err != nil {
+					log.FromContext(ctx).Error(err, "unable to set allocation to deleted", "allocation", latest.Name)
+				}
+				controllerutil.RemoveFinalizer(latest, "org.instaslice/accelarator")
+				return true
+			})
+			if client.IgnoreNotFound(errRemovingFinalizer) != nil {
+				return errRemovingFinalizer
+			}
+			if err := r.Delete(ctx, allocation); client.IgnoreNotFound(err) != nil {
+				return err
+			}
 		}
+		return nil
 	}
-	//TODO handle error
-	return "", "", -1, -1, -1
+	return fmt.Errorf("instaslice object not found for node %s", nodeName)
 }
 
-func (r *InstaSliceDaemonsetReconciler) cleanUpCiAndGi(ctx context.Context, podUuid string, instaslice inferencev1alpha1.Instaslice) string {
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		log.FromContext(ctx).Error(ret, "Unable to initialize NVML")
+// cleanUpCiAndGi destroys the slices realized for a pod and removes the prepared entry of each slice destroyed,
+// the entries of the slices that could not be destroyed are kept so the next attempt retries them.
+func (r *InstaSliceDaemonsetReconciler) cleanUpCiAndGi(ctx context.Context, podUuid string, instaslice *inferencev1alpha1.Instaslice) error {
+	if errInitializing := r.GPU.Init(); errInitializing != nil {
+		log.FromContext(ctx).Error(errInitializing, "Unable to initialize NVML")
+		return errInitializing
 	}
 
-	var candidateDel string
-	prepared := instaslice.Spec.Prepared
-	for migUUID, value := range prepared {
+	var errDestroying error
+	prepared := make(map[string]inferencev1alpha1.PreparedDetails)
+	var migUUIDs []string
+	for migUUID, value := range instaslice.Spec.Prepared {
+		prepared[migUUID] = value
 		if value.PodUUID == podUuid {
-			parent, errRecievingDeviceHandle := nvml.DeviceGetHandleByUUID(value.Parent)
-			if errRecievingDeviceHandle != nvml.SUCCESS {
-				log.FromContext(ctx).Error(errRecievingDeviceHandle, "Error obtaining GPU handle")
-			}
-			gi, errRetrievingGi := parent.GetGpuInstanceById(int(value.Giinfoid))
-			if errRetrievingGi != nvml.SUCCESS {
-				log.FromContext(ctx).Error(errRetrievingGi, "Error obtaining GPU instance")
-			}
-			ci, errRetrievingCi := gi.GetComputeInstanceById(int(value.Ciinfoid))
-			if errRetrievingCi != nvml.SUCCESS {
-				log.FromContext(ctx).Error(errRetrievingCi, "Error obtaining Compute instance")
-			}
-			errDestroyingCi := ci.Destroy()
-			if errDestroyingCi != nvml.SUCCESS {
-				log.FromContext(ctx).Error(errDestroyingCi, "Error deleting Compute instance")
-			}
-			errDestroyingGi := gi.Destroy()
-			if errDestroyingGi != nvml.SUCCESS {
-				log.FromContext(ctx).Error(errDestroyingGi, "Error deleting GPU instance")
-			}
-			candidateDel = migUUID
-			log.FromContext(ctx).Info("Done deleting MIG slice for pod", "UUID", value.PodUUID)
+			migUUIDs = append(migUUIDs, migUUID)
 		}
 	}
+	sort.Strings(migUUIDs)
+	refCounts := gpuInstanceRefCounts(prepared)
+	for _, migUUID := range migUUIDs {
+		value := prepared[migUUID]
+		// a GPU instance shared by compute instances goes away with the last of them
+		key := gpuInstanceKey(value.Parent, value.Giinfoid)
+		if errDestroyingSlice := r.GPU.DestroySlice(value.Parent, value.Giinfoid, value.Ciinfoid, refCounts[key] <= 1); errDestroyingSlice != nil {
+			log.FromContext(ctx).Error(errDestroyingSlice, "Error deleting MIG slice", "migUUID", migUUID)
+			errDestroying = errDestroyingSlice
+			continue
+		}
+		refCounts[key]--
+		if err := patchPreparedEntry(ctx, r.Client, instaslice, migUUID, nil); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Done deleting MIG slice for pod", "UUID", value.PodUUID)
+	}
 
-	return candidateDel
+	return errDestroying
 }
 
-func (r *InstaSliceDaemonsetReconciler) cleanUpInstaSliceResource(ctx context.Context, podName string) error {
+func (r *InstaSliceDaemonsetReconciler) cleanUpInstaSliceResource(ctx context.Context, resourceName v1.ResourceName) error {
 	nodeName := os.Getenv("NODE_NAME")
-	deletePatch, err := deletePatchData(podName)
+	deletePatch, err := deletePatchData(string(resourceName))
 	if err != nil {
 		log.FromContext(ctx).Error(err, "unable to create delete json patch data")
 		return err
@@ -426,10 +475,9 @@ func (r *InstaSliceDaemonsetReconciler) cleanUpInstaSliceResource(ctx context.Co
 		log.FromContext(ctx).Error(err, "unable to fetch Node")
 		return err
 	}
-	resourceName := v1.ResourceName(fmt.Sprintf("org.instaslice/%s", podName))
 	//&& val.String() == "1"
 	if _, ok := node.Status.Capacity[resourceName]; !ok {
-		log.FromContext(ctx).Info("skipping non-existent deletion of instaslice resource for ", "pod", podName)
+		log.FromContext(ctx).Info("skipping non-existent deletion of instaslice resource ", "resource", resourceName)
 		return nil
 	}
 	if err := r.Status().Patch(ctx, node, client.RawPatch(types.JSONPatchType, deletePatch)); err != nil {
@@ -439,14 +487,21 @@ func (r *InstaSliceDaemonsetReconciler) cleanUpInstaSliceResource(ctx context.Co
 	return nil
 }
 
-func (r *InstaSliceDaemonsetReconciler) createPreparedEntry(ctx context.Context, profileName string, podUUID string, deviceUUID string, giId uint32, ciId uint32, instaslice *inferencev1alpha1.Instaslice, migUUID string) error {
+func (r *InstaSliceDaemonsetReconciler) createPreparedEntry(ctx context.Context, profileName string, updatedAllocation inferencev1alpha1.AllocationDetails, deviceUUID string, giId uint32, ciId uint32, instaslice *inferencev1alpha1.Instaslice, migUUID string) error {
+	podUUID := updatedAllocation.PodUUID
 	existingPreparedDetails := instaslice.Spec.Prepared
 	checkAPreparedDetails := existingPreparedDetails[migUUID]
 	if checkAPreparedDetails.Ciinfoid == ciId && checkAPreparedDetails.Giinfoid == giId && checkAPreparedDetails.PodUUID == podUUID {
 		log.FromContext(ctx).Info("updated prepared details already exists")
 		return nil
 	}
-	updatedAllocation := instaslice.Spec.Allocations[podUUID]
+	// a merge patch keeps the fields left empty, the entry of a slice handed out from the warm pool is replaced
+	if checkAPreparedDetails.WarmPool {
+		if errForUpdate := patchPreparedEntry(ctx, r.Client, instaslice, migUUID, nil); errForUpdate != nil {
+			log.FromContext(ctx).Error(errForUpdate, "error removing warm pool entry")
+			return errForUpdate
+		}
+	}
 	instaslicePrepared := inferencev1alpha1.PreparedDetails{
 		Profile:  profileName,
 		Start:    updatedAllocation.Start,
@@ -455,17 +510,17 @@ func (r *InstaSliceDaemonsetReconciler) createPreparedEntry(ctx context.Context,
 		PodUUID:  podUUID,
 		Giinfoid: giId,
 		Ciinfoid: ciId,
+		Managed:  true,
 	}
-	if instaslice.Spec.Prepared == nil {
-		instaslice.Spec.Prepared = make(map[string]inferencev1alpha1.PreparedDetails)
-	}
-
-	instaslice.Spec.Prepared[migUUID] = instaslicePrepared
-	errForUpdate := r.Update(ctx, instaslice)
+	errForUpdate := patchPreparedEntry(ctx, r.Client, instaslice, migUUID, &instaslicePrepared)
 	if errForUpdate != nil {
 		log.FromContext(ctx).Error(errForUpdate, "error adding prepared statement")
 		return errForUpdate
 	}
+	if errForUpdate := syncGPUInstanceRefCounts(ctx, r.Client, instaslice); errForUpdate != nil {
+		log.FromContext(ctx).Error(errForUpdate, "error updating GPU instance reference counts")
+		return errForUpdate
+	}
 	return nil
 }
 
@@ -521,9 +576,8 @@ func (r *InstaSliceDaemonsetReconciler) SetupWithManager(mgr ctrl.Manager) error
 		<-mgr.Elected() // Wait for the manager to be elected
 		var instaslice inferencev1alpha1.Instaslice
 		typeNamespacedName := types.NamespacedName{
-			Name: nodeName,
-			//TODO: change namespace
-			Namespace: "default",
+			Name:      nodeName,
+			Namespace: r.Namespace,
 		}
 		errRetrievingInstaSliceForSetup := r.Get(ctx, typeNamespacedName, &instaslice)
 		if errRetrievingInstaSliceForSetup != nil {
@@ -531,12 +585,22 @@ func (r *InstaSliceDaemonsetReconciler) SetupWithManager(mgr ctrl.Manager) error
 			//TODO: should we do hard exit?
 			//os.Exit(1)
 		}
-		if instaslice.Status.Processed != "true" || (instaslice.Name == "" && instaslice.Namespace == "") {
+		if !meta.IsStatusConditionTrue(instaslice.Status.Conditions, inferencev1alpha1.ConditionDiscovered) || (instaslice.Name == "" && instaslice.Namespace == "") {
 			_, errForDiscoveringGpus := r.discoverMigEnabledGpuWithSlices()
 			if errForDiscoveringGpus != nil {
 				log.FromContext(ctx).Error(errForDiscoveringGpus, "error discovering GPUs")
 			}
 		}
+		// nodes discovered before the topology was recorded get it on the next restart
+		if errRecordingTopology := r.recordGPUTopology(ctx, typeNamespacedName); errRecordingTopology != nil {
+			log.FromContext(ctx).Error(errRecordingTopology, "unable to record the topology of the GPUs")
+		}
+		// slices realized before a restart belong to their allocations again
+		if errRetrievingInstaSlice := r.Get(ctx, typeNamespacedName, &instaslice); errRetrievingInstaSlice == nil {
+			if errRebuilding := r.rebuildPreparedCache(ctx, &instaslice); errRebuilding != nil {
+				log.FromContext(ctx).Error(errRebuilding, "unable to rebuild the prepared slices from the GPUs")
+			}
+		}
 		return nil
 	}))
 
@@ -546,16 +610,56 @@ func (r *InstaSliceDaemonsetReconciler) SetupWithManager(mgr ctrl.Manager) error
 // Enable creation of controller caches to talk to the API server in order to perform
 // object discovery in SetupWithManager
 func (r *InstaSliceDaemonsetReconciler) setupWithManager(mgr ctrl.Manager) error {
+	resync := make(chan event.GenericEvent)
+	if r.ResyncInterval > 0 {
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return r.enqueueResync(ctx, resync)
+		})); err != nil {
+			return err
+		}
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&inferencev1alpha1.Instaslice{}).Named("InstaSliceDaemonSet").
+		Watches(&inferencev1alpha1.InstasliceAllocation{}, handler.EnqueueRequestsFromMapFunc(r.nodeMapFunc)).
+		WatchesRawSource(&source.Channel{Source: resync}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
 
+// enqueueResync reconciles the Instaslice of the node every resync interval so its slices are resynced
+// even when no allocation changes.
+func (r *InstaSliceDaemonsetReconciler) enqueueResync(ctx context.Context, resync chan<- event.GenericEvent) error {
+	ticker := time.NewTicker(r.ResyncInterval)
+	defer ticker.Stop()
+	instaslice := &inferencev1alpha1.Instaslice{ObjectMeta: metav1.ObjectMeta{Name: os.Getenv("NODE_NAME"), Namespace: r.Namespace}}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			select {
+			case resync <- event.GenericEvent{Object: instaslice}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// nodeMapFunc maps allocations placed on this node to the Instaslice of the node
+func (r *InstaSliceDaemonsetReconciler) nodeMapFunc(ctx context.Context, obj client.Object) []reconcile.Request {
+	allocation := obj.(*inferencev1alpha1.InstasliceAllocation)
+	nodeName := os.Getenv("NODE_NAME")
+	if allocation.Spec.Nodename != nodeName {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: nodeName, Namespace: r.Namespace}}}
+}
+
 // This function discovers MIG devices as the plugin comes up. this is run exactly once.
 func (r *InstaSliceDaemonsetReconciler) discoverMigEnabledGpuWithSlices() ([]string, error) {
-	instaslice, _, gpuModelMap, failed, returnValue, errorDiscoveringProfiles := r.discoverAvailableProfilesOnGpus()
-	if failed {
-		return returnValue, errorDiscoveringProfiles
+	instaslice, discoveredGpusOnHost, errorDiscoveringProfiles := r.discoverAvailableProfilesOnGpus()
+	if errorDiscoveringProfiles != nil {
+		return nil, errorDiscoveringProfiles
 	}
 
 	err := r.discoverDanglingSlices(instaslice)
@@ -566,9 +670,7 @@ func (r *InstaSliceDaemonsetReconciler) discoverMigEnabledGpuWithSlices() ([]str
 
 	nodeName := os.Getenv("NODE_NAME")
 	instaslice.Name = nodeName
-	instaslice.Namespace = "default"
-	instaslice.Spec.MigGPUUUID = gpuModelMap
-	instaslice.Status.Processed = "true"
+	instaslice.Namespace = r.Namespace
 	//TODO: should we use context.TODO() ?
 	customCtx := context.TODO()
 	errToCreate := r.Create(customCtx, instaslice)
@@ -577,7 +679,7 @@ func (r *InstaSliceDaemonsetReconciler) discoverMigEnabledGpuWithSlices() ([]str
 	}
 
 	// Object exists, update its status
-	instaslice.Status.Processed = "true"
+	setInstasliceStatus(&gpuNode{Instaslice: instaslice}, nil)
 	if errForStatus := r.Status().Update(customCtx, instaslice); errForStatus != nil {
 		return nil, errForStatus
 	}
@@ -585,164 +687,83 @@ func (r *InstaSliceDaemonsetReconciler) discoverMigEnabledGpuWithSlices() ([]str
 	return discoveredGpusOnHost, nil
 }
 
-func (r *InstaSliceDaemonsetReconciler) discoverAvailableProfilesOnGpus() (*inferencev1alpha1.Instaslice, nvml.Return, map[string]string, bool, []string, error) {
+// discoverAvailableProfilesOnGpus returns an Instaslice with the GPUs of the node and the placements of their
+// MIG profiles, along with the UUIDs of the GPUs in index order.
+func (r *InstaSliceDaemonsetReconciler) discoverAvailableProfilesOnGpus() (*inferencev1alpha1.Instaslice, []string, error) {
+	if err := r.GPU.Init(); err != nil {
+		return nil, nil, err
+	}
+	gpus, err := r.GPU.DiscoverGPUs()
+	if err != nil {
+		return nil, nil, err
+	}
 	instaslice := &inferencev1alpha1.Instaslice{}
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		return nil, ret, nil, false, nil, ret
+	instaslice.Spec.MigGPUUUID = make(map[string]string)
+	var discoveredGpusOnHost []string
+	for _, gpu := range gpus {
+		instaslice.Spec.MigGPUUUID[gpu.UUID] = gpu.Model
+		discoveredGpusOnHost = append(discoveredGpusOnHost, gpu.UUID)
+	}
+	instaslice.Spec.GPUTopology = gpuTopology(gpus)
+	instaslice.Spec.MigplacementByModel, err = r.GPU.ListPlacements()
+	if err != nil {
+		return nil, nil, err
 	}
-
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		return nil, ret, nil, false, nil, ret
+	if len(gpus) > 0 {
+		instaslice.Spec.Migplacement = instaslice.Spec.MigplacementByModel[gpus[0].Model]
 	}
-	gpuModelMap := make(map[string]string)
-	discoverProfilePerNode := true
-	for i := 0; i < count; i++ {
-		device, ret := nvml.DeviceGetHandleByIndex(i)
-		if ret != nvml.SUCCESS {
-			return nil, ret, nil, false, nil, ret
-		}
-
-		uuid, _ := device.GetUUID()
-		gpuName, _ := device.GetName()
-		gpuModelMap[uuid] = gpuName
-		discoveredGpusOnHost = append(discoveredGpusOnHost, uuid)
-		if discoverProfilePerNode {
-
-			for i := 0; i < nvml.GPU_INSTANCE_PROFILE_COUNT; i++ {
-				giProfileInfo, ret := device.GetGpuInstanceProfileInfo(i)
-				if ret == nvml.ERROR_NOT_SUPPORTED {
-					continue
-				}
-				if ret == nvml.ERROR_INVALID_ARGUMENT {
-					continue
-				}
-				if ret != nvml.SUCCESS {
-					return nil, ret, nil, false, nil, ret
-				}
-
-				memory, ret := device.GetMemoryInfo()
-				if ret != nvml.SUCCESS {
-					return nil, ret, nil, false, nil, ret
-				}
-
-				profile := NewMigProfile(i, i, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED, giProfileInfo.SliceCount, giProfileInfo.SliceCount, giProfileInfo.MemorySizeMB, memory.Total)
-
-				giPossiblePlacements, ret := device.GetGpuInstancePossiblePlacements(&giProfileInfo)
-				if ret == nvml.ERROR_NOT_SUPPORTED {
-					continue
-				}
-				if ret == nvml.ERROR_INVALID_ARGUMENT {
-					continue
-				}
-				if ret != nvml.SUCCESS {
-					return nil, 0, nil, true, nil, ret
-				}
-				placementsForProfile := []inferencev1alpha1.Placement{}
-				for _, p := range giPossiblePlacements {
-					placement := inferencev1alpha1.Placement{
-						Size:  int(p.Size),
-						Start: int(p.Start),
-					}
-					placementsForProfile = append(placementsForProfile, placement)
-				}
+	return instaslice, discoveredGpusOnHost, nil
+}
 
-				aggregatedPlacementsForProfile := inferencev1alpha1.Mig{
-					Placements:     placementsForProfile,
-					Profile:        profile.String(),
-					Giprofileid:    i,
-					CIProfileID:    profile.CIProfileID,
-					CIEngProfileID: profile.CIEngProfileID,
-				}
-				instaslice.Spec.Migplacement = append(instaslice.Spec.Migplacement, aggregatedPlacementsForProfile)
-			}
-			discoverProfilePerNode = false
+// gpuTopology returns the topology of the GPUs keyed by GPU UUID, it is nil when the backend reports none.
+func gpuTopology(gpus []GPU) map[string]inferencev1alpha1.GPUTopology {
+	var topology map[string]inferencev1alpha1.GPUTopology
+	for _, gpu := range gpus {
+		if equality.Semantic.DeepEqual(gpu.Topology, inferencev1alpha1.GPUTopology{}) {
+			continue
+		}
+		if topology == nil {
+			topology = make(map[string]inferencev1alpha1.GPUTopology)
 		}
+		topology[gpu.UUID] = gpu.Topology
 	}
-	return instaslice, ret, gpuModelMap, false, nil, nil
+	return topology
 }
 
-func (r *InstaSliceDaemonsetReconciler) discoverDanglingSlices(instaslice *inferencev1alpha1.Instaslice) error {
-	h := &deviceHandler{}
-	h.nvml = nvml.New()
-	h.nvdevice = nvdevice.New(nvdevice.WithNvml(h.nvml))
-
-	errInitNvml := h.nvml.Init()
-	if errInitNvml != nvml.SUCCESS {
-		return errInitNvml
+// recordGPUTopology updates the topology of the GPUs in the Instaslice of the node when it changed.
+func (r *InstaSliceDaemonsetReconciler) recordGPUTopology(ctx context.Context, key types.NamespacedName) error {
+	if err := r.GPU.Init(); err != nil {
+		return err
 	}
-
-	availableGpusOnNode, errObtainingDeviceCount := h.nvml.DeviceGetCount()
-	if errObtainingDeviceCount != nvml.SUCCESS {
-		return errObtainingDeviceCount
+	gpus, err := r.GPU.DiscoverGPUs()
+	if err != nil {
+		return err
 	}
-
-	for i := 0; i < availableGpusOnNode; i++ {
-		device, errObtainingDeviceHandle := h.nvml.DeviceGetHandleByIndex(i)
-		if errObtainingDeviceHandle != nvml.SUCCESS {
-			return errObtainingDeviceHandle
-		}
-
-		uuid, errObtainingDeviceUUID := device.GetUUID()
-		if errObtainingDeviceUUID != nvml.SUCCESS {
-			return errObtainingDeviceUUID
-		}
-
-		nvlibParentDevice, errObtainingParentDevice := h.nvdevice.NewDevice(device)
-		if errObtainingParentDevice != nil {
-			return errObtainingParentDevice
+	topology := gpuTopology(gpus)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var instaslice inferencev1alpha1.Instaslice
+		if err := r.apiReader().Get(ctx, key, &instaslice); err != nil {
+			return err
 		}
-		migs, errRetrievingMigDevices := nvlibParentDevice.GetMigDevices()
-		if errRetrievingMigDevices != nil {
-			return errRetrievingMigDevices
+		if equality.Semantic.DeepEqual(instaslice.Spec.GPUTopology, topology) {
+			return nil
 		}
+		instaslice.Spec.GPUTopology = topology
+		return r.Update(ctx, &instaslice)
+	})
+}
 
-		for _, mig := range migs {
-			migUUID, _ := mig.GetUUID()
-			profile, errForProfile := mig.GetProfile()
-			if errForProfile != nil {
-				return errForProfile
-			}
-
-			giID, errForMigGid := mig.GetGpuInstanceId()
-			if errForMigGid != nvml.SUCCESS {
-				return errForMigGid
-			}
-			gpuInstance, errRetrievingDeviceGid := device.GetGpuInstanceById(giID)
-			if errRetrievingDeviceGid != nvml.SUCCESS {
-				return errRetrievingDeviceGid
-			}
-			gpuInstanceInfo, errObtainingInfo := gpuInstance.GetInfo()
-			if errObtainingInfo != nvml.SUCCESS {
-				return errObtainingInfo
-			}
-
-			ciID, ret := mig.GetComputeInstanceId()
-			if ret != nvml.SUCCESS {
-				return ret
-			}
-			ci, ret := gpuInstance.GetComputeInstanceById(ciID)
-			if ret != nvml.SUCCESS {
-				return ret
-			}
-			ciInfo, ret := ci.GetInfo()
-			if ret != nvml.SUCCESS {
-				return ret
-			}
-			prepared := inferencev1alpha1.PreparedDetails{
-				Profile:  profile.GetInfo().String(),
-				Start:    gpuInstanceInfo.Placement.Start,
-				Size:     gpuInstanceInfo.Placement.Size,
-				Parent:   uuid,
-				Giinfoid: gpuInstanceInfo.Id,
-				Ciinfoid: ciInfo.Id,
-			}
-			if instaslice.Spec.Prepared == nil {
-				instaslice.Spec.Prepared = make(map[string]inferencev1alpha1.PreparedDetails)
-			}
-			instaslice.Spec.Prepared[migUUID] = prepared
+// discoverDanglingSlices adds the MIG devices that already exist on the GPUs to the prepared entries of the Instaslice.
+func (r *InstaSliceDaemonsetReconciler) discoverDanglingSlices(instaslice *inferencev1alpha1.Instaslice) error {
+	migDevices, err := r.GPU.ListMigDevices()
+	if err != nil {
+		return err
+	}
+	for migUUID, prepared := range migDevices {
+		if instaslice.Spec.Prepared == nil {
+			instaslice.Spec.Prepared = make(map[string]inferencev1alpha1.PreparedDetails)
 		}
+		instaslice.Spec.Prepared[migUUID] = prepared
 	}
 	return nil
 }
@@ -792,15 +813,16 @@ func (m MigProfile) Attributes() []string {
 	return attr
 }
 
-// Create configmap which is used by Pods to consume MIG device
-func (r *InstaSliceDaemonsetReconciler) createConfigMap(ctx context.Context, migGPUUUID string, namespace string, podName string) error {
+// Create configmap which is used by Pods to consume MIG device, a container with more than
+// one slice gets the MIG UUIDs of all its slices as a comma separated list.
+func (r *InstaSliceDaemonsetReconciler) createConfigMap(ctx context.Context, migGPUUUID string, namespace string, configMapName string) error {
 	var configMap v1.ConfigMap
-	err := r.Get(ctx, types.NamespacedName{Name: podName, Namespace: namespace}, &configMap)
+	err := r.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: namespace}, &configMap)
 	if err != nil {
-		log.FromContext(ctx).Info("ConfigMap not found, creating for ", "pod", podName, "migGPUUUID", migGPUUUID)
+		log.FromContext(ctx).Info("ConfigMap not found, creating for ", "configmap", configMapName, "migGPUUUID", migGPUUUID)
 		configMapToCreate := &v1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      podName,
+				Name:      configMapName,
 				Namespace: namespace,
 			},
 			Data: map[string]string{
@@ -812,11 +834,48 @@ func (r *InstaSliceDaemonsetReconciler) createConfigMap(ctx context.Context, mig
 			log.FromContext(ctx).Error(err, "failed to create ConfigMap")
 			return err
 		}
-
+		return nil
+	}
+	var visibleDevices []string
+	if existingDevices := configMap.Data["NVIDIA_VISIBLE_DEVICES"]; existingDevices != "" {
+		visibleDevices = strings.Split(existingDevices, ",")
+	}
+	for _, device := range visibleDevices {
+		if device == migGPUUUID {
+			return nil
+		}
+	}
+	devices := strings.Join(append(visibleDevices, migGPUUUID), ",")
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data["NVIDIA_VISIBLE_DEVICES"] = devices
+	configMap.Data["CUDA_VISIBLE_DEVICES"] = devices
+	if err := r.Update(ctx, &configMap); err != nil {
+		log.FromContext(ctx).Error(err, "failed to add MIG device to ConfigMap")
+		return err
 	}
 	return nil
 }
 
+// allocationConfigMapName returns the configmap the slice of an allocation is published in,
+// allocations made before containers had their own configmap use the pod name.
+func allocationConfigMapName(allocation inferencev1alpha1.AllocationDetails) string {
+	if allocation.ConfigMapName != "" {
+		return allocation.ConfigMapName
+	}
+	return allocation.PodName
+}
+
+// allocationCapacityResource returns the per pod extended resource advertised for the slices of an allocation,
+// allocations made before it was recorded use the pod name.
+func allocationCapacityResource(allocation inferencev1alpha1.AllocationDetails) v1.ResourceName {
+	if allocation.CapacityResource != "" {
+		return v1.ResourceName(allocation.CapacityResource)
+	}
+	return v1.ResourceName(instasliceResourcePrefix + allocation.PodName)
+}
+
 // Manage lifecycle of configmap, delete it once the pod is deleted from the system
 func (r *InstaSliceDaemonsetReconciler) deleteConfigMap(ctx context.Context, configMapName string, namespace string) error {
 	// Define the ConfigMap object with the name and namespace
@@ -853,7 +912,7 @@ func createPatchData(resourceName string, resourceValue string) ([]byte, error)
 func deletePatchData(resourceName string) ([]byte, error) {
 	patch := []ResPatchOperation{
 		{Op: "remove",
-			Path: fmt.Sprintf("/status/capacity/%s", strings.ReplaceAll("org.instaslice/"+resourceName, "/", "~1")),
+			Path: fmt.Sprintf("/status/capacity/%s", strings.ReplaceAll(resourceName, "/", "~1")),
 		},
 	}
 	return json.Marshal(patch)
@@ -22,10 +22,14 @@ import (
 	"testing"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
-	"github.com/NVIDIA/go-nvml/pkg/nvml/mock/dgxa100"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -35,25 +39,12 @@ import (
 )
 
 func TestCleanUp(t *testing.T) {
-	// Set up the mock server
-	server := dgxa100.New()
-
-	// Mock the NVML functions
-	nvml.Init = func() nvml.Return {
-		return nvml.SUCCESS
-	}
-	nvml.Shutdown = func() nvml.Return {
-		return nvml.SUCCESS
-	}
-	nvml.DeviceGetHandleByUUID = func(uuid string) (nvml.Device, nvml.Return) {
-		for _, dev := range server.Devices {
-			device := dev.(*dgxa100.Device)
-			if device.UUID == uuid {
-				return device, nvml.SUCCESS
-			}
-		}
-		return nil, nvml.ERROR_NOT_FOUND
-	}
+	// Create a slice on the emulated GPUs for the pod
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 0, Size: 1})
+	assert.NoError(t, err)
 
 	// Create a fake Kubernetes client
 	s := scheme.Scheme
@@ -68,6 +59,7 @@ func TestCleanUp(t *testing.T) {
 	reconciler := &InstaSliceDaemonsetReconciler{
 		Client: fakeClient,
 		Scheme: s,
+		GPU:    backend,
 	}
 	// Create a fake Instaslice resource
 	instaslice := &inferencev1alpha1.Instaslice{
@@ -76,23 +68,30 @@ func TestCleanUp(t *testing.T) {
 		},
 		Spec: inferencev1alpha1.InstasliceSpec{
 			Prepared: map[string]inferencev1alpha1.PreparedDetails{
-				"mig-uuid-1": {
+				slice.MigUUID: {
 					PodUUID:  "pod-uid-1",
-					Parent:   "GPU-1",
-					Giinfoid: 1,
-					Ciinfoid: 1,
-				},
-			},
-			Allocations: map[string]inferencev1alpha1.AllocationDetails{
-				"allocation-1": {
-					PodUUID:   "pod-uid-1",
-					PodName:   "pod-name-1",
-					Namespace: "default",
+					Parent:   gpus[0].UUID,
+					Giinfoid: slice.GIID,
+					Ciinfoid: slice.CIID,
 				},
 			},
 		},
 	}
 	fakeClient.Create(context.Background(), instaslice)
+	allocation := &inferencev1alpha1.InstasliceAllocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "pod-uid-1-vllm-0",
+			Namespace:  "default",
+			Labels:     map[string]string{inferencev1alpha1.AllocationPodUIDLabel: "pod-uid-1"},
+			Finalizers: []string{"org.instaslice/accelarator"},
+		},
+		Spec: inferencev1alpha1.AllocationDetails{
+			PodUUID:   "pod-uid-1",
+			PodName:   "pod-name-1",
+			Namespace: "default",
+		},
+	}
+	fakeClient.Create(context.Background(), allocation)
 
 	// Set the NODE_NAME environment variable
 	os.Setenv("NODE_NAME", "node-1")
@@ -112,8 +111,186 @@ func TestCleanUp(t *testing.T) {
 
 	// Verify the Instaslice resource was updated
 	var updatedInstaslice inferencev1alpha1.Instaslice
-	err := fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-1"}, &updatedInstaslice)
+	err = fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-1"}, &updatedInstaslice)
+	assert.NoError(t, err)
+	assert.Empty(t, updatedInstaslice.Spec.Prepared)
+	err = fakeClient.Get(context.Background(), types.NamespacedName{Name: "pod-uid-1-vllm-0", Namespace: "default"}, &inferencev1alpha1.InstasliceAllocation{})
+	assert.True(t, errors.IsNotFound(err))
+	// Verify the slice was destroyed on the GPU
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Empty(t, migDevices)
+}
+
+// failingDestroyBackend fails the next DestroySlice calls of a backend.
+type failingDestroyBackend struct {
+	GPUBackend
+	failures int
+}
+
+func (b *failingDestroyBackend) DestroySlice(gpuUUID string, giID, ciID uint32, destroyGI bool) error {
+	if b.failures > 0 {
+		b.failures--
+		return newNvmlError("DestroyComputeInstance", nvml.ERROR_IN_USE)
+	}
+	return b.GPUBackend.DestroySlice(gpuUUID, giID, ciID, destroyGI)
+}
+
+func TestCleanUpKeepsSliceThatCannotBeDestroyed(t *testing.T) {
+	ctx := context.Background()
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	allocation := newCreatingAllocation("pod-uid-busy", gpus[0].UUID, "3g.20gb", nvml.GPU_INSTANCE_PROFILE_3_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, 0, 4)
+	allocation.Finalizers = []string{"org.instaslice/accelarator"}
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+	reconcileNode(t, reconciler)
+	failing := &failingDestroyBackend{GPUBackend: backend, failures: 1}
+	reconciler.GPU = failing
+
+	// the prepared entry and the allocation stay until the slice is destroyed
+	assert.Error(t, reconciler.cleanUp(ctx, "pod-uid-busy"))
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.Len(t, instaslice.Spec.Prepared, 1)
+	var kept inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &kept))
+	assert.Contains(t, kept.Finalizers, "org.instaslice/accelarator")
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 1)
+
+	assert.NoError(t, reconciler.cleanUp(ctx, "pod-uid-busy"))
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.Empty(t, instaslice.Spec.Prepared)
+	assert.True(t, errors.IsNotFound(reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &kept)))
+	migDevices, err = backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Empty(t, migDevices)
+}
+
+func TestCreateConfigMapMultipleSlices(t *testing.T) {
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).Build()
+	reconciler := &InstaSliceDaemonsetReconciler{
+		Client: fakeClient,
+		Scheme: s,
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, reconciler.createConfigMap(ctx, "MIG-1", "default", "vllm-model"))
+	assert.NoError(t, reconciler.createConfigMap(ctx, "MIG-2", "default", "vllm-model"))
+	// a retried reconcile must not publish the same device twice
+	assert.NoError(t, reconciler.createConfigMap(ctx, "MIG-2", "default", "vllm-model"))
+
+	var configMap v1.ConfigMap
+	err := fakeClient.Get(ctx, types.NamespacedName{Name: "vllm-model", Namespace: "default"}, &configMap)
 	assert.NoError(t, err)
+	assert.Equal(t, "MIG-1,MIG-2", configMap.Data["NVIDIA_VISIBLE_DEVICES"])
+	assert.Equal(t, "MIG-1,MIG-2", configMap.Data["CUDA_VISIBLE_DEVICES"])
+}
+
+// newCreatingAllocation returns an allocation of node-1 the controller placed for the vllm container of a pod.
+func newCreatingAllocation(podUUID string, gpuUUID string, profile string, giProfileID, ciProfileID int, start, size uint32) *inferencev1alpha1.InstasliceAllocation {
+	return &inferencev1alpha1.InstasliceAllocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podUUID + "-vllm-0",
+			Namespace: "default",
+			Labels:    map[string]string{inferencev1alpha1.AllocationNodeLabel: "node-1", inferencev1alpha1.AllocationPodUIDLabel: podUUID},
+		},
+		Spec: inferencev1alpha1.AllocationDetails{
+			PodUUID: podUUID, PodName: "vllm", Namespace: "default", ContainerName: "vllm", Nodename: "node-1",
+			GPUUUID: gpuUUID, Profile: profile, Giprofileid: giProfileID, CIProfileID: ciProfileID, Start: start, Size: size,
+			Allocationstatus: inferencev1alpha1.AllocationStatusCreating,
+		},
+	}
+}
+
+// newDaemonsetTestReconciler returns the daemonset reconciler of node-1 with the GPUs of the backend and objects.
+func newDaemonsetTestReconciler(t *testing.T, backend GPUBackend, objs ...client.Object) *InstaSliceDaemonsetReconciler {
+	t.Setenv("NODE_NAME", "node-1")
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	instaslice := &inferencev1alpha1.Instaslice{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "default"},
+		Spec:       inferencev1alpha1.InstasliceSpec{MigGPUUUID: map[string]string{}},
+	}
+	for _, gpu := range gpus {
+		instaslice.Spec.MigGPUUUID[gpu.UUID] = gpu.Model
+	}
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status:     v1.NodeStatus{Capacity: v1.ResourceList{v1.ResourceCPU: resource.MustParse("8")}},
+	}
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	return &InstaSliceDaemonsetReconciler{
+		Client:    runtimefake.NewClientBuilder().WithScheme(s).WithObjects(append(objs, node, instaslice)...).WithStatusSubresource(instaslice).Build(),
+		Scheme:    s,
+		Namespace: "default",
+		Recorder:  record.NewFakeRecorder(100),
+		GPU:       backend,
+	}
+}
+
+func reconcileNode(t *testing.T, reconciler *InstaSliceDaemonsetReconciler) {
+	_, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "node-1", Namespace: "default"}})
+	assert.NoError(t, err)
+}
+
+func TestReconcileCreatesSliceOnBackend(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	allocation := newCreatingAllocation("pod-uid-backend", gpus[0].UUID, "3g.20gb", nvml.GPU_INSTANCE_PROFILE_3_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, 0, 4)
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+
+	reconcileNode(t, reconciler)
+
+	ctx := context.Background()
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 1)
+	var updatedInstaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &updatedInstaslice))
+	for migUUID, prepared := range migDevices {
+		assert.Equal(t, "pod-uid-backend", updatedInstaslice.Spec.Prepared[migUUID].PodUUID)
+		var configMap v1.ConfigMap
+		assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "vllm", Namespace: "default"}, &configMap))
+		assert.Equal(t, migUUID, configMap.Data["NVIDIA_VISIBLE_DEVICES"])
+		assert.Equal(t, uint32(4), prepared.Size)
+	}
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updatedAllocation.Spec.Allocationstatus)
+}
+
+func TestReconcileFailsAllocationWhenSliceCannotBeCreated(t *testing.T) {
+	backend := NewDGXA100Backend()
+	device := failComputeInstances(backend, 0, nvml.ERROR_INSUFFICIENT_RESOURCES)
+	allocation := newCreatingAllocation("pod-uid-failing", device.UUID, "1g.5gb", nvml.GPU_INSTANCE_PROFILE_1_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, 0, 1)
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+
+	reconcileNode(t, reconciler)
+
+	// nothing is left on the GPU nor cached for the allocation
+	ctx := context.Background()
+	assert.Empty(t, device.GpuInstances)
+	_, cached := reconciler.prepared.get(allocation.Name)
+	assert.False(t, cached)
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusFailed, updatedAllocation.Spec.Allocationstatus)
+	assert.Equal(t, "CreateComputeInstance: "+nvml.ERROR_INSUFFICIENT_RESOURCES.Error(), updatedAllocation.Spec.AllocationStatusReason)
+	var updatedInstaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &updatedInstaslice))
 	assert.Empty(t, updatedInstaslice.Spec.Prepared)
-	assert.Empty(t, updatedInstaslice.Spec.Allocations)
+}
+
+func TestAllocationCapacityResource(t *testing.T) {
+	assert.Equal(t, v1.ResourceName("org.instaslice/key-1"),
+		allocationCapacityResource(inferencev1alpha1.AllocationDetails{PodName: "vllm-x7k2p", CapacityResource: "org.instaslice/key-1"}))
+	// allocations recorded before the capacity resource use the pod name
+	assert.Equal(t, v1.ResourceName("org.instaslice/vllm"), allocationCapacityResource(inferencev1alpha1.AllocationDetails{PodName: "vllm"}))
 }
@@ -0,0 +1,282 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// resyncSlices compares the MIG devices on the GPUs of the node with its prepared slices and allocations.
+// Slices instaslice created that no allocation owns are destroyed once they stayed orphaned for the grace period,
+// other orphaned MIG devices are only reported. Prepared slices
+// that vanished from the GPUs are re-created while their pod is gated and failed once it runs. The drift left
+// is reported in the status of the Instaslice.
+func (r *InstaSliceDaemonsetReconciler) resyncSlices(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, allocations []inferencev1alpha1.InstasliceAllocation) error {
+	if err := r.GPU.Init(); err != nil {
+		return err
+	}
+	migDevices, err := r.GPU.ListMigDevices()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var drift []inferencev1alpha1.SliceDrift
+	refCounts := gpuInstanceRefCounts(migDevices)
+
+	for migUUID := range r.orphanedSince {
+		if _, exists := migDevices[migUUID]; !exists {
+			delete(r.orphanedSince, migUUID)
+		}
+	}
+	for migUUID, device := range migDevices {
+		if r.sliceOwned(migUUID, device, instaslice, allocations) {
+			delete(r.orphanedSince, migUUID)
+			continue
+		}
+		since, seen := r.orphanedSince[migUUID]
+		if !seen {
+			if r.orphanedSince == nil {
+				r.orphanedSince = make(map[string]time.Time)
+			}
+			since = now
+			r.orphanedSince[migUUID] = since
+		}
+		if r.orphanCollectable(migUUID, instaslice) && now.Sub(since) >= r.OrphanGracePeriod {
+			key := gpuInstanceKey(device.Parent, device.Giinfoid)
+			if errDestroying := r.destroyOrphanedSlice(ctx, instaslice, migUUID, device, refCounts[key] <= 1); errDestroying == nil {
+				refCounts[key]--
+				delete(r.orphanedSince, migUUID)
+				continue
+			}
+		}
+		drift = append(drift, inferencev1alpha1.SliceDrift{MigUUID: migUUID, GPUUUID: device.Parent, Profile: device.Profile,
+			Kind: inferencev1alpha1.SliceDriftOrphaned, Since: metav1.NewTime(since)})
+	}
+
+	for migUUID, prepared := range instaslice.Spec.Prepared {
+		if _, exists := migDevices[migUUID]; exists {
+			continue
+		}
+		if errRepairing := r.repairVanishedSlice(ctx, instaslice, migUUID, prepared, allocations); errRepairing != nil {
+			log.FromContext(ctx).Error(errRepairing, "unable to repair vanished slice", "migUUID", migUUID)
+			drift = append(drift, inferencev1alpha1.SliceDrift{MigUUID: migUUID, GPUUUID: prepared.Parent, Profile: prepared.Profile,
+				Kind: inferencev1alpha1.SliceDriftMissing, Since: metav1.NewTime(now)})
+		}
+	}
+
+	setSliceDriftMetrics(instaslice.Name, drift)
+	err = updateInstasliceStatus(ctx, r.apiReader(), r.Client, client.ObjectKeyFromObject(instaslice), func(latest *inferencev1alpha1.Instaslice) bool {
+		status := latest.Status.DeepCopy()
+		setSliceDrift(latest, drift)
+		return !equality.Semantic.DeepEqual(*status, latest.Status)
+	})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to report slice drift of instaslice", "node", instaslice.Name)
+		return err
+	}
+	return nil
+}
+
+// sliceOwned returns true when a MIG device realizes an allocation of the node, either recorded as the prepared
+// slice of its pod, cached while being created or waiting to be adopted by an allocation with the same placement.
+// Slices of the warm pool are owned by the node.
+func (r *InstaSliceDaemonsetReconciler) sliceOwned(migUUID string, device inferencev1alpha1.PreparedDetails, instaslice *inferencev1alpha1.Instaslice, allocations []inferencev1alpha1.InstasliceAllocation) bool {
+	if r.prepared.contains(migUUID) {
+		return true
+	}
+	prepared, isPrepared := instaslice.Spec.Prepared[migUUID]
+	if isPrepared && isWarmSlice(prepared) {
+		return true
+	}
+	for _, allocation := range allocations {
+		if isPrepared && prepared.PodUUID != "" && prepared.PodUUID == allocation.Spec.PodUUID {
+			return true
+		}
+		if allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusCreating && allocation.Spec.GPUUUID == device.Parent &&
+			allocation.Spec.Start == device.Start && allocation.Spec.Size == device.Size && allocation.Spec.Profile == device.Profile {
+			return true
+		}
+	}
+	return false
+}
+
+// orphanCollectable returns true when an orphaned MIG device may be destroyed, which requires a grace period and
+// a prepared entry showing instaslice created the slice.
+func (r *InstaSliceDaemonsetReconciler) orphanCollectable(migUUID string, instaslice *inferencev1alpha1.Instaslice) bool {
+	prepared, isPrepared := instaslice.Spec.Prepared[migUUID]
+	return r.OrphanGracePeriod > 0 && isPrepared && prepared.Managed
+}
+
+// destroyOrphanedSlice destroys a MIG device no allocation owns and forgets its prepared entry, its GPU instance
+// is only destroyed when destroyGI is true as other compute instances may still use it.
+func (r *InstaSliceDaemonsetReconciler) destroyOrphanedSlice(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, migUUID string, device inferencev1alpha1.PreparedDetails, destroyGI bool) error {
+	if err := r.GPU.DestroySlice(device.Parent, device.Giinfoid, device.Ciinfoid, destroyGI); err != nil {
+		log.FromContext(ctx).Error(err, "unable to destroy orphaned slice", "migUUID", migUUID)
+		return err
+	}
+	if _, exists := instaslice.Spec.Prepared[migUUID]; exists {
+		if err := patchPreparedEntry(ctx, r.Client, instaslice, migUUID, nil); err != nil {
+			log.FromContext(ctx).Error(err, "unable to remove prepared entry of orphaned slice", "migUUID", migUUID)
+			return err
+		}
+	}
+	log.FromContext(ctx).Info("destroyed orphaned slice", "migUUID", migUUID, "gpu", device.Parent)
+	r.Recorder.Eventf(instaslice, v1.EventTypeWarning, EventReasonOrphanedSliceDestroyed, "destroyed %s slice %s on GPU %s that no allocation owns",
+		device.Profile, migUUID, device.Parent)
+	return nil
+}
+
+// repairVanishedSlice handles a prepared slice whose MIG device is no longer on the GPU. The slice of a gated
+// pod is created again, the allocation of a pod that already runs on it fails and is released with the pod.
+func (r *InstaSliceDaemonsetReconciler) repairVanishedSlice(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, migUUID string,
+	prepared inferencev1alpha1.PreparedDetails, allocations []inferencev1alpha1.InstasliceAllocation) error {
+	var allocation *inferencev1alpha1.InstasliceAllocation
+	for i := range allocations {
+		candidate := allocations[i].Spec
+		if candidate.PodUUID == prepared.PodUUID && candidate.GPUUUID == prepared.Parent && candidate.Start == prepared.Start &&
+			candidate.Size == prepared.Size && candidate.Profile == prepared.Profile {
+			allocation = &allocations[i]
+			break
+		}
+	}
+	if allocation != nil {
+		r.prepared.delete(allocation.Name)
+	}
+	reason := fmt.Sprintf("slice %s vanished from GPU %s", migUUID, prepared.Parent)
+	if allocation != nil && allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusCreated {
+		return r.recreateVanishedSlice(ctx, instaslice, migUUID, allocation, reason)
+	}
+	if allocation != nil && allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusUngated {
+		if err := r.markAllocationFailed(ctx, instaslice, allocation, reason); err != nil {
+			return err
+		}
+	}
+	log.FromContext(ctx).Info("forgetting vanished slice", "migUUID", migUUID, "gpu", prepared.Parent)
+	return patchPreparedEntry(ctx, r.Client, instaslice, migUUID, nil)
+}
+
+// recreateVanishedSlice creates the slice of an allocation again with the same placement and publishes the new
+// MIG device to its container, the allocation fails when the slice cannot be created.
+func (r *InstaSliceDaemonsetReconciler) recreateVanishedSlice(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, migUUID string,
+	allocation *inferencev1alpha1.InstasliceAllocation, reason string) error {
+	if err := patchPreparedEntry(ctx, r.Client, instaslice, migUUID, nil); err != nil {
+		return err
+	}
+	_, _, isComputeInstance := computeInstanceSlices(allocation.Spec.Profile)
+	slice, err := r.GPU.CreateSlice(SliceRequest{
+		GPUUUID:          allocation.Spec.GPUUUID,
+		Profile:          allocation.Spec.Profile,
+		GIProfileID:      allocation.Spec.Giprofileid,
+		CIProfileID:      allocation.Spec.CIProfileID,
+		CIEngProfileID:   allocation.Spec.CIEngProfileID,
+		Start:            allocation.Spec.Start,
+		Size:             allocation.Spec.Size,
+		ShareGPUInstance: isComputeInstance,
+	})
+	if err != nil {
+		return r.markAllocationFailed(ctx, instaslice, allocation, fmt.Sprintf("%s and could not be created again: %v", reason, err))
+	}
+	r.prepared.set(allocation.Name, preparedMig{gid: slice.GIID, miguuid: slice.MigUUID, cid: slice.CIID})
+	if err := r.replaceConfigMapDevice(ctx, allocation.Spec.Namespace, allocationConfigMapName(allocation.Spec), migUUID, slice.MigUUID); err != nil {
+		return err
+	}
+	if err := r.createPreparedEntry(ctx, allocation.Spec.Profile, allocation.Spec, allocation.Spec.GPUUUID, slice.GIID, slice.CIID, instaslice, slice.MigUUID); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s, created %s slice %s for container %s again", reason, allocation.Spec.Profile, slice.MigUUID, allocation.Spec.ContainerName)
+	r.Recorder.Event(allocationPod(allocation.Spec), v1.EventTypeWarning, EventReasonSliceVanished, message)
+	r.Recorder.Eventf(instaslice, v1.EventTypeWarning, EventReasonSliceVanished, "%s of pod %s/%s", message, allocation.Spec.Namespace, allocation.Spec.PodName)
+	return nil
+}
+
+// replaceConfigMapDevice swaps a MIG device published in the configmap of a container for another one.
+func (r *InstaSliceDaemonsetReconciler) replaceConfigMapDevice(ctx context.Context, namespace string, configMapName string, oldMigUUID string, newMigUUID string) error {
+	var configMap v1.ConfigMap
+	err := r.Get(ctx, types.NamespacedName{Name: configMapName, Namespace: namespace}, &configMap)
+	if errors.IsNotFound(err) {
+		return r.createConfigMap(ctx, newMigUUID, namespace, configMapName)
+	}
+	if err != nil {
+		return err
+	}
+	var devices []string
+	for _, device := range strings.Split(configMap.Data["NVIDIA_VISIBLE_DEVICES"], ",") {
+		if device != "" && device != oldMigUUID && device != newMigUUID {
+			devices = append(devices, device)
+		}
+	}
+	visibleDevices := strings.Join(append(devices, newMigUUID), ",")
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data["NVIDIA_VISIBLE_DEVICES"] = visibleDevices
+	configMap.Data["CUDA_VISIBLE_DEVICES"] = visibleDevices
+	if err := r.Update(ctx, &configMap); err != nil {
+		log.FromContext(ctx).Error(err, "failed to replace MIG device in ConfigMap")
+		return err
+	}
+	return nil
+}
+
+// setSliceDrift records the drift found on the node and whether its slices are in sync.
+func setSliceDrift(instaslice *inferencev1alpha1.Instaslice, drift []inferencev1alpha1.SliceDrift) {
+	sort.Slice(drift, func(i, j int) bool { return drift[i].MigUUID < drift[j].MigUUID })
+	// the first time a drift was found is kept across resyncs
+	for i := range drift {
+		for _, existing := range instaslice.Status.Drift {
+			if existing.MigUUID == drift[i].MigUUID && existing.Kind == drift[i].Kind {
+				drift[i].Since = existing.Since
+			}
+		}
+	}
+	instaslice.Status.Drift = drift
+
+	inSync := metav1.Condition{
+		Type:               inferencev1alpha1.ConditionInSync,
+		Status:             metav1.ConditionTrue,
+		Reason:             "InSync",
+		Message:            "the MIG devices on the GPUs match the prepared slices",
+		ObservedGeneration: instaslice.Generation,
+	}
+	if len(drift) > 0 {
+		orphaned := 0
+		for _, sliceDrift := range drift {
+			if sliceDrift.Kind == inferencev1alpha1.SliceDriftOrphaned {
+				orphaned++
+			}
+		}
+		inSync.Status = metav1.ConditionFalse
+		inSync.Reason = "SlicesDrifted"
+		inSync.Message = fmt.Sprintf("%d orphaned MIG devices, %d prepared slices missing on the GPUs", orphaned, len(drift)-orphaned)
+	}
+	meta.SetStatusCondition(&instaslice.Status.Conditions, inSync)
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// resyncNode resyncs the slices of node-1 and returns its Instaslice afterwards.
+func resyncNode(t *testing.T, reconciler *InstaSliceDaemonsetReconciler) inferencev1alpha1.Instaslice {
+	ctx := context.Background()
+	key := types.NamespacedName{Name: "node-1", Namespace: "default"}
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, key, &instaslice))
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	assert.NoError(t, reconciler.List(ctx, &allocationList))
+	assert.NoError(t, reconciler.resyncSlices(ctx, &instaslice, allocationList.Items))
+	assert.NoError(t, reconciler.Get(ctx, key, &instaslice))
+	return instaslice
+}
+
+func TestResyncDestroysOrphanedSliceAfterGracePeriod(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	reconciler := newDaemonsetTestReconciler(t, backend)
+	reconciler.OrphanGracePeriod = time.Hour
+	// a slice instaslice created for a pod that is gone
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 0, Size: 1})
+	assert.NoError(t, err)
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.NoError(t, patchPreparedEntry(context.Background(), reconciler.Client, &instaslice, slice.MigUUID,
+		&inferencev1alpha1.PreparedDetails{Profile: "1g.5gb", Start: 0, Size: 1, Parent: gpus[0].UUID, Giinfoid: slice.GIID, Ciinfoid: slice.CIID, Managed: true}))
+
+	instaslice = resyncNode(t, reconciler)
+	assert.Len(t, instaslice.Status.Drift, 1)
+	assert.Equal(t, inferencev1alpha1.SliceDriftOrphaned, instaslice.Status.Drift[0].Kind)
+	assert.Equal(t, slice.MigUUID, instaslice.Status.Drift[0].MigUUID)
+	assert.True(t, meta.IsStatusConditionFalse(instaslice.Status.Conditions, inferencev1alpha1.ConditionInSync))
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 1)
+
+	reconciler.orphanedSince[slice.MigUUID] = time.Now().Add(-2 * time.Hour)
+	instaslice = resyncNode(t, reconciler)
+	assert.Empty(t, instaslice.Status.Drift)
+	assert.Empty(t, instaslice.Spec.Prepared)
+	assert.True(t, meta.IsStatusConditionTrue(instaslice.Status.Conditions, inferencev1alpha1.ConditionInSync))
+	migDevices, err = backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Empty(t, migDevices)
+}
+
+func TestResyncKeepsSliceInstasliceDidNotCreate(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	// a slice that existed before the daemonset started
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 0, Size: 1})
+	assert.NoError(t, err)
+	reconciler := newDaemonsetTestReconciler(t, backend)
+	reconciler.OrphanGracePeriod = time.Hour
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.NoError(t, reconciler.discoverDanglingSlices(&instaslice))
+	assert.NoError(t, reconciler.Update(context.Background(), &instaslice))
+
+	resyncNode(t, reconciler)
+	reconciler.orphanedSince[slice.MigUUID] = time.Now().Add(-2 * time.Hour)
+	instaslice = resyncNode(t, reconciler)
+	assert.Len(t, instaslice.Status.Drift, 1)
+	assert.Equal(t, inferencev1alpha1.SliceDriftOrphaned, instaslice.Status.Drift[0].Kind)
+	assert.Contains(t, instaslice.Spec.Prepared, slice.MigUUID)
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Contains(t, migDevices, slice.MigUUID)
+}
+
+func TestResyncOnlyReportsOrphanedSliceWithoutGracePeriod(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	reconciler := newDaemonsetTestReconciler(t, backend)
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 0, Size: 1})
+	assert.NoError(t, err)
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.NoError(t, patchPreparedEntry(context.Background(), reconciler.Client, &instaslice, slice.MigUUID,
+		&inferencev1alpha1.PreparedDetails{Profile: "1g.5gb", Start: 0, Size: 1, Parent: gpus[0].UUID, Giinfoid: slice.GIID, Ciinfoid: slice.CIID, Managed: true}))
+
+	resyncNode(t, reconciler)
+	reconciler.orphanedSince[slice.MigUUID] = time.Now().Add(-2 * time.Hour)
+	instaslice = resyncNode(t, reconciler)
+	assert.Len(t, instaslice.Status.Drift, 1)
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Contains(t, migDevices, slice.MigUUID)
+}
+
+func TestResyncRecreatesVanishedSliceOfGatedPod(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	allocation := newCreatingAllocation("pod-uid-reset", gpus[0].UUID, "3g.20gb", nvml.GPU_INSTANCE_PROFILE_3_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, 0, 4)
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+	reconcileNode(t, reconciler)
+	vanished, _ := reconciler.prepared.get(allocation.Name)
+
+	// the slice is owned by the allocation
+	instaslice := resyncNode(t, reconciler)
+	assert.Empty(t, instaslice.Status.Drift)
+
+	// a GPU reset destroys the slice
+	assert.NoError(t, backend.DestroySlice(gpus[0].UUID, vanished.gid, vanished.cid, true))
+	instaslice = resyncNode(t, reconciler)
+	assert.Empty(t, instaslice.Status.Drift)
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 1)
+	for migUUID := range migDevices {
+		assert.NotEqual(t, vanished.miguuid, migUUID)
+		assert.Equal(t, map[string]inferencev1alpha1.PreparedDetails{migUUID: {Profile: "3g.20gb", Start: 0, Size: 4, Parent: gpus[0].UUID,
+			PodUUID: "pod-uid-reset", Giinfoid: migDevices[migUUID].Giinfoid, Ciinfoid: migDevices[migUUID].Ciinfoid, GIRefCount: 1, Managed: true}}, instaslice.Spec.Prepared)
+		var configMap v1.ConfigMap
+		assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "vllm", Namespace: "default"}, &configMap))
+		assert.Equal(t, migUUID, configMap.Data["NVIDIA_VISIBLE_DEVICES"])
+	}
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updatedAllocation.Spec.Allocationstatus)
+}
+
+func TestResyncFailsAllocationOfRunningPod(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	allocation := newCreatingAllocation("pod-uid-running", gpus[0].UUID, "1g.5gb", nvml.GPU_INSTANCE_PROFILE_1_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, 0, 1)
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+	reconcileNode(t, reconciler)
+	assert.NoError(t, setAllocationStatus(context.Background(), reconciler.Client, reconciler.Client, allocation, inferencev1alpha1.AllocationStatusUngated, ""))
+	vanished, _ := reconciler.prepared.get(allocation.Name)
+
+	assert.NoError(t, backend.DestroySlice(gpus[0].UUID, vanished.gid, vanished.cid, true))
+	instaslice := resyncNode(t, reconciler)
+	assert.Empty(t, instaslice.Spec.Prepared)
+	assert.Empty(t, instaslice.Status.Drift)
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Empty(t, migDevices)
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusFailed, updatedAllocation.Spec.Allocationstatus)
+	assert.Equal(t, "slice "+vanished.miguuid+" vanished from GPU "+gpus[0].UUID, updatedAllocation.Spec.AllocationStatusReason)
+}
+
+func TestReconcileResyncUnblocksAllocationWithVanishedSlice(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	allocation := newCreatingAllocation("pod-uid-stale", gpus[3].UUID, "2g.10gb", nvml.GPU_INSTANCE_PROFILE_2_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_2_SLICE, 0, 2)
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+	reconciler.ResyncInterval = time.Minute
+	// the slice was prepared before the GPU was reset
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.NoError(t, patchPreparedEntry(context.Background(), reconciler.Client, &instaslice, "MIG-vanished",
+		&inferencev1alpha1.PreparedDetails{Profile: "2g.10gb", Start: 0, Size: 2, Parent: gpus[3].UUID, PodUUID: "pod-uid-stale"}))
+
+	reconcileNode(t, reconciler)
+
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(context.Background(), client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updatedAllocation.Spec.Allocationstatus)
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.NotContains(t, instaslice.Spec.Prepared, "MIG-vanished")
+	assert.Len(t, instaslice.Spec.Prepared, 1)
+}
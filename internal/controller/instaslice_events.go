@@ -0,0 +1,75 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// Reasons of the events emitted on pods and on the Instaslice of their node.
+const (
+	// EventReasonSliceAllocated is emitted by the controller once a slice is placed on a GPU.
+	EventReasonSliceAllocated = "SliceAllocated"
+	// EventReasonInsufficientCapacity is emitted by the controller when no node can host all slices of a pod.
+	EventReasonInsufficientCapacity = "InsufficientCapacity"
+	// EventReasonNoMatchingNode is emitted by the controller when the node selector, node affinity or tolerations of a pod
+	// rule out every node with GPUs.
+	EventReasonNoMatchingNode = "NoMatchingNode"
+	// EventReasonQuotaExceeded is emitted by the controller when the slices of a pod exceed a quota of its namespace.
+	EventReasonQuotaExceeded = "QuotaExceeded"
+	// EventReasonQueued is emitted by the controller on a pod waiting in the admission queue behind the pod at its head
+	// and on the head when it holds a placement until slices are released.
+	EventReasonQueued = "Queued"
+	// EventReasonPreempting is emitted by the controller on a pod that evicts lower priority pods to get its slices.
+	EventReasonPreempting = "Preempting"
+	// EventReasonPreempted is emitted by the controller on a pod evicted for a higher priority pod.
+	EventReasonPreempted = "Preempted"
+	// EventReasonPreemptionBlocked is emitted by the controller when the eviction of a lower priority pod is refused,
+	// e.g. by a PodDisruptionBudget.
+	EventReasonPreemptionBlocked = "PreemptionBlocked"
+	// EventReasonSliceFailed is emitted by the controller when a slice of a gated pod failed and its slices are released
+	// to place the pod again.
+	EventReasonSliceFailed = "SliceFailed"
+	// EventReasonUngated is emitted by the controller once the pod is released to the scheduler.
+	EventReasonUngated = "Ungated"
+	// EventReasonSliceCreated is emitted by the daemonset once the MIG slice exists on the GPU.
+	EventReasonSliceCreated = "SliceCreated"
+	// EventReasonNVMLError is emitted by the daemonset when NVML fails to create a slice.
+	EventReasonNVMLError = "NVMLError"
+	// EventReasonSliceReleased is emitted by the daemonset once the slices of a deleted pod are destroyed.
+	EventReasonSliceReleased = "SliceReleased"
+	// EventReasonSliceVanished is emitted by the daemonset when a prepared slice is no longer on its GPU.
+	EventReasonSliceVanished = "SliceVanished"
+	// EventReasonOrphanedSliceDestroyed is emitted by the daemonset once a slice no allocation owns is destroyed.
+	EventReasonOrphanedSliceDestroyed = "OrphanedSliceDestroyed"
+)
+
+// allocationPod returns a reference to the pod of an allocation that events can be recorded on.
+func allocationPod(allocation inferencev1alpha1.AllocationDetails) *v1.Pod {
+	return &v1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      allocation.PodName,
+			Namespace: allocation.Namespace,
+			UID:       types.UID(allocation.PodUUID),
+		},
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// Allocation pipeline stages observed by allocationLatency.
+const (
+	// stageCreating is the time from pod creation until the controller placed all its slices.
+	stageCreating = "creating"
+	// stageCreated is the time from placement until the daemonset realized a slice on the GPU.
+	stageCreated = "created"
+	// stageUngated is the time from pod creation until the pod was released to the scheduler.
+	stageUngated = "ungated"
+)
+
+var (
+	allocationLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "instaslice_allocation_latency_seconds",
+		Help:    "Time for a pod to reach a stage of the allocation pipeline: creating and ungated are measured from pod creation, created from placement.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"stage"})
+	pendingPodsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "instaslice_pending_pods",
+		Help: "Gated pods waiting for a slice of a profile.",
+	}, []string{"profile"})
+	gpuSlots = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "instaslice_gpu_slots",
+		Help: "Memory slots of a GPU by state, free or used.",
+	}, []string{"node", "gpu", "state"})
+	nvmlFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "instaslice_nvml_failures_total",
+		Help: "NVML calls that did not succeed by operation and return code.",
+	}, []string{"operation", "code"})
+	requeues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "instaslice_requeues_total",
+		Help: "Reconciles that were requeued by controller.",
+	}, []string{"controller"})
+	sliceDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "instaslice_slice_drift",
+		Help: "MIG devices of a node out of sync with its prepared slices by kind, Orphaned or Missing.",
+	}, []string{"node", "kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(allocationLatency, pendingPodsGauge, gpuSlots, nvmlFailures, requeues, sliceDrift)
+}
+
+// observeAllocationLatency records the time since start for a stage of the allocation pipeline.
+func observeAllocationLatency(stage string, start time.Time) {
+	allocationLatency.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// recordNvmlFailure counts an NVML call that returned ret.
+func recordNvmlFailure(operation string, ret nvml.Return) {
+	nvmlFailures.WithLabelValues(operation, ret.Error()).Inc()
+}
+
+// recordRequeue counts the result of a reconcile of the controller when it is requeued.
+func recordRequeue(controller string, result ctrl.Result, err error) {
+	if err != nil || result.Requeue || result.RequeueAfter > 0 {
+		requeues.WithLabelValues(controller).Inc()
+	}
+}
+
+// setGpuSlotMetrics publishes the slot usage of every GPU of a node from its status.
+func setGpuSlotMetrics(instaslice *inferencev1alpha1.Instaslice) {
+	gpuSlots.DeletePartialMatch(prometheus.Labels{"node": instaslice.Name})
+	for _, gpu := range instaslice.Status.GPUs {
+		gpuSlots.WithLabelValues(instaslice.Name, gpu.GPUUUID, "used").Set(float64(gpu.SlotsUsed))
+		gpuSlots.WithLabelValues(instaslice.Name, gpu.GPUUUID, "free").Set(float64(gpu.SlotsFree))
+	}
+}
+
+// setSliceDriftMetrics publishes the drift found by the last resync of a node.
+func setSliceDriftMetrics(node string, drift []inferencev1alpha1.SliceDrift) {
+	counts := map[inferencev1alpha1.SliceDriftKind]int{inferencev1alpha1.SliceDriftOrphaned: 0, inferencev1alpha1.SliceDriftMissing: 0}
+	for _, sliceDrift := range drift {
+		counts[sliceDrift.Kind]++
+	}
+	for kind, count := range counts {
+		sliceDrift.WithLabelValues(node, string(kind)).Set(float64(count))
+	}
+}
+
+// pendingPodTracker keeps the profiles requested by gated pods so the pending pods gauge can be derived from it.
+type pendingPodTracker struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName][]string
+}
+
+var pendingPods = &pendingPodTracker{pods: make(map[types.NamespacedName][]string)}
+
+// set records the profiles a gated pod waits for.
+func (t *pendingPodTracker) set(pod types.NamespacedName, profiles []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pods[pod] = profiles
+	t.publish()
+}
+
+// remove forgets a pod once it is ungated or deleted.
+func (t *pendingPodTracker) remove(pod types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.pods[pod]; !exists {
+		return
+	}
+	delete(t.pods, pod)
+	t.publish()
+}
+
+// publish sets the gauge from the tracked pods, a pod is counted once per profile it requests.
+func (t *pendingPodTracker) publish() {
+	counts := make(map[string]int)
+	for _, profiles := range t.pods {
+		seen := make(map[string]bool)
+		for _, profile := range profiles {
+			if !seen[profile] {
+				seen[profile] = true
+				counts[profile]++
+			}
+		}
+	}
+	pendingPodsGauge.Reset()
+	for profile, count := range counts {
+		pendingPodsGauge.WithLabelValues(profile).Set(float64(count))
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func TestPendingPodTracker(t *testing.T) {
+	tracker := &pendingPodTracker{pods: make(map[types.NamespacedName][]string)}
+	tracker.set(types.NamespacedName{Namespace: "default", Name: "a"}, []string{"1g.5gb", "1g.5gb", "3g.20gb"})
+	tracker.set(types.NamespacedName{Namespace: "default", Name: "b"}, []string{"1g.5gb"})
+	assert.Equal(t, 2.0, testutil.ToFloat64(pendingPodsGauge.WithLabelValues("1g.5gb")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(pendingPodsGauge.WithLabelValues("3g.20gb")))
+
+	tracker.remove(types.NamespacedName{Namespace: "default", Name: "a"})
+	assert.Equal(t, 1.0, testutil.ToFloat64(pendingPodsGauge.WithLabelValues("1g.5gb")))
+	assert.Equal(t, 1, testutil.CollectAndCount(pendingPodsGauge))
+	pendingPodsGauge.Reset()
+}
+
+func TestRecordRequeue(t *testing.T) {
+	before := testutil.ToFloat64(requeues.WithLabelValues("test"))
+	recordRequeue("test", ctrl.Result{}, nil)
+	recordRequeue("test", ctrl.Result{Requeue: true}, nil)
+	recordRequeue("test", ctrl.Result{RequeueAfter: time.Second}, nil)
+	recordRequeue("test", ctrl.Result{}, errors.New("failed"))
+	assert.Equal(t, before+3, testutil.ToFloat64(requeues.WithLabelValues("test")))
+}
+
+func TestRecordNvmlFailure(t *testing.T) {
+	before := testutil.ToFloat64(nvmlFailures.WithLabelValues("CreateGpuInstanceWithPlacement", "ERROR_INSUFFICIENT_RESOURCES"))
+	recordNvmlFailure("CreateGpuInstanceWithPlacement", nvml.ERROR_INSUFFICIENT_RESOURCES)
+	assert.Equal(t, before+1, testutil.ToFloat64(nvmlFailures.WithLabelValues("CreateGpuInstanceWithPlacement", "ERROR_INSUFFICIENT_RESOURCES")))
+}
+
+func TestSetGpuSlotMetrics(t *testing.T) {
+	instaslice := &inferencev1alpha1.Instaslice{}
+	instaslice.Name = "metrics-node"
+	instaslice.Status.GPUs = []inferencev1alpha1.GPUSummary{{GPUUUID: "GPU-1", SlotsUsed: 3, SlotsFree: 5}}
+	setGpuSlotMetrics(instaslice)
+	series := testutil.CollectAndCount(gpuSlots)
+	assert.Equal(t, 3.0, testutil.ToFloat64(gpuSlots.WithLabelValues("metrics-node", "GPU-1", "used")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(gpuSlots.WithLabelValues("metrics-node", "GPU-1", "free")))
+
+	// GPUs that are no longer reported are dropped
+	instaslice.Status.GPUs = []inferencev1alpha1.GPUSummary{{GPUUUID: "GPU-2", SlotsFree: 8}}
+	setGpuSlotMetrics(instaslice)
+	assert.Equal(t, series, testutil.CollectAndCount(gpuSlots))
+	assert.Equal(t, 8.0, testutil.ToFloat64(gpuSlots.WithLabelValues("metrics-node", "GPU-2", "free")))
+}
+
+func TestReconcileRecordsPendingPodsAndLatency(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("metrics", "pod-metrics")
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), pod).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: record.NewFakeRecorder(100)}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "metrics", Namespace: "default"}}
+	creatingObserved := func() uint64 {
+		var metric dto.Metric
+		assert.NoError(t, allocationLatency.WithLabelValues(stageCreating).(prometheus.Histogram).Write(&metric))
+		return metric.GetHistogram().GetSampleCount()
+	}
+	creatingBefore := creatingObserved()
+	pendingBefore := testutil.ToFloat64(pendingPodsGauge.WithLabelValues("3g.20gb"))
+
+	_, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, pendingBefore+1, testutil.ToFloat64(pendingPodsGauge.WithLabelValues("3g.20gb")))
+	assert.Equal(t, creatingBefore+1, creatingObserved())
+
+	assert.NoError(t, fakeClient.Delete(ctx, pod))
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, pendingBefore, testutil.ToFloat64(pendingPodsGauge.WithLabelValues("3g.20gb")))
+}
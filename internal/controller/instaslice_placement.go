@@ -0,0 +1,338 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// gpuNode is the GPU inventory of a node from its Instaslice together with the slices allocated on it
+// keyed by InstasliceAllocation name.
+type gpuNode struct {
+	*inferencev1alpha1.Instaslice
+	allocations map[string]inferencev1alpha1.AllocationDetails
+}
+
+// newGpuNodes pairs every Instaslice with the allocations placed on its node.
+func newGpuNodes(instaslices []inferencev1alpha1.Instaslice, allocations []inferencev1alpha1.InstasliceAllocation) []gpuNode {
+	nodes := make([]gpuNode, 0, len(instaslices))
+	for i := range instaslices {
+		nodes = append(nodes, newGpuNode(&instaslices[i], allocations))
+	}
+	return nodes
+}
+
+// newGpuNode pairs the Instaslice with the allocations placed on its node.
+func newGpuNode(instaslice *inferencev1alpha1.Instaslice, allocations []inferencev1alpha1.InstasliceAllocation) gpuNode {
+	node := gpuNode{Instaslice: instaslice, allocations: make(map[string]inferencev1alpha1.AllocationDetails)}
+	for _, allocation := range allocations {
+		if allocation.Spec.Nodename == instaslice.Name {
+			node.allocations[allocation.Name] = allocation.Spec
+		}
+	}
+	return node
+}
+
+// copyWithAllocations returns a node sharing the inventory with its own copy of the allocations.
+func (n *gpuNode) copyWithAllocations() *gpuNode {
+	allocations := make(map[string]inferencev1alpha1.AllocationDetails, len(n.allocations))
+	for key, allocation := range n.allocations {
+		allocations[key] = allocation
+	}
+	return &gpuNode{Instaslice: n.Instaslice, allocations: allocations}
+}
+
+// placementCandidate is a free placement for a slice on a GPU of a node.
+type placementCandidate struct {
+	node    *gpuNode
+	gpuUUID string
+	start   uint32
+}
+
+// PlacementSelector is implemented by policies that compare every free placement in the cluster
+// instead of allocating on the first GPU with room.
+type PlacementSelector interface {
+	SelectPlacement(nodes []gpuNode, profileName string) (*placementCandidate, error)
+	// SelectNode returns the candidate node whose allocations, placed on each node for its own GPUs, fit best.
+	SelectNode(candidates []gpuNode, allocationsByNode map[string]map[string]inferencev1alpha1.AllocationDetails) (*gpuNode, error)
+}
+
+// BestFitPolicy places a slice where it removes the fewest placements of profiles at least as large,
+// preferring the fullest GPU on ties so that empty GPUs stay available for the largest profiles.
+type BestFitPolicy struct{}
+
+// gpuMigPlacements returns the MIG profiles and their placements of the model of a GPU of a node.
+// Instaslices recorded before placements were kept per model only have those of the first GPU.
+func gpuMigPlacements(instaslice *inferencev1alpha1.Instaslice, gpuUUID string) []inferencev1alpha1.Mig {
+	if migs, exists := instaslice.Spec.MigplacementByModel[instaslice.Spec.MigGPUUUID[gpuUUID]]; exists {
+		return migs
+	}
+	return instaslice.Spec.Migplacement
+}
+
+// nodeMigPlacements returns the MIG profiles and their placements of every GPU model of a node in model order,
+// a profile offered by several models is listed once per model.
+func nodeMigPlacements(instaslice *inferencev1alpha1.Instaslice) []inferencev1alpha1.Mig {
+	if len(instaslice.Spec.MigplacementByModel) == 0 {
+		return instaslice.Spec.Migplacement
+	}
+	models := make([]string, 0, len(instaslice.Spec.MigplacementByModel))
+	for model := range instaslice.Spec.MigplacementByModel {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	var migs []inferencev1alpha1.Mig
+	for _, model := range models {
+		migs = append(migs, instaslice.Spec.MigplacementByModel[model]...)
+	}
+	return migs
+}
+
+// gpuSlotCount returns the number of memory slots of a GPU of a node, derived from the placements of its model.
+func gpuSlotCount(instaslice *inferencev1alpha1.Instaslice, gpuUUID string) int {
+	slotCount := 0
+	for _, mig := range gpuMigPlacements(instaslice, gpuUUID) {
+		for _, placement := range mig.Placements {
+			if placement.Start+placement.Size > slotCount {
+				slotCount = placement.Start + placement.Size
+			}
+		}
+	}
+	return slotCount
+}
+
+// gpuSlotOccupancy marks the slots of a GPU used by allocations and by prepared slices that do not belong to a pod,
+// the slices of the warm pool included.
+func gpuSlotOccupancy(node *gpuNode, gpuUUID string) []bool {
+	slots := make([]bool, gpuSlotCount(node.Instaslice, gpuUUID))
+	occupy := func(start, size uint32) {
+		for i := start; i < start+size && int(i) < len(slots); i++ {
+			slots[i] = true
+		}
+	}
+	for _, item := range node.Spec.Prepared {
+		if item.Parent == gpuUUID && item.PodUUID == "" {
+			occupy(item.Start, item.Size)
+		}
+	}
+	for _, item := range node.allocations {
+		if item.GPUUUID == gpuUUID {
+			occupy(item.Start, item.Size)
+		}
+	}
+	return slots
+}
+
+// placementFits returns true when all slots of the placement are free.
+func placementFits(slots []bool, start, size int) bool {
+	if start < 0 || start+size > len(slots) {
+		return false
+	}
+	for i := start; i < start+size; i++ {
+		if slots[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// profilePlacements returns the discovered placements of a profile on a GPU of a node.
+func profilePlacements(instaslice *inferencev1alpha1.Instaslice, gpuUUID string, profileName string) []inferencev1alpha1.Placement {
+	for _, mig := range gpuMigPlacements(instaslice, gpuUUID) {
+		if mig.Profile == profileName {
+			return mig.Placements
+		}
+	}
+	return nil
+}
+
+// profileSize returns the memory slots a profile takes on the first GPU model of a node offering it.
+func profileSize(instaslice *inferencev1alpha1.Instaslice, profileName string) (int, bool) {
+	for _, mig := range nodeMigPlacements(instaslice) {
+		if mig.Profile == profileName && len(mig.Placements) > 0 {
+			return mig.Placements[0].Size, true
+		}
+	}
+	return 0, false
+}
+
+// freePlacementsOfSizeAtLeast counts the placements of profiles at least size slots large that fit in the free slots of a GPU,
+// the placements of compute instance profiles are those of their GPU instance and are not counted twice.
+func freePlacementsOfSizeAtLeast(instaslice *inferencev1alpha1.Instaslice, gpuUUID string, slots []bool, size int) int {
+	count := 0
+	for _, mig := range gpuMigPlacements(instaslice, gpuUUID) {
+		if _, _, isComputeInstance := computeInstanceSlices(mig.Profile); isComputeInstance {
+			continue
+		}
+		for _, placement := range mig.Placements {
+			if placement.Size >= size && placementFits(slots, placement.Start, placement.Size) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func freeSlotCount(slots []bool) int {
+	count := 0
+	for _, used := range slots {
+		if !used {
+			count++
+		}
+	}
+	return count
+}
+
+// SelectPlacement scores every free placement of the profile on every GPU of every node and returns the one
+// that keeps the most placements of profiles at least as large available. Nodes, GPUs and starts are visited in sorted
+// order so that ties are broken deterministically.
+func (b *BestFitPolicy) SelectPlacement(nodes []gpuNode, profileName string) (*placementCandidate, error) {
+	var best *placementCandidate
+	bestLost, bestFreeSlots := 0, 0
+
+	sortedNodes := make([]*gpuNode, 0, len(nodes))
+	for i := range nodes {
+		sortedNodes = append(sortedNodes, &nodes[i])
+	}
+	sort.Slice(sortedNodes, func(i, j int) bool { return sortedNodes[i].Name < sortedNodes[j].Name })
+
+	for _, node := range sortedNodes {
+		instaslice := node.Instaslice
+		gpus := make([]string, 0, len(instaslice.Spec.MigGPUUUID))
+		for gpuUUID := range instaslice.Spec.MigGPUUUID {
+			gpus = append(gpus, gpuUUID)
+		}
+		sort.Strings(gpus)
+		for _, gpuUUID := range gpus {
+			placements := profilePlacements(instaslice, gpuUUID, profileName)
+			if len(placements) == 0 {
+				continue
+			}
+			slots := gpuSlotOccupancy(node, gpuUUID)
+			freeSlots := freeSlotCount(slots)
+			// a slice of the warm pool or a compute instance in a GPU instance that is already there takes no placement away
+			start, reused := warmSliceStart(node, gpuUUID, profileName)
+			if !reused {
+				start, reused = sharedGPUInstanceStart(node, gpuUUID, profileName)
+			}
+			if reused {
+				if best == nil || bestLost >= 0 || freeSlots < bestFreeSlots {
+					best = &placementCandidate{node: node, gpuUUID: gpuUUID, start: start}
+					bestLost, bestFreeSlots = -1, freeSlots
+				}
+				continue
+			}
+			freeBefore := freePlacementsOfSizeAtLeast(instaslice, gpuUUID, slots, placements[0].Size)
+			for _, placement := range placements {
+				if !placementFits(slots, placement.Start, placement.Size) {
+					continue
+				}
+				after := make([]bool, len(slots))
+				copy(after, slots)
+				for i := placement.Start; i < placement.Start+placement.Size; i++ {
+					after[i] = true
+				}
+				lost := freeBefore - freePlacementsOfSizeAtLeast(instaslice, gpuUUID, after, placement.Size)
+				if best == nil || lost < bestLost || (lost == bestLost && freeSlots < bestFreeSlots) {
+					best = &placementCandidate{node: node, gpuUUID: gpuUUID, start: uint32(placement.Start)}
+					bestLost, bestFreeSlots = lost, freeSlots
+				}
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("failed to find allocatable gpu for profile %s", profileName)
+	}
+	return best, nil
+}
+
+// SelectNode scores the allocations of the slices of a pod on every candidate node in allocation name order, one
+// after the other, and returns the node that keeps the most placements of profiles at least as large available.
+// Ties go to the node the slices take the fewest slots on, as requests for a size may get larger profiles on some
+// nodes, then to the node whose GPUs are fullest and then to the first node by name.
+func (b *BestFitPolicy) SelectNode(candidates []gpuNode, allocationsByNode map[string]map[string]inferencev1alpha1.AllocationDetails) (*gpuNode, error) {
+	var best *gpuNode
+	bestScore := [3]int{}
+	for i := range candidates {
+		candidate := &candidates[i]
+		allocations, exists := allocationsByNode[candidate.Name]
+		if !exists {
+			continue
+		}
+		lost, freeSlots := allocationsPlacementLoss(candidate, allocations)
+		usedSlots := 0
+		for _, allocation := range allocations {
+			usedSlots += int(allocation.Size)
+		}
+		score := [3]int{lost, usedSlots, freeSlots}
+		if best == nil || lessScore(score, bestScore) || (score == bestScore && candidate.Name < best.Name) {
+			best, bestScore = candidate, score
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("failed to find node with allocatable gpu")
+	}
+	return best, nil
+}
+
+// lessScore returns true when score a ranks before score b, comparing their entries in order.
+func lessScore(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// allocationsPlacementLoss returns how many placements of profiles at least as large the allocations take away from
+// the node when added one after another, along with the free slots of the GPUs they land on. A slice reusing a slot
+// that is already taken, such as one of the warm pool or a compute instance in an existing GPU instance, takes none.
+func allocationsPlacementLoss(original *gpuNode, allocations map[string]inferencev1alpha1.AllocationDetails) (int, int) {
+	node := original.copyWithAllocations()
+	lost, freeSlots := 0, 0
+	for _, name := range sortedAllocationNames(allocations) {
+		allocation := allocations[name]
+		slots := gpuSlotOccupancy(node, allocation.GPUUUID)
+		freeSlots += freeSlotCount(slots)
+		start, size := int(allocation.Start), int(allocation.Size)
+		if placementFits(slots, start, size) {
+			before := freePlacementsOfSizeAtLeast(node.Instaslice, allocation.GPUUUID, slots, size)
+			for i := start; i < start+size; i++ {
+				slots[i] = true
+			}
+			lost += before - freePlacementsOfSizeAtLeast(node.Instaslice, allocation.GPUUUID, slots, size)
+		} else {
+			lost--
+		}
+		node.allocations[name] = allocation
+	}
+	return lost, freeSlots
+}
+
+// Policy based allocation - BestFit, placements are chosen by SelectPlacement.
+func (b *BestFitPolicy) SortPlacementStarts(starts []int) {}
+
+func (b *BestFitPolicy) SetAllocationDetails(profileName string, newStart, size uint32, podUUID, nodename string,
+	processed string, discoveredGiprofile int, Ciprofileid int, Ciengprofileid int,
+	namespace string, podName string, gpuUuid string) *inferencev1alpha1.AllocationDetails {
+	return newAllocationDetails(profileName, newStart, size, podUUID, nodename, processed, discoveredGiprofile,
+		Ciprofileid, Ciengprofileid, namespace, podName, gpuUuid)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func TestGpuSlotOccupancy(t *testing.T) {
+	instaslice := newTestNode("node-1", "GPU-1", "GPU-2")
+	instaslice.Spec.Prepared = map[string]inferencev1alpha1.PreparedDetails{
+		"MIG-dangling": {Parent: "GPU-1", Start: 0, Size: 1},
+		"MIG-pod":      {Parent: "GPU-1", Start: 2, Size: 1, PodUUID: "pod-1"},
+	}
+	instaslice.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-1", Start: 4, Size: 4},
+	}
+
+	assert.Equal(t, 8, gpuSlotCount(instaslice.Instaslice, "GPU-1"))
+	assert.Equal(t, []bool{true, false, false, false, true, true, true, true}, gpuSlotOccupancy(instaslice, "GPU-1"))
+	assert.Equal(t, 8, freeSlotCount(gpuSlotOccupancy(instaslice, "GPU-2")))
+	assert.True(t, placementFits(gpuSlotOccupancy(instaslice, "GPU-1"), 2, 2))
+	assert.False(t, placementFits(gpuSlotOccupancy(instaslice, "GPU-1"), 6, 2))
+	assert.False(t, placementFits(gpuSlotOccupancy(instaslice, "GPU-1"), 7, 2))
+}
+
+func TestPlacementsOfMixedGPUModels(t *testing.T) {
+	r := &InstasliceReconciler{}
+	node := newTestNode("node-1", "GPU-1", "GPU-A30")
+	node.Spec.MigGPUUUID["GPU-A30"] = "NVIDIA A30"
+	node.Spec.MigplacementByModel = map[string][]inferencev1alpha1.Mig{
+		"NVIDIA A100-PCIE-40GB": node.Spec.Migplacement,
+		"NVIDIA A30": {
+			{Profile: "1g.6gb", Giprofileid: 0, CIProfileID: 0, Placements: []inferencev1alpha1.Placement{
+				{Start: 0, Size: 1}, {Start: 1, Size: 1}, {Start: 2, Size: 1}, {Start: 3, Size: 1}}},
+			{Profile: "2g.12gb", Giprofileid: 1, CIProfileID: 1, Placements: []inferencev1alpha1.Placement{
+				{Start: 0, Size: 2}, {Start: 2, Size: 2}}},
+			{Profile: "4g.24gb", Giprofileid: 3, CIProfileID: 3, Placements: []inferencev1alpha1.Placement{
+				{Start: 0, Size: 4}}},
+		},
+	}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "vllm", Namespace: "default", UID: "pod-1"}}
+
+	assert.Equal(t, 8, gpuSlotCount(node.Instaslice, "GPU-1"))
+	assert.Equal(t, 4, gpuSlotCount(node.Instaslice, "GPU-A30"))
+	assert.Len(t, gpuSlotOccupancy(node, "GPU-A30"), 4)
+	assert.Equal(t, "7g.40gb", largestPlaceableProfile(node.Instaslice, "GPU-1", gpuSlotOccupancy(node, "GPU-1")))
+	assert.Equal(t, "4g.24gb", largestPlaceableProfile(node.Instaslice, "GPU-A30", gpuSlotOccupancy(node, "GPU-A30")))
+
+	// profiles of a model are only placed on the GPUs of that model
+	candidate, err := (&BestFitPolicy{}).SelectPlacement([]gpuNode{*node}, "2g.12gb")
+	assert.NoError(t, err)
+	assert.Equal(t, "GPU-A30", candidate.gpuUUID)
+	assert.Equal(t, uint32(0), candidate.start)
+	allocations, err := r.placeSlicesOnNode(node, []sliceRequest{{containerName: "vllm", profileName: "4g.24gb"}}, &LeftToRightPolicy{}, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "GPU-A30", allocations["pod-1-vllm-0"].GPUUUID)
+	assert.Equal(t, uint32(4), allocations["pod-1-vllm-0"].Size)
+	assert.Equal(t, 3, allocations["pod-1-vllm-0"].Giprofileid)
+
+	node.allocations["pod-0-vllm-0"] = inferencev1alpha1.AllocationDetails{GPUUUID: "GPU-A30", Profile: "1g.6gb", Start: 0, Size: 1}
+	_, err = r.placeSlicesOnNode(node, []sliceRequest{{containerName: "vllm", profileName: "4g.24gb"}}, &LeftToRightPolicy{}, pod)
+	assert.Error(t, err)
+}
+
+func TestBestFitPolicyEmptyGpu(t *testing.T) {
+	instaslices := []gpuNode{*newTestNode("node-1", "GPU-1")}
+
+	// the last 1g placement only removes itself, the second 3g placement and the 7g placement
+	candidate, err := (&BestFitPolicy{}).SelectPlacement(instaslices, "1g.5gb")
+	assert.NoError(t, err)
+	assert.Equal(t, "GPU-1", candidate.gpuUUID)
+	assert.Equal(t, uint32(6), candidate.start)
+
+	// the second 3g placement keeps the 4g placement available
+	candidate, err = (&BestFitPolicy{}).SelectPlacement(instaslices, "3g.20gb")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), candidate.start)
+}
+
+func TestBestFitPolicyPrefersUsedGpu(t *testing.T) {
+	node := newTestNode("node-1", "GPU-1", "GPU-2")
+	node.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-2", Profile: "1g.5gb", Start: 6, Size: 1},
+	}
+
+	candidate, err := (&BestFitPolicy{}).SelectPlacement([]gpuNode{*node}, "1g.5gb")
+	assert.NoError(t, err)
+	assert.Equal(t, "GPU-2", candidate.gpuUUID)
+	assert.Equal(t, uint32(4), candidate.start)
+}
+
+func TestBestFitPolicyAcrossNodes(t *testing.T) {
+	emptyNode := newTestNode("node-a", "GPU-A")
+	usedNode := newTestNode("node-b", "GPU-B")
+	usedNode.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-B", Profile: "3g.20gb", Start: 0, Size: 4},
+	}
+	instaslices := []gpuNode{*emptyNode, *usedNode}
+
+	candidate, err := (&BestFitPolicy{}).SelectPlacement(instaslices, "1g.5gb")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-b", candidate.node.Name)
+	assert.Equal(t, "GPU-B", candidate.gpuUUID)
+	assert.Equal(t, uint32(6), candidate.start)
+
+	// only the empty node can still host a 7g slice
+	candidate, err = (&BestFitPolicy{}).SelectPlacement(instaslices, "7g.40gb")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", candidate.node.Name)
+
+	emptyNode.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-2": {PodUUID: "pod-2", GPUUUID: "GPU-A", Profile: "1g.5gb", Start: 6, Size: 1},
+	}
+	_, err = (&BestFitPolicy{}).SelectPlacement([]gpuNode{*emptyNode, *usedNode}, "7g.40gb")
+	assert.Error(t, err)
+}
+
+func TestFindNodeForSlicesWithBestFit(t *testing.T) {
+	r := &InstasliceReconciler{}
+	emptyNode := newTestNode("node-a", "GPU-A")
+	usedNode := newTestNode("node-b", "GPU-B")
+	usedNode.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1": {PodUUID: "pod-1", GPUUUID: "GPU-B", Profile: "3g.20gb", Start: 0, Size: 4},
+	}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-2", Namespace: "default", UID: "pod-2"}}
+
+	requests := []sliceRequest{{containerName: "vllm", profileName: "2g.10gb"}}
+	instaslice, allocations, err := r.findNodeForSlices(context.Background(), []gpuNode{*emptyNode, *usedNode}, requests, &BestFitPolicy{}, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-b", instaslice.Name)
+	assert.Len(t, allocations, 1)
+	allocation := allocations["pod-2-vllm-0"]
+	assert.Equal(t, "node-b", allocation.Nodename)
+	assert.Equal(t, "GPU-B", allocation.GPUUUID)
+	assert.Equal(t, uint32(4), allocation.Start)
+	assert.Equal(t, uint32(2), allocation.Size)
+	assert.Equal(t, 1, allocation.Giprofileid)
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreating, allocation.Allocationstatus)
+}
+
+func TestFindNodeForSlicesWithBestFitResolvesSizesPerNode(t *testing.T) {
+	r := &InstasliceReconciler{}
+	// node-a offers no 1g.5gb profile, a 5Gi slice gets a 2g.10gb slice there
+	noSmallProfileNode := newTestNode("node-a", "GPU-A")
+	noSmallProfileNode.Spec.Migplacement = noSmallProfileNode.Spec.Migplacement[1:]
+	smallProfileNode := newTestNode("node-b", "GPU-B")
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-2", Namespace: "default", UID: "pod-2"}}
+
+	requests := []sliceRequest{{containerName: "vllm", size: &sliceSize{memory: resource.MustParse("5Gi")}}}
+	instaslice, allocations, err := r.findNodeForSlices(context.Background(), []gpuNode{*noSmallProfileNode, *smallProfileNode}, requests, &BestFitPolicy{}, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-b", instaslice.Name)
+	assert.Equal(t, "1g.5gb", allocations["pod-2-vllm-0"].Profile)
+}
@@ -0,0 +1,434 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+const (
+	// preemptionReservationTimeout is how long the placement freed by a preemption is held for the preemptor,
+	// it covers the graceful termination of the evicted pods and the release of their slices.
+	preemptionReservationTimeout = 2 * time.Minute
+	// reservationAllocationPrefix prefixes the placeholder allocations that keep reserved placements taken.
+	reservationAllocationPrefix = "reservation/"
+	// reservationAnnotation keeps the placement reserved for a gated pod on the pod so a restarted controller
+	// still holds it.
+	reservationAnnotation = "instaslice.codeflare.dev/reservation"
+)
+
+// preemptionVictim is a lower priority pod whose slices are released for a preemptor.
+type preemptionVictim struct {
+	pod types.NamespacedName
+	uid types.UID
+	// evict is false for pods whose slices are already being released.
+	evict bool
+}
+
+// preemptionReservation is a placement freed for a preemptor by evicting lower priority pods.
+type preemptionReservation struct {
+	node    string
+	gpuUUID string
+	start   uint32
+	size    uint32
+	// slices are the placements all slices of the preemptor take once the victims released theirs.
+	slices  []inferencev1alpha1.AllocationDetails
+	victims []preemptionVictim
+	expires time.Time
+}
+
+// evictions returns the number of pods evicted for the reservation.
+func (p preemptionReservation) evictions() int {
+	count := 0
+	for _, victim := range p.victims {
+		if victim.evict {
+			count++
+		}
+	}
+	return count
+}
+
+// preemptionReservations keeps the placements reserved for preemptors by pod UID.
+type preemptionReservations struct {
+	mu           sync.Mutex
+	reservations map[types.UID]preemptionReservation
+}
+
+func (p *preemptionReservations) get(uid types.UID) (preemptionReservation, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reservation, exists := p.reservations[uid]
+	if exists && time.Now().After(reservation.expires) {
+		delete(p.reservations, uid)
+		return preemptionReservation{}, false
+	}
+	return reservation, exists
+}
+
+func (p *preemptionReservations) set(uid types.UID, reservation preemptionReservation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reservations == nil {
+		p.reservations = make(map[types.UID]preemptionReservation)
+	}
+	p.reservations[uid] = reservation
+}
+
+func (p *preemptionReservations) remove(uid types.UID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.reservations, uid)
+}
+
+// holdOnNodes takes the placements reserved for other preemptors on the nodes so no other pod is placed there.
+func (p *preemptionReservations) holdOnNodes(nodes []gpuNode, uid types.UID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for preemptor, reservation := range p.reservations {
+		if preemptor == uid || now.After(reservation.expires) {
+			continue
+		}
+		for i := range nodes {
+			if nodes[i].Name != reservation.node {
+				continue
+			}
+			for j, slice := range reservation.slices {
+				nodes[i].allocations[fmt.Sprintf("%s%s/%d", reservationAllocationPrefix, preemptor, j)] = inferencev1alpha1.AllocationDetails{
+					PodUUID: string(preemptor), GPUUUID: slice.GPUUUID, Start: slice.Start, Size: slice.Size,
+				}
+			}
+		}
+	}
+}
+
+// reservationRecord is a preemption reservation as kept in the reservationAnnotation of its pod.
+type reservationRecord struct {
+	Node    string                                `json:"node"`
+	GPUUUID string                                `json:"gpuUUID"`
+	Start   uint32                                `json:"start"`
+	Size    uint32                                `json:"size"`
+	Slices  []inferencev1alpha1.AllocationDetails `json:"slices"`
+	Victims []victimRecord                        `json:"victims,omitempty"`
+	Expires metav1.Time                           `json:"expires"`
+}
+
+// victimRecord is a victim of a preemption reservation as kept in the reservationAnnotation of the preemptor.
+type victimRecord struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid"`
+	Evict     bool      `json:"evict,omitempty"`
+}
+
+func newReservationRecord(reservation preemptionReservation) reservationRecord {
+	record := reservationRecord{Node: reservation.node, GPUUUID: reservation.gpuUUID, Start: reservation.start, Size: reservation.size,
+		Slices: reservation.slices, Expires: metav1.NewTime(reservation.expires)}
+	for _, victim := range reservation.victims {
+		record.Victims = append(record.Victims, victimRecord{Namespace: victim.pod.Namespace, Name: victim.pod.Name, UID: victim.uid, Evict: victim.evict})
+	}
+	return record
+}
+
+func (record reservationRecord) reservation() preemptionReservation {
+	reservation := preemptionReservation{node: record.Node, gpuUUID: record.GPUUUID, start: record.Start, size: record.Size,
+		slices: record.Slices, expires: record.Expires.Time}
+	for _, victim := range record.Victims {
+		reservation.victims = append(reservation.victims, preemptionVictim{pod: types.NamespacedName{Namespace: victim.Namespace, Name: victim.Name},
+			uid: victim.UID, evict: victim.Evict})
+	}
+	return reservation
+}
+
+// reserve holds a placement for a gated pod and records it on the pod, the placement stays held in memory
+// when the pod cannot be patched.
+func (r *InstasliceReconciler) reserve(ctx context.Context, pod *v1.Pod, reservation preemptionReservation) {
+	r.reservations.set(pod.UID, reservation)
+	value, err := json.Marshal(newReservationRecord(reservation))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to encode reservation of ", "pod", pod.Name)
+		return
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[reservationAnnotation] = string(value)
+	if err := r.Patch(ctx, pod, patch); err != nil {
+		log.FromContext(ctx).Error(err, "unable to record reservation on ", "pod", pod.Name)
+	}
+}
+
+// releaseReservation drops the placement held for a pod once its slices are placed.
+func (r *InstasliceReconciler) releaseReservation(ctx context.Context, pod *v1.Pod) {
+	r.reservations.remove(pod.UID)
+	if _, exists := pod.Annotations[reservationAnnotation]; !exists {
+		return
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	delete(pod.Annotations, reservationAnnotation)
+	if err := r.Patch(ctx, pod, patch); err != nil {
+		log.FromContext(ctx).Error(err, "unable to remove reservation from ", "pod", pod.Name)
+	}
+}
+
+// restoreReservations loads the reservations recorded on the gated pods once after the controller started,
+// reservations that expired meanwhile are dropped. It is called with the placing lock held.
+func (r *InstasliceReconciler) restoreReservations(ctx context.Context) error {
+	if r.reservationsRestored {
+		return nil
+	}
+	var podList v1.PodList
+	if err := r.List(ctx, &podList); err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		value, exists := pod.Annotations[reservationAnnotation]
+		if !exists || !checkIfPodGated(pod, false) || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		var record reservationRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			log.FromContext(ctx).Error(err, "ignoring reservation recorded on ", "pod", pod.Name)
+			continue
+		}
+		if now.After(record.Expires.Time) {
+			continue
+		}
+		if _, exists := r.reservations.get(pod.UID); !exists {
+			r.reservations.set(pod.UID, record.reservation())
+		}
+	}
+	r.reservationsRestored = true
+	return nil
+}
+
+// podPriority returns the priority the priority class of the pod resolved to, pods without one have priority 0.
+func podPriority(pod *v1.Pod) int32 {
+	if pod.Spec.Priority != nil {
+		return *pod.Spec.Priority
+	}
+	return 0
+}
+
+// preemptForPod reserves a placement for a pod that does not fit anywhere by evicting lower priority pods,
+// it returns false when the pod may not preempt or no set of lower priority pods frees room for it.
+func (r *InstasliceReconciler) preemptForPod(ctx context.Context, pod *v1.Pod, nodes []gpuNode, requests []sliceRequest, policy AllocationPolicy) bool {
+	if pod.Spec.PreemptionPolicy != nil && *pod.Spec.PreemptionPolicy == v1.PreemptNever {
+		return false
+	}
+	priority := podPriority(pod)
+	reservation, exists := r.reservations.get(pod.UID)
+	// a placement held at the head of the admission queue evicts nothing, the pod may still preempt
+	if !exists || reservation.evictions() == 0 {
+		plan := r.planPreemption(ctx, pod, nodes, requests, policy, func(victim *v1.Pod) bool { return podPriority(victim) < priority })
+		if plan == nil {
+			return false
+		}
+		reservation = *plan
+		reservation.expires = time.Now().Add(preemptionReservationTimeout)
+		r.reserve(ctx, pod, reservation)
+		var victims []string
+		for _, victim := range reservation.victims {
+			victims = append(victims, victim.pod.String())
+		}
+		log.FromContext(ctx).Info("preempting lower priority pods for ", "pod", pod.Name, "node", reservation.node, "gpu", reservation.gpuUUID, "victims", victims)
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, EventReasonPreempting, "preempting %d pods on node %s GPU %s start %d: %s",
+			len(victims), reservation.node, reservation.gpuUUID, reservation.start, strings.Join(victims, ", "))
+	}
+	// evictions blocked by a disruption budget are retried until the reservation expires
+	r.evictVictims(ctx, pod, reservation)
+	return true
+}
+
+// planPreemption returns the placement needing the fewest evictions of preemptible pods after which all slices
+// of the pod fit on a node. Only allocations overlapping the placement on its GPU are released, the victims may
+// free room on other GPUs as well, so every placement the slices take is reserved.
+func (r *InstasliceReconciler) planPreemption(ctx context.Context, pod *v1.Pod, nodes []gpuNode, requests []sliceRequest, policy AllocationPolicy, preemptible func(victim *v1.Pod) bool) *preemptionReservation {
+	victimCache := make(map[string]*preemptionVictim)
+	var best *preemptionReservation
+	for i := range nodes {
+		node := &nodes[i]
+		resolved, err := resolveSliceRequests(node.Instaslice, requests)
+		if err != nil {
+			continue
+		}
+		var profiles []string
+		seen := make(map[string]bool)
+		for _, request := range resolved {
+			if !seen[request.profileName] {
+				seen[request.profileName] = true
+				profiles = append(profiles, request.profileName)
+			}
+		}
+		gpuUUIDs := make([]string, 0, len(node.Spec.MigGPUUUID))
+		for gpuUUID := range node.Spec.MigGPUUUID {
+			gpuUUIDs = append(gpuUUIDs, gpuUUID)
+		}
+		sort.Strings(gpuUUIDs)
+		for _, gpuUUID := range gpuUUIDs {
+			for _, profile := range profiles {
+				for _, placement := range profilePlacements(node.Instaslice, gpuUUID, profile) {
+					victims, preemptible := r.placementVictims(ctx, node, gpuUUID, uint32(placement.Start), uint32(placement.Size), preemptible, victimCache)
+					if !preemptible || len(victims) == 0 {
+						continue
+					}
+					allocations, err := r.placeSlicesOnNode(node.withoutPods(victims), requests, policy, pod)
+					if err != nil {
+						continue
+					}
+					slices := make([]inferencev1alpha1.AllocationDetails, 0, len(allocations))
+					for _, name := range sortedAllocationNames(allocations) {
+						slices = append(slices, allocations[name])
+					}
+					candidate := &preemptionReservation{node: node.Name, gpuUUID: gpuUUID, start: uint32(placement.Start), size: uint32(placement.Size),
+						slices: slices, victims: victims}
+					if best == nil || candidate.evictions() < best.evictions() ||
+						(candidate.evictions() == best.evictions() && len(candidate.victims) < len(best.victims)) {
+						best = candidate
+					}
+				}
+			}
+		}
+	}
+	return best
+}
+
+// placementVictims returns the pods holding slices that overlap a placement on a GPU of the node, the bool is
+// false when one of them may not be preempted: a pod that is not preemptible, a slice no pod owns outside
+// the warm pool or a placement reserved for another preemptor.
+func (r *InstasliceReconciler) placementVictims(ctx context.Context, node *gpuNode, gpuUUID string, start, size uint32, preemptible func(victim *v1.Pod) bool, victimCache map[string]*preemptionVictim) ([]preemptionVictim, bool) {
+	overlaps := func(otherStart, otherSize uint32) bool {
+		return start < otherStart+otherSize && otherStart < start+size
+	}
+	for _, prepared := range node.Spec.Prepared {
+		if prepared.Parent == gpuUUID && prepared.PodUUID == "" && !prepared.WarmPool && overlaps(prepared.Start, prepared.Size) {
+			return nil, false
+		}
+	}
+	var victims []preemptionVictim
+	added := make(map[string]bool)
+	keys := make([]string, 0, len(node.allocations))
+	for key := range node.allocations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		allocation := node.allocations[key]
+		if allocation.GPUUUID != gpuUUID || !overlaps(allocation.Start, allocation.Size) {
+			continue
+		}
+		if strings.HasPrefix(key, reservationAllocationPrefix) {
+			return nil, false
+		}
+		victim, exists := victimCache[allocation.PodUUID]
+		if !exists {
+			var evictable bool
+			victim, evictable = r.allocationVictim(ctx, allocation, preemptible)
+			if !evictable {
+				victim = nil
+			}
+			victimCache[allocation.PodUUID] = victim
+		}
+		if victim == nil {
+			return nil, false
+		}
+		if !added[allocation.PodUUID] {
+			added[allocation.PodUUID] = true
+			victims = append(victims, *victim)
+		}
+	}
+	return victims, true
+}
+
+// allocationVictim returns the pod of an allocation as a victim of a preemptor, evictable is false
+// when the pod is not preemptible. Pods already deleted release their slices without eviction.
+func (r *InstasliceReconciler) allocationVictim(ctx context.Context, allocation inferencev1alpha1.AllocationDetails, preemptible func(victim *v1.Pod) bool) (*preemptionVictim, bool) {
+	victim := &preemptionVictim{pod: types.NamespacedName{Namespace: allocation.Namespace, Name: allocation.PodName}, uid: types.UID(allocation.PodUUID)}
+	if allocation.Allocationstatus == inferencev1alpha1.AllocationStatusReleasing || allocation.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted {
+		return victim, true
+	}
+	var pod v1.Pod
+	if err := r.Get(ctx, victim.pod, &pod); err != nil {
+		if errors.IsNotFound(err) {
+			return victim, true
+		}
+		log.FromContext(ctx).Error(err, "unable to fetch pod holding slice", "pod", victim.pod)
+		return nil, false
+	}
+	if pod.UID != victim.uid || !pod.DeletionTimestamp.IsZero() {
+		return victim, true
+	}
+	if !preemptible(&pod) {
+		return nil, false
+	}
+	victim.evict = true
+	return victim, true
+}
+
+// evictVictims evicts the pods of a reservation that are still running through the Eviction API,
+// which refuses evictions that would violate a PodDisruptionBudget.
+func (r *InstasliceReconciler) evictVictims(ctx context.Context, preemptor *v1.Pod, reservation preemptionReservation) {
+	for _, victim := range reservation.victims {
+		if !victim.evict {
+			continue
+		}
+		var pod v1.Pod
+		if err := r.Get(ctx, victim.pod, &pod); err != nil || pod.UID != victim.uid || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}}
+		if err := r.SubResource("eviction").Create(ctx, &pod, eviction); err != nil {
+			log.FromContext(ctx).Error(err, "unable to evict pod for ", "preemptor", preemptor.Name, "pod", victim.pod)
+			r.Recorder.Eventf(preemptor, v1.EventTypeWarning, EventReasonPreemptionBlocked, "unable to evict pod %s: %v", victim.pod, err)
+			continue
+		}
+		r.Recorder.Eventf(&pod, v1.EventTypeNormal, EventReasonPreempted, "evicted to free GPU %s on node %s for higher priority pod %s/%s",
+			reservation.gpuUUID, reservation.node, preemptor.Namespace, preemptor.Name)
+	}
+}
+
+// withoutPods returns a copy of the node without the allocations of the victims.
+func (n *gpuNode) withoutPods(victims []preemptionVictim) *gpuNode {
+	node := n.copyWithAllocations()
+	for key, allocation := range node.allocations {
+		for _, victim := range victims {
+			if allocation.PodUUID == string(victim.uid) {
+				delete(node.allocations, key)
+			}
+		}
+	}
+	return node
+}
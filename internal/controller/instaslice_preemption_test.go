@@ -0,0 +1,249 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// newRunningTestPod returns a pod with priority holding a slice of profile on a GPU of node-1 along with its allocation.
+func newRunningTestPod(name string, priority int32, gpuUUID string, profile string, start, size uint32) (*v1.Pod, *inferencev1alpha1.InstasliceAllocation) {
+	pod := newGatedTestPod(name, types.UID(name+"-uid"))
+	pod.Spec.SchedulingGates = nil
+	pod.Spec.Priority = &priority
+	allocation := newInstasliceAllocation(pod, name+"-uid-vllm-0", inferencev1alpha1.AllocationDetails{
+		Nodename: "node-1", PodUUID: name + "-uid", PodName: name, Namespace: "default", GPUUUID: gpuUUID,
+		Profile: profile, Start: start, Size: size, Allocationstatus: inferencev1alpha1.AllocationStatusUngated,
+	})
+	return pod, allocation
+}
+
+func newPreemptorTestPod(name string, priority int32, profile string) *v1.Pod {
+	pod := newGatedTestPod(name, types.UID(name+"-uid"))
+	pod.Spec.Priority = &priority
+	pod.Spec.Containers[0].Resources.Limits = v1.ResourceList{v1.ResourceName(migResourcePrefix + profile): resource.MustParse("1")}
+	return pod
+}
+
+func TestReconcilePreemptsFewestLowerPriorityPods(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	var objs []client.Object
+	add := func(pod *v1.Pod, allocation *inferencev1alpha1.InstasliceAllocation) {
+		objs = append(objs, pod, allocation)
+	}
+	// GPU-1 is shared by a low and a high priority pod, GPU-2 by four low priority pods
+	add(newRunningTestPod("low-a", 0, "GPU-1", "3g.20gb", 0, 4))
+	add(newRunningTestPod("high-b", 1000, "GPU-1", "3g.20gb", 4, 4))
+	add(newRunningTestPod("low-c", 0, "GPU-2", "2g.10gb", 0, 2))
+	add(newRunningTestPod("low-d", 0, "GPU-2", "2g.10gb", 2, 2))
+	add(newRunningTestPod("low-e", 0, "GPU-2", "2g.10gb", 4, 2))
+	add(newRunningTestPod("low-f", 0, "GPU-2", "1g.5gb", 6, 1))
+	preemptor := newPreemptorTestPod("preemptor", 100, "3g.20gb")
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(append(objs, newTestNode("node-1", "GPU-1", "GPU-2").Instaslice, newKubeNode("node-1"), preemptor)...).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder, QueueBackfill: true}
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	assert.Equal(t, "Normal Preempting preempting 1 pods on node node-1 GPU GPU-1 start 0: default/low-a", <-recorder.Events)
+	assert.Equal(t, "Normal Preempted evicted to free GPU GPU-1 on node node-1 for higher priority pod default/preemptor", <-recorder.Events)
+	// evicted pods terminate until the controller releases their slices and removes its finalizer
+	var pod v1.Pod
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "low-a", Namespace: "default"}, &pod))
+	assert.False(t, pod.DeletionTimestamp.IsZero())
+	for _, name := range []string{"high-b", "low-c", "low-d", "low-e", "low-f"} {
+		pod = v1.Pod{}
+		assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, &pod))
+		assert.True(t, pod.DeletionTimestamp.IsZero())
+	}
+
+	// the daemonset released the slice of the evicted pod, the freed placement is held for the preemptor
+	var released inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "low-a-uid-vllm-0", Namespace: "default"}, &released))
+	released.Finalizers = nil
+	assert.NoError(t, fakeClient.Update(ctx, &released))
+	assert.NoError(t, fakeClient.Delete(ctx, &released))
+	other := newPreemptorTestPod("other", 0, "3g.20gb")
+	assert.NoError(t, fakeClient.Create(ctx, other))
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "other", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.Contains(t, <-recorder.Events, "Warning InsufficientCapacity")
+
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, preemptor)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "GPU-1", allocations[0].Spec.GPUUUID)
+	assert.Equal(t, uint32(0), allocations[0].Spec.Start)
+	_, reserved := r.reservations.get(preemptor.UID)
+	assert.False(t, reserved)
+}
+
+func TestReconcileRestoresReservationAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	lowPod, lowAllocation := newRunningTestPod("low-a", 0, "GPU-1", "3g.20gb", 0, 4)
+	highPod, highAllocation := newRunningTestPod("high-b", 1000, "GPU-1", "3g.20gb", 4, 4)
+	preemptor := newPreemptorTestPod("preemptor", 100, "3g.20gb")
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), lowPod, lowAllocation, highPod, highAllocation, preemptor).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder, QueueBackfill: true}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Normal Preempting preempting 1 pods on node node-1 GPU GPU-1 start 0: default/low-a", <-recorder.Events)
+	var pod v1.Pod
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "preemptor", Namespace: "default"}, &pod))
+	assert.Contains(t, pod.Annotations[reservationAnnotation], `"gpuUUID":"GPU-1"`)
+
+	// the slice of the evicted pod is released while the controller restarts, the freed placement is still held
+	var released inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "low-a-uid-vllm-0", Namespace: "default"}, &released))
+	released.Finalizers = nil
+	assert.NoError(t, fakeClient.Update(ctx, &released))
+	assert.NoError(t, fakeClient.Delete(ctx, &released))
+	restarted := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: record.NewFakeRecorder(100), QueueBackfill: true}
+	other := newPreemptorTestPod("other", 0, "3g.20gb")
+	assert.NoError(t, fakeClient.Create(ctx, other))
+	_, err = restarted.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "other", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := restarted.listPodAllocations(ctx, other)
+	assert.NoError(t, err)
+	assert.Empty(t, allocations)
+
+	_, err = restarted.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err = restarted.listPodAllocations(ctx, preemptor)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, uint32(0), allocations[0].Spec.Start)
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "preemptor", Namespace: "default"}, &pod))
+	assert.NotContains(t, pod.Annotations, reservationAnnotation)
+}
+
+func TestReconcileReservesEveryPlacementOfPreemptor(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	// the low priority pod holds a slice on both GPUs, the high priority pods the rest of them
+	lowPod, lowAllocation := newRunningTestPod("low", 0, "GPU-1", "3g.20gb", 0, 4)
+	lowSecondAllocation := newInstasliceAllocation(lowPod, "low-uid-vllm-1", inferencev1alpha1.AllocationDetails{
+		Nodename: "node-1", PodUUID: "low-uid", PodName: "low", Namespace: "default", GPUUUID: "GPU-2",
+		Profile: "3g.20gb", Start: 0, Size: 4, Allocationstatus: inferencev1alpha1.AllocationStatusUngated,
+	})
+	highPod1, highAllocation1 := newRunningTestPod("high-1", 1000, "GPU-1", "3g.20gb", 4, 4)
+	highPod2, highAllocation2 := newRunningTestPod("high-2", 1000, "GPU-2", "3g.20gb", 4, 4)
+	preemptor := newPreemptorTestPod("preemptor", 100, "3g.20gb")
+	second := *preemptor.Spec.Containers[0].DeepCopy()
+	second.Name = "vllm-2"
+	preemptor.Spec.Containers = append(preemptor.Spec.Containers, second)
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1", "GPU-2").Instaslice, newKubeNode("node-1"), lowPod, lowAllocation, lowSecondAllocation,
+			highPod1, highAllocation1, highPod2, highAllocation2, preemptor).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder, QueueBackfill: true}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Normal Preempting preempting 1 pods on node node-1 GPU GPU-1 start 0: default/low", <-recorder.Events)
+	reservation, reserved := r.reservations.get(preemptor.UID)
+	assert.True(t, reserved)
+	assert.Len(t, reservation.slices, 2)
+
+	// both slices of the evicted pod are released, neither is handed to another pod
+	for _, name := range []string{"low-uid-vllm-0", "low-uid-vllm-1"} {
+		var released inferencev1alpha1.InstasliceAllocation
+		assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, &released))
+		released.Finalizers = nil
+		assert.NoError(t, fakeClient.Update(ctx, &released))
+		assert.NoError(t, fakeClient.Delete(ctx, &released))
+	}
+	other := newPreemptorTestPod("other", 0, "3g.20gb")
+	assert.NoError(t, fakeClient.Create(ctx, other))
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "other", Namespace: "default"}})
+	assert.NoError(t, err)
+	otherAllocations, err := r.listPodAllocations(ctx, other)
+	assert.NoError(t, err)
+	assert.Empty(t, otherAllocations)
+
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, preemptor)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 2)
+	starts := make(map[string]uint32)
+	for _, allocation := range allocations {
+		starts[allocation.Spec.GPUUUID] = allocation.Spec.Start
+	}
+	assert.Equal(t, map[string]uint32{"GPU-1": 0, "GPU-2": 0}, starts)
+}
+
+func TestReconcileDoesNotPreemptPodsItMayNot(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	lowPod, lowAllocation := newRunningTestPod("low", 0, "GPU-1", "7g.40gb", 0, 8)
+	highPod, highAllocation := newRunningTestPod("high", 1000, "GPU-2", "7g.40gb", 0, 8)
+	never := v1.PreemptNever
+	for _, tc := range []struct {
+		name      string
+		priority  int32
+		preempter *v1.PreemptionPolicy
+	}{
+		{name: "same priority", priority: 0},
+		{name: "never preempts", priority: 100, preempter: &never},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			preemptor := newPreemptorTestPod("preemptor", tc.priority, "7g.40gb")
+			preemptor.Spec.PreemptionPolicy = tc.preempter
+			recorder := record.NewFakeRecorder(100)
+			fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+				WithObjects(newTestNode("node-1", "GPU-1", "GPU-2").Instaslice, newKubeNode("node-1"), lowPod.DeepCopy(), lowAllocation.DeepCopy(), highPod.DeepCopy(), highAllocation.DeepCopy(), preemptor).Build()
+			r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "preemptor", Namespace: "default"}})
+			assert.NoError(t, err)
+			assert.Equal(t, "Normal Queued head of the admission queue, holding node node-1 GPU GPU-1 start 0 until 1 pods release their slices", <-recorder.Events)
+			assert.Contains(t, <-recorder.Events, "Warning InsufficientCapacity")
+			for _, name := range []string{"low", "high"} {
+				var pod v1.Pod
+				assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, &pod))
+				assert.True(t, pod.DeletionTimestamp.IsZero())
+			}
+		})
+	}
+}
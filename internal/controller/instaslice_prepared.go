@@ -0,0 +1,130 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+type preparedMig struct {
+	gid     uint32
+	miguuid string
+	cid     uint32
+}
+
+// preparedMigCache remembers the slice realized for every allocation of the node keyed by allocation name.
+type preparedMigCache struct {
+	mu   sync.Mutex
+	migs map[string]preparedMig
+}
+
+func (c *preparedMigCache) get(allocationKey string) (preparedMig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mig, exists := c.migs[allocationKey]
+	return mig, exists
+}
+
+func (c *preparedMigCache) set(allocationKey string, mig preparedMig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.migs == nil {
+		c.migs = make(map[string]preparedMig)
+	}
+	c.migs[allocationKey] = mig
+}
+
+// contains returns true when the MIG device is cached for an allocation.
+func (c *preparedMigCache) contains(migUUID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, mig := range c.migs {
+		if mig.miguuid == migUUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *preparedMigCache) delete(allocationKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.migs, allocationKey)
+}
+
+// findRealizedSlice returns the MIG device that already realizes an allocation: it is on the GPU of the allocation
+// with the same placement and profile and is not prepared for another pod.
+func findRealizedSlice(allocation inferencev1alpha1.AllocationDetails, instaslice *inferencev1alpha1.Instaslice, migDevices map[string]inferencev1alpha1.PreparedDetails) (preparedMig, bool) {
+	for migUUID, device := range migDevices {
+		if device.Parent != allocation.GPUUUID || device.Start != allocation.Start || device.Size != allocation.Size || device.Profile != allocation.Profile {
+			continue
+		}
+		if prepared, exists := instaslice.Spec.Prepared[migUUID]; exists && prepared.PodUUID != "" && prepared.PodUUID != allocation.PodUUID {
+			continue
+		}
+		return preparedMig{gid: device.Giinfoid, miguuid: migUUID, cid: device.Ciinfoid}, true
+	}
+	return preparedMig{}, false
+}
+
+// adoptRealizedSlice caches the MIG device that already realizes an allocation, e.g. created before the daemonset
+// restarted, so the slice is not created a second time.
+func (r *InstaSliceDaemonsetReconciler) adoptRealizedSlice(ctx context.Context, allocation *inferencev1alpha1.InstasliceAllocation, instaslice *inferencev1alpha1.Instaslice, migDevices map[string]inferencev1alpha1.PreparedDetails) bool {
+	// compute instances sharing a GPU instance have the same placement, skip the ones adopted by other allocations
+	unclaimed := make(map[string]inferencev1alpha1.PreparedDetails, len(migDevices))
+	for migUUID, device := range migDevices {
+		if !r.prepared.contains(migUUID) {
+			unclaimed[migUUID] = device
+		}
+	}
+	mig, found := findRealizedSlice(allocation.Spec, instaslice, unclaimed)
+	if !found {
+		return false
+	}
+	log.FromContext(ctx).Info("adopting existing slice", "allocation", allocation.Name, "migUUID", mig.miguuid)
+	r.prepared.set(allocation.Name, mig)
+	return true
+}
+
+// rebuildPreparedCache reconstructs the slices realized for the allocations of the node from the MIG devices on its GPUs.
+func (r *InstaSliceDaemonsetReconciler) rebuildPreparedCache(ctx context.Context, instaslice *inferencev1alpha1.Instaslice) error {
+	if err := r.GPU.Init(); err != nil {
+		return err
+	}
+	migDevices, err := r.GPU.ListMigDevices()
+	if err != nil {
+		return err
+	}
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	if err := r.List(ctx, &allocationList, client.MatchingLabels{inferencev1alpha1.AllocationNodeLabel: instaslice.Name}); err != nil {
+		return err
+	}
+	for i := range allocationList.Items {
+		allocation := &allocationList.Items[i]
+		if _, exists := r.prepared.get(allocation.Name); exists || allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted {
+			continue
+		}
+		r.adoptRealizedSlice(ctx, allocation, instaslice, migDevices)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func TestFindRealizedSlice(t *testing.T) {
+	allocation := inferencev1alpha1.AllocationDetails{PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "3g.20gb", Start: 4, Size: 4}
+	migDevices := map[string]inferencev1alpha1.PreparedDetails{
+		"MIG-other-placement": {Parent: "GPU-1", Profile: "3g.20gb", Start: 0, Size: 4, Giinfoid: 1, Ciinfoid: 0},
+		"MIG-other-gpu":       {Parent: "GPU-2", Profile: "3g.20gb", Start: 4, Size: 4, Giinfoid: 2, Ciinfoid: 0},
+		"MIG-match":           {Parent: "GPU-1", Profile: "3g.20gb", Start: 4, Size: 4, Giinfoid: 3, Ciinfoid: 0},
+	}
+	instaslice := &inferencev1alpha1.Instaslice{}
+
+	mig, found := findRealizedSlice(allocation, instaslice, migDevices)
+	assert.True(t, found)
+	assert.Equal(t, preparedMig{gid: 3, miguuid: "MIG-match", cid: 0}, mig)
+
+	// a slice prepared for the pod is its own
+	instaslice.Spec.Prepared = map[string]inferencev1alpha1.PreparedDetails{"MIG-match": {PodUUID: "pod-1"}}
+	_, found = findRealizedSlice(allocation, instaslice, migDevices)
+	assert.True(t, found)
+
+	// a slice prepared for another pod is never taken
+	instaslice.Spec.Prepared = map[string]inferencev1alpha1.PreparedDetails{"MIG-match": {PodUUID: "pod-2"}}
+	_, found = findRealizedSlice(allocation, instaslice, migDevices)
+	assert.False(t, found)
+
+	allocation.Profile = "4g.20gb"
+	instaslice.Spec.Prepared = nil
+	_, found = findRealizedSlice(allocation, instaslice, migDevices)
+	assert.False(t, found)
+}
+
+func TestReconcileAdoptsSliceCreatedBeforeRestart(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	// the previous daemonset created the slice and stopped before recording it
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[0].UUID, Profile: "3g.20gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_3_SLICE,
+		CIProfileID: nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, Start: 4, Size: 4})
+	assert.NoError(t, err)
+	allocation := newCreatingAllocation("pod-uid-restart", gpus[0].UUID, "3g.20gb", nvml.GPU_INSTANCE_PROFILE_3_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_3_SLICE, 4, 4)
+	reconciler := newDaemonsetTestReconciler(t, backend, allocation)
+
+	reconcileNode(t, reconciler)
+
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 1)
+	ctx := context.Background()
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.Equal(t, "pod-uid-restart", instaslice.Spec.Prepared[slice.MigUUID].PodUUID)
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updatedAllocation.Spec.Allocationstatus)
+}
+
+func TestRebuildPreparedCache(t *testing.T) {
+	backend := NewDGXA100Backend()
+	gpus, err := backend.DiscoverGPUs()
+	assert.NoError(t, err)
+	slice, err := backend.CreateSlice(SliceRequest{GPUUUID: gpus[1].UUID, Profile: "1g.5gb", GIProfileID: nvml.GPU_INSTANCE_PROFILE_1_SLICE, Start: 2, Size: 1})
+	assert.NoError(t, err)
+	adopted := newCreatingAllocation("pod-uid-adopted", gpus[1].UUID, "1g.5gb", nvml.GPU_INSTANCE_PROFILE_1_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, 2, 1)
+	pending := newCreatingAllocation("pod-uid-pending", gpus[1].UUID, "1g.5gb", nvml.GPU_INSTANCE_PROFILE_1_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, 3, 1)
+	reconciler := newDaemonsetTestReconciler(t, backend, adopted, pending)
+
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.NoError(t, reconciler.rebuildPreparedCache(context.Background(), &instaslice))
+
+	mig, cached := reconciler.prepared.get(adopted.Name)
+	assert.True(t, cached)
+	assert.Equal(t, preparedMig{gid: slice.GIID, miguuid: slice.MigUUID, cid: slice.CIID}, mig)
+	_, cached = reconciler.prepared.get(pending.Name)
+	assert.False(t, cached)
+}
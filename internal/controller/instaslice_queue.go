@@ -0,0 +1,215 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// FIFOQueueOrdering admits gated pods in the order they were created.
+	FIFOQueueOrdering = "fifo"
+	// PriorityQueueOrdering admits gated pods by priority, pods of the same priority in the order they were created.
+	PriorityQueueOrdering = "priority"
+	// queuePositionAnnotation holds the position of a gated pod in the admission queue, starting at 1.
+	queuePositionAnnotation = "instaslice.codeflare.dev/queue-position"
+)
+
+// queueEntry is a gated pod waiting for its slices to be placed.
+type queueEntry struct {
+	pod      types.NamespacedName
+	uid      types.UID
+	priority int32
+	created  time.Time
+	// blocked is set for pods that may not be placed whatever is released, such as pods over a quota,
+	// they keep their position but do not hold the head of the queue.
+	blocked bool
+	// lastEvent is the reason and message of the last event recorded on the pod while it waits.
+	lastEvent string
+}
+
+// admissionQueue orders the gated pods without allocations so capacity released on the GPUs goes to the pod
+// at the head of the queue instead of the pod that happens to be reconciled first.
+type admissionQueue struct {
+	mu      sync.Mutex
+	entries map[types.NamespacedName]queueEntry
+}
+
+// add puts a gated pod in the queue, a pod already queued keeps its blocked state.
+func (q *admissionQueue) add(pod *v1.Pod) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.entries == nil {
+		q.entries = make(map[types.NamespacedName]queueEntry)
+	}
+	name := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	entry := q.entries[name]
+	entry.pod = name
+	entry.uid = pod.UID
+	entry.priority = podPriority(pod)
+	entry.created = pod.CreationTimestamp.Time
+	q.entries[name] = entry
+}
+
+func (q *admissionQueue) remove(pod types.NamespacedName) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.entries, pod)
+}
+
+func (q *admissionQueue) setBlocked(pod types.NamespacedName, blocked bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, exists := q.entries[pod]; exists {
+		entry.blocked = blocked
+		q.entries[pod] = entry
+	}
+}
+
+// eventChanged remembers the reason and message of an event recorded on a queued pod and returns true when they
+// differ from the last ones, a pod that is not queued always records its events.
+func (q *admissionQueue) eventChanged(pod types.NamespacedName, reason, message string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, exists := q.entries[pod]
+	if !exists {
+		return true
+	}
+	event := reason + ": " + message
+	if entry.lastEvent == event {
+		return false
+	}
+	entry.lastEvent = event
+	q.entries[pod] = entry
+	return true
+}
+
+// ordered returns the queued pods from the head of the queue.
+func (q *admissionQueue) ordered(ordering string) []queueEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]queueEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if ordering != FIFOQueueOrdering && entries[i].priority != entries[j].priority {
+			return entries[i].priority > entries[j].priority
+		}
+		if !entries[i].created.Equal(entries[j].created) {
+			return entries[i].created.Before(entries[j].created)
+		}
+		return entries[i].pod.String() < entries[j].pod.String()
+	})
+	return entries
+}
+
+// position returns the position of a pod in the queue starting at 1 and the pods ahead of it, position is 0
+// when the pod is not queued.
+func (q *admissionQueue) position(pod types.NamespacedName, ordering string) (int, []queueEntry) {
+	entries := q.ordered(ordering)
+	for i, entry := range entries {
+		if entry.pod == pod {
+			return i + 1, entries[:i]
+		}
+	}
+	return 0, nil
+}
+
+// head returns the first pod of the queue that is not blocked.
+func (q *admissionQueue) head(ordering string) (queueEntry, bool) {
+	for _, entry := range q.ordered(ordering) {
+		if !entry.blocked {
+			return entry, true
+		}
+	}
+	return queueEntry{}, false
+}
+
+// setQueuePosition records the position of a gated pod in the admission queue in its annotations.
+func (r *InstasliceReconciler) setQueuePosition(ctx context.Context, pod *v1.Pod, position int) error {
+	value := strconv.Itoa(position)
+	if pod.Annotations[queuePositionAnnotation] == value {
+		return nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[queuePositionAnnotation] = value
+	return r.Patch(ctx, pod, patch)
+}
+
+// recordQueueEvent records an event on a gated pod waiting in the queue unless it is the last one recorded on it,
+// waiting pods are reconciled every few seconds and only a new position or reason is worth an event.
+func (r *InstasliceReconciler) recordQueueEvent(pod *v1.Pod, eventtype, reason, message string) {
+	if r.queue.eventChanged(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}, reason, message) {
+		r.Recorder.Event(pod, eventtype, reason, message)
+	}
+}
+
+// queueBlocker returns the pod ahead of a queued pod holding a placement it waits for, without backfill
+// the pods behind it are not placed until it is.
+func (r *InstasliceReconciler) queueBlocker(ahead []queueEntry) (queueEntry, bool) {
+	if r.QueueBackfill {
+		return queueEntry{}, false
+	}
+	for _, entry := range ahead {
+		if _, exists := r.reservations.get(entry.uid); exists {
+			return entry, true
+		}
+	}
+	return queueEntry{}, false
+}
+
+// reserveHeadOfLine holds a placement for the pod at the head of the queue when it does not fit anywhere,
+// the placement needing the fewest pods to release their slices is taken so smaller pods placed behind it
+// cannot starve it. Pods that do not fit even once slices are released are blocked so the next pod becomes the head.
+func (r *InstasliceReconciler) reserveHeadOfLine(ctx context.Context, pod *v1.Pod, nodes []gpuNode, requests []sliceRequest, policy AllocationPolicy) {
+	name := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	head, exists := r.queue.head(r.QueueOrdering)
+	if !exists || head.uid != pod.UID {
+		return
+	}
+	if _, exists := r.reservations.get(pod.UID); exists {
+		return
+	}
+	plan := r.planPreemption(ctx, pod, nodes, requests, policy, func(*v1.Pod) bool { return true })
+	if plan == nil {
+		// the pod would hold the head of the queue forever
+		r.queue.setBlocked(name, true)
+		return
+	}
+	for i := range plan.victims {
+		plan.victims[i].evict = false
+	}
+	plan.expires = time.Now().Add(preemptionReservationTimeout)
+	r.reserve(ctx, pod, *plan)
+	log.FromContext(ctx).Info("holding placement for head of admission queue ", "pod", pod.Name, "node", plan.node, "gpu", plan.gpuUUID, "start", plan.start)
+	r.recordQueueEvent(pod, v1.EventTypeNormal, EventReasonQueued, fmt.Sprintf("head of the admission queue, holding node %s GPU %s start %d until %d pods release their slices",
+		plan.node, plan.gpuUUID, plan.start, len(plan.victims)))
+}
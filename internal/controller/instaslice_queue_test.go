@@ -0,0 +1,147 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func newQueuedTestPod(name string, priority int32, created time.Time) *v1.Pod {
+	pod := newGatedTestPod(name, types.UID(name+"-uid"))
+	pod.Spec.Priority = &priority
+	pod.CreationTimestamp = metav1.NewTime(created)
+	return pod
+}
+
+func TestAdmissionQueueOrdering(t *testing.T) {
+	now := time.Now()
+	var queue admissionQueue
+	queue.add(newQueuedTestPod("first", 0, now))
+	queue.add(newQueuedTestPod("second", 100, now.Add(time.Second)))
+	queue.add(newQueuedTestPod("third", 0, now.Add(2*time.Second)))
+	names := func(entries []queueEntry) []string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.pod.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"second", "first", "third"}, names(queue.ordered(PriorityQueueOrdering)))
+	assert.Equal(t, []string{"first", "second", "third"}, names(queue.ordered(FIFOQueueOrdering)))
+	position, ahead := queue.position(types.NamespacedName{Namespace: "default", Name: "third"}, PriorityQueueOrdering)
+	assert.Equal(t, 3, position)
+	assert.Equal(t, []string{"second", "first"}, names(ahead))
+
+	// blocked pods keep their position but do not hold the head of the queue
+	queue.setBlocked(types.NamespacedName{Namespace: "default", Name: "second"}, true)
+	head, exists := queue.head(PriorityQueueOrdering)
+	assert.True(t, exists)
+	assert.Equal(t, "first", head.pod.Name)
+	position, _ = queue.position(types.NamespacedName{Namespace: "default", Name: "second"}, PriorityQueueOrdering)
+	assert.Equal(t, 1, position)
+
+	queue.remove(types.NamespacedName{Namespace: "default", Name: "first"})
+	position, _ = queue.position(types.NamespacedName{Namespace: "default", Name: "first"}, PriorityQueueOrdering)
+	assert.Zero(t, position)
+}
+
+func TestAdmissionQueueEventChanged(t *testing.T) {
+	var queue admissionQueue
+	name := types.NamespacedName{Namespace: "default", Name: "first"}
+	// events of pods that are not queued are always recorded
+	assert.True(t, queue.eventChanged(name, EventReasonQueued, "position 2"))
+	assert.True(t, queue.eventChanged(name, EventReasonQueued, "position 2"))
+
+	queue.add(newQueuedTestPod("first", 0, time.Now()))
+	assert.True(t, queue.eventChanged(name, EventReasonQueued, "position 2"))
+	assert.False(t, queue.eventChanged(name, EventReasonQueued, "position 2"))
+	assert.True(t, queue.eventChanged(name, EventReasonQueued, "position 1"))
+	assert.True(t, queue.eventChanged(name, EventReasonInsufficientCapacity, "position 1"))
+	// the pod keeps its last event while it is queued again
+	queue.add(newQueuedTestPod("first", 0, time.Now()))
+	assert.False(t, queue.eventChanged(name, EventReasonInsufficientCapacity, "position 1"))
+}
+
+func TestReconcileHoldsPlacementForHeadOfQueue(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	now := time.Now()
+	for _, tc := range []struct {
+		name          string
+		backfill      bool
+		expectedEvent string
+	}{
+		{name: "backfill", backfill: true, expectedEvent: "Warning InsufficientCapacity"},
+		{name: "no backfill", backfill: false, expectedEvent: "Normal Queued position 2 in the admission queue, waiting for pod default/big to be placed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			running, runningAllocation := newRunningTestPod("running", 0, "GPU-1", "3g.20gb", 0, 4)
+			big := newPreemptorTestPod("big", 0, "7g.40gb")
+			big.CreationTimestamp = metav1.NewTime(now)
+			small := newQueuedTestPod("small", 0, now.Add(time.Second))
+			recorder := record.NewFakeRecorder(100)
+			fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+				WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), running, runningAllocation, big, small).Build()
+			r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder, QueueBackfill: tc.backfill}
+
+			// the 7g pod at the head of the queue holds the GPU until the running pod releases its slice
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "big", Namespace: "default"}})
+			assert.NoError(t, err)
+			assert.Equal(t, "Normal Queued head of the admission queue, holding node node-1 GPU GPU-1 start 0 until 1 pods release their slices", <-recorder.Events)
+			assert.Contains(t, <-recorder.Events, "Warning InsufficientCapacity")
+
+			// the free half of the GPU is not given to the pod behind it
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "small", Namespace: "default"}})
+			assert.NoError(t, err)
+			assert.Contains(t, <-recorder.Events, tc.expectedEvent)
+			allocations, err := r.listPodAllocations(ctx, small)
+			assert.NoError(t, err)
+			assert.Empty(t, allocations)
+			var pod v1.Pod
+			assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "small", Namespace: "default"}, &pod))
+			assert.Equal(t, "2", pod.Annotations[queuePositionAnnotation])
+
+			runningAllocation.Finalizers = nil
+			assert.NoError(t, fakeClient.Update(ctx, runningAllocation))
+			assert.NoError(t, fakeClient.Delete(ctx, runningAllocation))
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "big", Namespace: "default"}})
+			assert.NoError(t, err)
+			allocations, err = r.listPodAllocations(ctx, big)
+			assert.NoError(t, err)
+			assert.Len(t, allocations, 1)
+			position, _ := r.queue.position(types.NamespacedName{Name: "big", Namespace: "default"}, r.QueueOrdering)
+			assert.Zero(t, position)
+			head, _ := r.queue.head(r.QueueOrdering)
+			assert.Equal(t, "small", head.pod.Name)
+		})
+	}
+}
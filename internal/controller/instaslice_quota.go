@@ -0,0 +1,174 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// namespaceUsage returns the slices held by the pods of a namespace, every allocation holds its slice until it is deleted.
+func namespaceUsage(namespace string, allocations []inferencev1alpha1.InstasliceAllocation) inferencev1alpha1.InstasliceQuotaStatus {
+	usage := inferencev1alpha1.InstasliceQuotaStatus{Profiles: make(map[string]int32)}
+	for _, allocation := range allocations {
+		if allocation.Namespace != namespace || allocation.Spec.Allocationstatus == inferencev1alpha1.AllocationStatusDeleted {
+			continue
+		}
+		usage.Profiles[allocation.Spec.Profile]++
+		usage.GPUSlots += int32(allocation.Spec.Size)
+	}
+	return usage
+}
+
+// requestedUsage returns the slices requested by a pod, the slots of a profile come from the placements discovered on the nodes.
+// A slice requested by size only gets a profile on the node it is placed on, it is charged by allocationsUsage once placed.
+func requestedUsage(requests []sliceRequest, instaslices []inferencev1alpha1.Instaslice) inferencev1alpha1.InstasliceQuotaStatus {
+	usage := inferencev1alpha1.InstasliceQuotaStatus{Profiles: make(map[string]int32)}
+	for _, request := range requests {
+		if request.profileName == "" {
+			continue
+		}
+		for _, instaslice := range instaslices {
+			if size, offered := profileSize(&instaslice, request.profileName); offered {
+				usage.GPUSlots += int32(size)
+				break
+			}
+		}
+		usage.Profiles[request.profileName]++
+	}
+	return usage
+}
+
+// allocationsUsage returns the slices a pod gets with the allocations placed for it on a node.
+func allocationsUsage(allocations map[string]inferencev1alpha1.AllocationDetails) inferencev1alpha1.InstasliceQuotaStatus {
+	usage := inferencev1alpha1.InstasliceQuotaStatus{Profiles: make(map[string]int32)}
+	for _, allocation := range allocations {
+		usage.Profiles[allocation.Profile]++
+		usage.GPUSlots += int32(allocation.Size)
+	}
+	return usage
+}
+
+// quotaViolation explains why the requested slices do not fit in a quota on top of the usage of the namespace,
+// it is empty when they fit.
+func quotaViolation(quota *inferencev1alpha1.InstasliceQuota, used, requested inferencev1alpha1.InstasliceQuotaStatus) string {
+	profiles := make([]string, 0, len(requested.Profiles))
+	for profile := range requested.Profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		limit, limited := quota.Spec.Profiles[profile]
+		if limited && used.Profiles[profile]+requested.Profiles[profile] > limit {
+			return fmt.Sprintf("quota %s allows %d %s slices, %d used and %d requested", quota.Name, limit, profile, used.Profiles[profile], requested.Profiles[profile])
+		}
+	}
+	if quota.Spec.MaxGPUSlots != nil && used.GPUSlots+requested.GPUSlots > *quota.Spec.MaxGPUSlots {
+		return fmt.Sprintf("quota %s allows %d GPU slots, %d used and %d requested", quota.Name, *quota.Spec.MaxGPUSlots, used.GPUSlots, requested.GPUSlots)
+	}
+	return ""
+}
+
+// checkQuotas returns why the slices requested by a pod exceed a quota of its namespace, it is empty when every quota allows them.
+func (r *InstasliceReconciler) checkQuotas(ctx context.Context, namespace string, requested inferencev1alpha1.InstasliceQuotaStatus, allocations []inferencev1alpha1.InstasliceAllocation) (string, error) {
+	var quotaList inferencev1alpha1.InstasliceQuotaList
+	if err := r.List(ctx, &quotaList, client.InNamespace(namespace)); err != nil {
+		return "", err
+	}
+	if len(quotaList.Items) == 0 {
+		return "", nil
+	}
+	used := namespaceUsage(namespace, allocations)
+	for i := range quotaList.Items {
+		if violation := quotaViolation(&quotaList.Items[i], used, requested); violation != "" {
+			return violation, nil
+		}
+	}
+	return "", nil
+}
+
+// InstasliceQuotaReconciler reflects the slices held by the pods of a namespace in the status of its quotas
+type InstasliceQuotaReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslicequotas,verbs=get;list;watch
+//+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instaslicequotas/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=inference.codeflare.dev,resources=instasliceallocations,verbs=get;list;watch
+
+func (r *InstasliceQuotaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	defer func() { recordRequeue("instaslice-quota", result, err) }()
+
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	if err := r.List(ctx, &allocationList, client.InNamespace(req.Namespace)); err != nil {
+		log.FromContext(ctx).Error(err, "Error listing allocations")
+		return ctrl.Result{}, err
+	}
+	usage := namespaceUsage(req.Namespace, allocationList.Items)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var quota inferencev1alpha1.InstasliceQuota
+		if err := r.Get(ctx, req.NamespacedName, &quota); err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(quota.Status, usage) {
+			return nil
+		}
+		quota.Status = usage
+		return r.Status().Update(ctx, &quota)
+	})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to update status of quota", "quota", req.Name)
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// quotaMapFunc maps an allocation to the quotas of its namespace
+func (r *InstasliceQuotaReconciler) quotaMapFunc(ctx context.Context, obj client.Object) []reconcile.Request {
+	var quotaList inferencev1alpha1.InstasliceQuotaList
+	if err := r.List(ctx, &quotaList, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "Error listing quotas", "namespace", obj.GetNamespace())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, quota := range quotaList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: quota.Namespace, Name: quota.Name}})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *InstasliceQuotaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&inferencev1alpha1.InstasliceQuota{}).Named("InstasliceQuota").
+		Watches(&inferencev1alpha1.InstasliceAllocation{}, handler.EnqueueRequestsFromMapFunc(r.quotaMapFunc)).
+		Complete(r)
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func newTestQuota(name string, profiles map[string]int32, maxGPUSlots *int32) *inferencev1alpha1.InstasliceQuota {
+	return &inferencev1alpha1.InstasliceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       inferencev1alpha1.InstasliceQuotaSpec{Profiles: profiles, MaxGPUSlots: maxGPUSlots},
+	}
+}
+
+func slotLimit(slots int32) *int32 {
+	return &slots
+}
+
+func TestNamespaceUsage(t *testing.T) {
+	pod := newGatedTestPod("vllm", "pod-1")
+	allocations := []inferencev1alpha1.InstasliceAllocation{
+		*newInstasliceAllocation(pod, "pod-1-vllm-0", inferencev1alpha1.AllocationDetails{Profile: "3g.20gb", Size: 4, Allocationstatus: inferencev1alpha1.AllocationStatusUngated}),
+		*newInstasliceAllocation(pod, "pod-1-vllm-1", inferencev1alpha1.AllocationDetails{Profile: "1g.5gb", Size: 1, Allocationstatus: inferencev1alpha1.AllocationStatusReleasing}),
+		*newInstasliceAllocation(pod, "pod-1-vllm-2", inferencev1alpha1.AllocationDetails{Profile: "1g.5gb", Size: 1, Allocationstatus: inferencev1alpha1.AllocationStatusDeleted}),
+	}
+	other := newGatedTestPod("other", "pod-2")
+	other.Namespace = "team-b"
+	allocations = append(allocations, *newInstasliceAllocation(other, "pod-2-vllm-0", inferencev1alpha1.AllocationDetails{Profile: "7g.40gb", Size: 8}))
+
+	usage := namespaceUsage("default", allocations)
+	assert.Equal(t, map[string]int32{"3g.20gb": 1, "1g.5gb": 1}, usage.Profiles)
+	assert.Equal(t, int32(5), usage.GPUSlots)
+}
+
+func TestQuotaViolation(t *testing.T) {
+	used := inferencev1alpha1.InstasliceQuotaStatus{Profiles: map[string]int32{"7g.40gb": 1}, GPUSlots: 8}
+	requested := inferencev1alpha1.InstasliceQuotaStatus{Profiles: map[string]int32{"7g.40gb": 1}, GPUSlots: 8}
+
+	assert.Equal(t, "quota team allows 1 7g.40gb slices, 1 used and 1 requested",
+		quotaViolation(newTestQuota("team", map[string]int32{"7g.40gb": 1}, nil), used, requested))
+	assert.Equal(t, "quota team allows 12 GPU slots, 8 used and 8 requested",
+		quotaViolation(newTestQuota("team", map[string]int32{"7g.40gb": 2}, slotLimit(12)), used, requested))
+	// profiles that are not listed are not limited
+	assert.Empty(t, quotaViolation(newTestQuota("team", map[string]int32{"1g.5gb": 0}, slotLimit(16)), used, requested))
+}
+
+func TestReconcileHoldsPodBackByQuota(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	existing := newGatedTestPod("other", "pod-0")
+	existingAllocation := newInstasliceAllocation(existing, "pod-0-vllm-0", inferencev1alpha1.AllocationDetails{
+		Nodename: "node-1", PodUUID: "pod-0", GPUUUID: "GPU-1", Profile: "3g.20gb", Start: 0, Size: 4, Allocationstatus: inferencev1alpha1.AllocationStatusUngated,
+	})
+	pod := newGatedTestPod("vllm", "pod-1")
+	quota := newTestQuota("team", nil, slotLimit(6))
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1", "GPU-2").Instaslice, newKubeNode("node-1"), existingAllocation, pod, quota).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}}
+
+	result, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	assert.Equal(t, "Warning QuotaExceeded quota team allows 6 GPU slots, 4 used and 4 requested", <-recorder.Events)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, allocations)
+
+	// the pod is placed once the quota allows it
+	quota.Spec.MaxGPUSlots = slotLimit(8)
+	assert.NoError(t, fakeClient.Update(ctx, quota))
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	allocations, err = r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+}
+
+func TestReconcileChargesSizedSliceByPlacedProfile(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	// node-a offers no 1g.5gb profile and is full, the 5Gi slice gets a 1g.5gb slice on node-b
+	fullNode := newTestNode("node-a", "GPU-A")
+	fullNode.Spec.Migplacement = fullNode.Spec.Migplacement[1:]
+	fullPod := newGatedTestPod("other", "pod-0")
+	fullAllocation := newInstasliceAllocation(fullPod, "pod-0-vllm-0", inferencev1alpha1.AllocationDetails{
+		Nodename: "node-a", PodUUID: "pod-0", GPUUUID: "GPU-A", Profile: "7g.40gb", Start: 0, Size: 8, Allocationstatus: inferencev1alpha1.AllocationStatusUngated,
+	})
+	pod := newGatedTestPod("vllm", "pod-1")
+	pod.Spec.Containers[0].Resources.Limits = nil
+	pod.Annotations = map[string]string{gpuMemoryAnnotation: "5Gi"}
+	quota := newTestQuota("team", map[string]int32{"1g.5gb": 0}, nil)
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(fullNode.Instaslice, newTestNode("node-b", "GPU-B").Instaslice, newKubeNode("node-a"), newKubeNode("node-b"), fullAllocation, pod, quota).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}}
+
+	_, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "Warning QuotaExceeded quota team allows 0 1g.5gb slices, 0 used and 1 requested", <-recorder.Events)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, allocations)
+
+	// the profile node-a would resolve the size to is not charged
+	quota.Spec.Profiles = map[string]int32{"2g.10gb": 0}
+	assert.NoError(t, fakeClient.Update(ctx, quota))
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	allocations, err = r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "node-b", allocations[0].Spec.Nodename)
+	assert.Equal(t, "1g.5gb", allocations[0].Spec.Profile)
+}
+
+func TestInstasliceQuotaReconcilerReportsUsage(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("vllm", "pod-1")
+	allocation := newInstasliceAllocation(pod, "pod-1-vllm-0", inferencev1alpha1.AllocationDetails{
+		Nodename: "node-1", PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "3g.20gb", Start: 0, Size: 4, Allocationstatus: inferencev1alpha1.AllocationStatusCreating,
+	})
+	quota := newTestQuota("team", map[string]int32{"3g.20gb": 2}, nil)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).WithObjects(allocation, quota).WithStatusSubresource(quota).Build()
+	r := &InstasliceQuotaReconciler{Client: fakeClient, Scheme: s}
+
+	assert.Equal(t, []ctrl.Request{{NamespacedName: types.NamespacedName{Name: "team", Namespace: "default"}}}, r.quotaMapFunc(ctx, allocation))
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "team", Namespace: "default"}})
+	assert.NoError(t, err)
+	var updated inferencev1alpha1.InstasliceQuota
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "team", Namespace: "default"}, &updated))
+	assert.Equal(t, map[string]int32{"3g.20gb": 1}, updated.Status.Profiles)
+	assert.Equal(t, int32(4), updated.Status.GPUSlots)
+}
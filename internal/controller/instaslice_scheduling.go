@@ -0,0 +1,135 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// nodeMismatch returns why a pod may not run on a node, it is empty when the node matches the node selector and
+// the required node affinity of the pod and the pod tolerates the taints of the node. Like the scheduler,
+// PreferNoSchedule taints and preferred affinities do not exclude a node.
+func nodeMismatch(pod *v1.Pod, node *v1.Node) string {
+	if len(pod.Spec.NodeSelector) > 0 && !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return "node selector does not match"
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		if required != nil && !nodeSelectorMatches(required, node) {
+			return "node affinity does not match"
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == v1.TaintEffectPreferNoSchedule || taintTolerated(pod.Spec.Tolerations, taint) {
+			continue
+		}
+		return fmt.Sprintf("taint %s is not tolerated", taint.ToString())
+	}
+	return ""
+}
+
+func taintTolerated(tolerations []v1.Toleration, taint *v1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeSelectorMatches returns true when any term of the selector matches the node.
+func nodeSelectorMatches(selector *v1.NodeSelector, node *v1.Node) bool {
+	for _, term := range selector.NodeSelectorTerms {
+		if nodeSelectorTermMatches(term, node) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeSelectorTermMatches returns true when the node meets all requirements of the term, an empty term matches
+// no node. metadata.name is the only field requirements may select on.
+func nodeSelectorTermMatches(term v1.NodeSelectorTerm, node *v1.Node) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+	for _, requirement := range term.MatchExpressions {
+		if !nodeRequirementMatches(requirement, labels.Set(node.Labels)) {
+			return false
+		}
+	}
+	for _, requirement := range term.MatchFields {
+		if requirement.Key != "metadata.name" || !nodeRequirementMatches(requirement, labels.Set{requirement.Key: node.Name}) {
+			return false
+		}
+	}
+	return true
+}
+
+func nodeRequirementMatches(requirement v1.NodeSelectorRequirement, set labels.Set) bool {
+	operators := map[v1.NodeSelectorOperator]selection.Operator{
+		v1.NodeSelectorOpIn:           selection.In,
+		v1.NodeSelectorOpNotIn:        selection.NotIn,
+		v1.NodeSelectorOpExists:       selection.Exists,
+		v1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+		v1.NodeSelectorOpGt:           selection.GreaterThan,
+		v1.NodeSelectorOpLt:           selection.LessThan,
+	}
+	operator, exists := operators[requirement.Operator]
+	if !exists {
+		return false
+	}
+	selector, err := labels.NewRequirement(requirement.Key, operator, requirement.Values)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(set)
+}
+
+// schedulableNodes returns the nodes the scheduling constraints of the pod allow it to run on, along with why
+// the other nodes were left out. Nodes whose Node object is gone are left out as well.
+func (r *InstasliceReconciler) schedulableNodes(ctx context.Context, pod *v1.Pod, nodes []gpuNode) ([]gpuNode, []string, error) {
+	var nodeList v1.NodeList
+	if err := r.List(ctx, &nodeList); err != nil {
+		return nil, nil, err
+	}
+	kubeNodes := make(map[string]*v1.Node, len(nodeList.Items))
+	for i := range nodeList.Items {
+		kubeNodes[nodeList.Items[i].Name] = &nodeList.Items[i]
+	}
+	var schedulable []gpuNode
+	var mismatches []string
+	for _, node := range nodes {
+		kubeNode, exists := kubeNodes[node.Name]
+		if !exists {
+			mismatches = append(mismatches, fmt.Sprintf("%s: node not found", node.Name))
+			continue
+		}
+		if mismatch := nodeMismatch(pod, kubeNode); mismatch != "" {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", node.Name, mismatch))
+			continue
+		}
+		schedulable = append(schedulable, node)
+	}
+	return schedulable, mismatches, nil
+}
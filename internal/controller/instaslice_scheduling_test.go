@@ -0,0 +1,110 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func zoneAffinity(operator v1.NodeSelectorOperator, zones ...string) *v1.Affinity {
+	return &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+			MatchExpressions: []v1.NodeSelectorRequirement{{Key: "zone", Operator: operator, Values: zones}},
+		}}},
+	}}
+}
+
+func TestNodeMismatch(t *testing.T) {
+	node := newKubeNode("node-1")
+	node.Labels = map[string]string{"zone": "a", "gpu": "a100"}
+	node.Spec.Taints = []v1.Taint{
+		{Key: "dedicated", Value: "inference", Effect: v1.TaintEffectNoSchedule},
+		{Key: "busy", Effect: v1.TaintEffectPreferNoSchedule},
+	}
+	tolerated := []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "inference", Effect: v1.TaintEffectNoSchedule}}
+	for _, tc := range []struct {
+		name     string
+		spec     v1.PodSpec
+		mismatch string
+	}{
+		{name: "tolerated", spec: v1.PodSpec{Tolerations: tolerated}},
+		{name: "not tolerated", spec: v1.PodSpec{}, mismatch: "taint dedicated=inference:NoSchedule is not tolerated"},
+		{name: "selector", spec: v1.PodSpec{Tolerations: tolerated, NodeSelector: map[string]string{"gpu": "a100"}}},
+		{name: "other selector", spec: v1.PodSpec{Tolerations: tolerated, NodeSelector: map[string]string{"gpu": "h100"}}, mismatch: "node selector does not match"},
+		{name: "affinity", spec: v1.PodSpec{Tolerations: tolerated, Affinity: zoneAffinity(v1.NodeSelectorOpIn, "a", "b")}},
+		{name: "anti affinity", spec: v1.PodSpec{Tolerations: tolerated, Affinity: zoneAffinity(v1.NodeSelectorOpNotIn, "a")}, mismatch: "node affinity does not match"},
+		{name: "name field", spec: v1.PodSpec{Tolerations: tolerated, Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{MatchExpressions: []v1.NodeSelectorRequirement{{Key: "zone", Operator: v1.NodeSelectorOpDoesNotExist}}},
+				{MatchFields: []v1.NodeSelectorRequirement{{Key: "metadata.name", Operator: v1.NodeSelectorOpIn, Values: []string{"node-1"}}}},
+			}},
+		}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.mismatch, nodeMismatch(&v1.Pod{Spec: tc.spec}, node))
+		})
+	}
+}
+
+func TestReconcilePlacesPodOnMatchingNode(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	tainted := newKubeNode("node-1")
+	tainted.Labels = map[string]string{"zone": "a"}
+	tainted.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/unschedulable", Effect: v1.TaintEffectNoSchedule}}
+	otherZone := newKubeNode("node-2")
+	otherZone.Labels = map[string]string{"zone": "c"}
+	matching := newKubeNode("node-3")
+	matching.Labels = map[string]string{"zone": "b"}
+	pod := newGatedTestPod("vllm", "pod-1")
+	pod.Spec.Affinity = zoneAffinity(v1.NodeSelectorOpIn, "a", "b")
+	recorder := record.NewFakeRecorder(100)
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).WithObjects(
+		newTestNode("node-1", "GPU-1").Instaslice, newTestNode("node-2", "GPU-2").Instaslice, newTestNode("node-3", "GPU-3").Instaslice,
+		tainted, otherZone, matching, pod).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: recorder}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "node-3", allocations[0].Spec.Nodename)
+
+	// no node is left once the pod asks for another zone
+	other := newGatedTestPod("other", "pod-2")
+	other.Spec.NodeSelector = map[string]string{"zone": "d"}
+	assert.NoError(t, fakeClient.Create(ctx, other))
+	<-recorder.Events
+	<-recorder.Events
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "other", Namespace: "default"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Warning NoMatchingNode no node with GPUs matches the scheduling constraints of the pod: "+
+		"node-1: node selector does not match; node-2: node selector does not match; node-3: node selector does not match", <-recorder.Events)
+}
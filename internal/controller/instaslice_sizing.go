@@ -0,0 +1,122 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+const (
+	// gpuMemoryAnnotation asks for a slice with at least the given GPU memory for the first container of a pod,
+	// the profile is picked per node among the profiles its GPUs offer.
+	gpuMemoryAnnotation = "instaslice.codeflare.dev/gpu-memory"
+	// gpuComputeAnnotation optionally asks for at least the given number of compute slices along with gpuMemoryAnnotation.
+	gpuComputeAnnotation = "instaslice.codeflare.dev/gpu-compute"
+)
+
+// sizedProfilePattern matches the profiles a sized request may resolve to, profiles with media extensions
+// or compute instances sharing a GPU instance are only handed out when asked for by name.
+var sizedProfilePattern = regexp.MustCompile(`^(\d+)g\.(\d+)gb$`)
+
+// sliceSize is the smallest slice a pod asks for instead of naming a MIG profile.
+type sliceSize struct {
+	memory  resource.Quantity
+	compute int
+}
+
+func (s sliceSize) String() string {
+	if s.compute == 0 {
+		return fmt.Sprintf("gpu-memory=%s", s.memory.String())
+	}
+	return fmt.Sprintf("gpu-memory=%s,gpu-compute=%d", s.memory.String(), s.compute)
+}
+
+// podSliceSize returns the slice size requested through the annotations of the pod, nil when it names its profiles.
+func podSliceSize(pod *v1.Pod) (*sliceSize, error) {
+	memory, hasMemory := pod.Annotations[gpuMemoryAnnotation]
+	compute, hasCompute := pod.Annotations[gpuComputeAnnotation]
+	if !hasMemory {
+		if hasCompute {
+			return nil, fmt.Errorf("%s requires %s", gpuComputeAnnotation, gpuMemoryAnnotation)
+		}
+		return nil, nil
+	}
+	size := &sliceSize{}
+	quantity, err := resource.ParseQuantity(memory)
+	if err != nil || quantity.Sign() <= 0 {
+		return nil, fmt.Errorf("%s must be a positive quantity, got %q", gpuMemoryAnnotation, memory)
+	}
+	size.memory = quantity
+	if hasCompute {
+		size.compute, err = strconv.Atoi(compute)
+		if err != nil || size.compute <= 0 {
+			return nil, fmt.Errorf("%s must be a positive integer, got %q", gpuComputeAnnotation, compute)
+		}
+	}
+	return size, nil
+}
+
+// smallestProfileFor returns the smallest profile discovered on a node with at least the memory and compute of a size.
+// Profiles taking fewer memory slots come first, then the ones with less memory.
+func smallestProfileFor(instaslice *inferencev1alpha1.Instaslice, size sliceSize) (string, error) {
+	best := ""
+	var bestSlots, bestMemory int64
+	for _, mig := range nodeMigPlacements(instaslice) {
+		match := sizedProfilePattern.FindStringSubmatch(mig.Profile)
+		if match == nil || len(mig.Placements) == 0 {
+			continue
+		}
+		compute, _ := strconv.Atoi(match[1])
+		memory, _ := strconv.ParseInt(match[2], 10, 64)
+		if compute < size.compute || resource.NewQuantity(memory<<30, resource.BinarySI).Cmp(size.memory) < 0 {
+			continue
+		}
+		slots := int64(mig.Placements[0].Size)
+		if best == "" || slots < bestSlots || (slots == bestSlots && memory < bestMemory) ||
+			(slots == bestSlots && memory == bestMemory && mig.Profile < best) {
+			best, bestSlots, bestMemory = mig.Profile, slots, memory
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no profile on node %s offers %s", instaslice.Name, size)
+	}
+	return best, nil
+}
+
+// resolveSliceRequests returns the requests with the profile of the requests asking for a size resolved
+// against the profiles of a node.
+func resolveSliceRequests(instaslice *inferencev1alpha1.Instaslice, requests []sliceRequest) ([]sliceRequest, error) {
+	resolved := make([]sliceRequest, len(requests))
+	for i, request := range requests {
+		if request.size != nil {
+			profileName, err := smallestProfileFor(instaslice, *request.size)
+			if err != nil {
+				return nil, err
+			}
+			request.profileName = profileName
+		}
+		resolved[i] = request
+	}
+	return resolved, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func TestSmallestProfileFor(t *testing.T) {
+	node := newTestNode("node-1", "GPU-1")
+	node.Spec.Migplacement = append(node.Spec.Migplacement,
+		inferencev1alpha1.Mig{Profile: "1g.10gb+me", Placements: []inferencev1alpha1.Placement{{Start: 0, Size: 1}}})
+	for _, tc := range []struct {
+		memory  string
+		compute int
+		profile string
+	}{
+		{memory: "5G", profile: "1g.5gb"},
+		{memory: "8Gi", profile: "2g.10gb"},
+		{memory: "10Gi", profile: "2g.10gb"},
+		{memory: "12Gi", profile: "3g.20gb"},
+		{memory: "10Gi", compute: 4, profile: "4g.20gb"},
+		{memory: "40Gi", profile: "7g.40gb"},
+	} {
+		profile, err := smallestProfileFor(node.Instaslice, sliceSize{memory: resource.MustParse(tc.memory), compute: tc.compute})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.profile, profile, tc.memory)
+	}
+	_, err := smallestProfileFor(node.Instaslice, sliceSize{memory: resource.MustParse("80Gi")})
+	assert.EqualError(t, err, "no profile on node node-1 offers gpu-memory=80Gi")
+}
+
+func TestPodSliceSize(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		size        *sliceSize
+		err         string
+	}{
+		{annotations: nil},
+		{annotations: map[string]string{gpuMemoryAnnotation: "10Gi"}, size: &sliceSize{memory: resource.MustParse("10Gi")}},
+		{annotations: map[string]string{gpuMemoryAnnotation: "10Gi", gpuComputeAnnotation: "2"}, size: &sliceSize{memory: resource.MustParse("10Gi"), compute: 2}},
+		{annotations: map[string]string{gpuMemoryAnnotation: "lots"}, err: `instaslice.codeflare.dev/gpu-memory must be a positive quantity, got "lots"`},
+		{annotations: map[string]string{gpuMemoryAnnotation: "10Gi", gpuComputeAnnotation: "0"}, err: `instaslice.codeflare.dev/gpu-compute must be a positive integer, got "0"`},
+		{annotations: map[string]string{gpuComputeAnnotation: "2"}, err: "instaslice.codeflare.dev/gpu-compute requires instaslice.codeflare.dev/gpu-memory"},
+	} {
+		pod := newGatedTestPod("vllm", "pod-1")
+		pod.Annotations = tc.annotations
+		size, err := podSliceSize(pod)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.size, size)
+	}
+}
+
+func TestReconcilePlacesSliceRequestedBySize(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	pod := newGatedTestPod("vllm", "pod-1")
+	pod.Annotations = map[string]string{gpuMemoryAnnotation: "8Gi"}
+	pod.Spec.Containers[0].Resources.Limits = nil
+	fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+		WithObjects(newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), pod).Build()
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: record.NewFakeRecorder(100)}
+
+	assert.Equal(t, []sliceRequest{{containerName: "vllm", size: &sliceSize{memory: resource.MustParse("8Gi")}}}, podSliceRequests(pod))
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+	assert.NoError(t, err)
+	allocations, err := r.listPodAllocations(ctx, pod)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "2g.10gb", allocations[0].Spec.Profile)
+	assert.Equal(t, uint32(2), allocations[0].Spec.Size)
+	assert.Equal(t, "vllm", allocations[0].Spec.ContainerName)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// setInstasliceStatus recomputes the conditions and GPU summary of the Instaslice of a node,
+// initErr is the result of the last GPU backend initialization done by the daemonset.
+func setInstasliceStatus(node *gpuNode, initErr error) {
+	instaslice := node.Instaslice
+	discovered := metav1.Condition{
+		Type:               inferencev1alpha1.ConditionDiscovered,
+		Status:             metav1.ConditionTrue,
+		Reason:             "GPUsDiscovered",
+		Message:            fmt.Sprintf("discovered %d MIG enabled GPUs", len(instaslice.Spec.MigGPUUUID)),
+		ObservedGeneration: instaslice.Generation,
+	}
+	if len(instaslice.Spec.MigGPUUUID) == 0 || len(nodeMigPlacements(instaslice)) == 0 {
+		discovered.Status = metav1.ConditionFalse
+		discovered.Reason = "NoMigPlacements"
+		discovered.Message = "no MIG enabled GPU or placement discovered on the node"
+	}
+	meta.SetStatusCondition(&instaslice.Status.Conditions, discovered)
+
+	nvmlHealthy := metav1.Condition{
+		Type:               inferencev1alpha1.ConditionNVMLHealthy,
+		Status:             metav1.ConditionTrue,
+		Reason:             "NVMLInitialized",
+		Message:            "NVML initialized successfully",
+		ObservedGeneration: instaslice.Generation,
+	}
+	if initErr != nil {
+		nvmlHealthy.Status = metav1.ConditionFalse
+		nvmlHealthy.Reason = "NVMLInitFailed"
+		nvmlHealthy.Message = initErr.Error()
+	}
+	meta.SetStatusCondition(&instaslice.Status.Conditions, nvmlHealthy)
+
+	ready := metav1.Condition{
+		Type:               inferencev1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Ready",
+		Message:            "slices can be created on the node",
+		ObservedGeneration: instaslice.Generation,
+	}
+	if discovered.Status != metav1.ConditionTrue {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "NotDiscovered"
+		ready.Message = discovered.Message
+	} else if nvmlHealthy.Status != metav1.ConditionTrue {
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "NVMLUnhealthy"
+		ready.Message = nvmlHealthy.Message
+	}
+	meta.SetStatusCondition(&instaslice.Status.Conditions, ready)
+
+	instaslice.Status.GPUs = gpuSummaries(node)
+}
+
+// gpuSummaries returns the slice usage of every GPU of the node sorted by UUID.
+func gpuSummaries(node *gpuNode) []inferencev1alpha1.GPUSummary {
+	instaslice := node.Instaslice
+	var gpuUUIDs []string
+	for gpuUUID := range instaslice.Spec.MigGPUUUID {
+		gpuUUIDs = append(gpuUUIDs, gpuUUID)
+	}
+	sort.Strings(gpuUUIDs)
+	var summaries []inferencev1alpha1.GPUSummary
+	for _, gpuUUID := range gpuUUIDs {
+		slots := gpuSlotOccupancy(node, gpuUUID)
+		free := freeSlotCount(slots)
+		summaries = append(summaries, inferencev1alpha1.GPUSummary{
+			GPUUUID:                 gpuUUID,
+			Model:                   instaslice.Spec.MigGPUUUID[gpuUUID],
+			SlotsUsed:               int32(len(slots) - free),
+			SlotsFree:               int32(free),
+			LargestPlaceableProfile: largestPlaceableProfile(instaslice, gpuUUID, slots),
+		})
+	}
+	return summaries
+}
+
+// largestPlaceableProfile returns the profile with the most memory slots that still has a free placement on a GPU,
+// profiles with the same size are ranked by their compute slices.
+func largestPlaceableProfile(instaslice *inferencev1alpha1.Instaslice, gpuUUID string, slots []bool) string {
+	largest := ""
+	largestSize, largestCompute := 0, 0
+	for _, mig := range gpuMigPlacements(instaslice, gpuUUID) {
+		if _, _, isComputeInstance := computeInstanceSlices(mig.Profile); isComputeInstance {
+			continue
+		}
+		for _, placement := range mig.Placements {
+			if !placementFits(slots, placement.Start, placement.Size) {
+				continue
+			}
+			// profiles with media extensions rank below the plain profile of the same size
+			compute := 0
+			if match := sizedProfilePattern.FindStringSubmatch(mig.Profile); match != nil {
+				compute, _ = strconv.Atoi(match[1])
+			}
+			if placement.Size > largestSize || (placement.Size == largestSize && compute > largestCompute) {
+				largest, largestSize, largestCompute = mig.Profile, placement.Size, compute
+			}
+			break
+		}
+	}
+	return largest
+}
+
+// refreshStatus writes the recomputed status of the Instaslice of the node when it changed.
+func (r *InstaSliceDaemonsetReconciler) refreshStatus(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, allocations []inferencev1alpha1.InstasliceAllocation) error {
+	initErr := r.GPU.Init()
+	err := updateInstasliceStatus(ctx, r.apiReader(), r.Client, client.ObjectKeyFromObject(instaslice), func(latest *inferencev1alpha1.Instaslice) bool {
+		status := latest.Status.DeepCopy()
+		node := newGpuNode(latest, allocations)
+		setInstasliceStatus(&node, initErr)
+		setGpuSlotMetrics(latest)
+		return !equality.Semantic.DeepEqual(*status, latest.Status)
+	})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to update status of instaslice", "node", instaslice.Name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func TestSetInstasliceStatus(t *testing.T) {
+	instaslice := newTestNode("node-1", "GPU-2", "GPU-1")
+	instaslice.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1-vllm-0": {PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "4g.20gb", Start: 0, Size: 4},
+		"pod-2-vllm-0": {PodUUID: "pod-2", GPUUUID: "GPU-2", Profile: "7g.40gb", Start: 0, Size: 8},
+	}
+
+	setInstasliceStatus(instaslice, nil)
+
+	assert.True(t, meta.IsStatusConditionTrue(instaslice.Status.Conditions, inferencev1alpha1.ConditionDiscovered))
+	assert.True(t, meta.IsStatusConditionTrue(instaslice.Status.Conditions, inferencev1alpha1.ConditionNVMLHealthy))
+	assert.True(t, meta.IsStatusConditionTrue(instaslice.Status.Conditions, inferencev1alpha1.ConditionReady))
+	assert.Equal(t, []inferencev1alpha1.GPUSummary{
+		{GPUUUID: "GPU-1", Model: instaslice.Spec.MigGPUUUID["GPU-1"], SlotsUsed: 4, SlotsFree: 4, LargestPlaceableProfile: "3g.20gb"},
+		{GPUUUID: "GPU-2", Model: instaslice.Spec.MigGPUUUID["GPU-2"], SlotsUsed: 8, SlotsFree: 0},
+	}, instaslice.Status.GPUs)
+
+	setInstasliceStatus(instaslice, &nvmlError{operation: "Init", ret: nvml.ERROR_DRIVER_NOT_LOADED})
+	assert.True(t, meta.IsStatusConditionFalse(instaslice.Status.Conditions, inferencev1alpha1.ConditionNVMLHealthy))
+	ready := meta.FindStatusCondition(instaslice.Status.Conditions, inferencev1alpha1.ConditionReady)
+	assert.Equal(t, "NVMLUnhealthy", ready.Reason)
+}
+
+func TestSetInstasliceStatusNotDiscovered(t *testing.T) {
+	instaslice := &gpuNode{Instaslice: &inferencev1alpha1.Instaslice{}}
+
+	setInstasliceStatus(instaslice, nil)
+
+	assert.True(t, meta.IsStatusConditionFalse(instaslice.Status.Conditions, inferencev1alpha1.ConditionDiscovered))
+	ready := meta.FindStatusCondition(instaslice.Status.Conditions, inferencev1alpha1.ConditionReady)
+	assert.Equal(t, "NotDiscovered", ready.Reason)
+	assert.Empty(t, instaslice.Status.GPUs)
+}
+
+func TestLargestPlaceableProfile(t *testing.T) {
+	instaslice := newTestNode("node-1", "GPU-1")
+	assert.Equal(t, "7g.40gb", largestPlaceableProfile(instaslice.Instaslice, "GPU-1", gpuSlotOccupancy(instaslice, "GPU-1")))
+
+	// 4g.20gb and 3g.20gb take the same slots, the one with more compute wins
+	instaslice.allocations = map[string]inferencev1alpha1.AllocationDetails{
+		"pod-1-vllm-0": {PodUUID: "pod-1", GPUUUID: "GPU-1", Profile: "1g.5gb", Start: 6, Size: 1},
+	}
+	assert.Equal(t, "4g.20gb", largestPlaceableProfile(instaslice.Instaslice, "GPU-1", gpuSlotOccupancy(instaslice, "GPU-1")))
+}
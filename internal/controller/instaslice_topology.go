@@ -0,0 +1,116 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+const (
+	// topologyAnnotation asks for all slices of a pod to be placed on GPUs close to each other.
+	topologyAnnotation = "instaslice.codeflare.dev/topology"
+	// NUMATopology places all slices of a pod on GPUs of a single NUMA node, so the kubelet topology manager
+	// can pin the CPUs of the pod to the same NUMA node.
+	NUMATopology = "numa"
+	// NVLinkTopology places all slices of a pod on GPUs linked to each other by NVLink.
+	NVLinkTopology = "nvlink"
+)
+
+// topologyGroups returns the sets of GPUs of a node the slices of a pod asking for a topology may be spread over.
+// GPUs whose topology is unknown only form a set on their own.
+func topologyGroups(instaslice *inferencev1alpha1.Instaslice, topology string) ([][]string, error) {
+	gpuUUIDs := make([]string, 0, len(instaslice.Spec.MigGPUUUID))
+	for gpuUUID := range instaslice.Spec.MigGPUUUID {
+		gpuUUIDs = append(gpuUUIDs, gpuUUID)
+	}
+	sort.Strings(gpuUUIDs)
+	var groups [][]string
+	switch topology {
+	case NUMATopology:
+		byNUMANode := make(map[int32][]string)
+		var numaNodes []int32
+		var unknown [][]string
+		for _, gpuUUID := range gpuUUIDs {
+			numaNode := instaslice.Spec.GPUTopology[gpuUUID].NUMANode
+			if numaNode == nil {
+				unknown = append(unknown, []string{gpuUUID})
+				continue
+			}
+			if _, exists := byNUMANode[*numaNode]; !exists {
+				numaNodes = append(numaNodes, *numaNode)
+			}
+			byNUMANode[*numaNode] = append(byNUMANode[*numaNode], gpuUUID)
+		}
+		sort.Slice(numaNodes, func(i, j int) bool { return numaNodes[i] < numaNodes[j] })
+		for _, numaNode := range numaNodes {
+			groups = append(groups, byNUMANode[numaNode])
+		}
+		groups = append(groups, unknown...)
+	case NVLinkTopology:
+		linked := func(a, b string) bool {
+			for _, peer := range instaslice.Spec.GPUTopology[a].NVLinkPeers {
+				if peer == b {
+					return true
+				}
+			}
+			return false
+		}
+		seen := make(map[string]bool)
+		for _, gpuUUID := range gpuUUIDs {
+			// the GPU along with the peers linked to every GPU of the group so far
+			group := []string{gpuUUID}
+			for _, peer := range gpuUUIDs {
+				if peer == gpuUUID {
+					continue
+				}
+				linkedToAll := true
+				for _, member := range group {
+					if !linked(member, peer) && !linked(peer, member) {
+						linkedToAll = false
+						break
+					}
+				}
+				if linkedToAll {
+					group = append(group, peer)
+				}
+			}
+			sorted := append([]string(nil), group...)
+			sort.Strings(sorted)
+			if key := strings.Join(sorted, ","); !seen[key] {
+				seen[key] = true
+				groups = append(groups, group)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology %q, supported topologies are %s and %s", topology, NUMATopology, NVLinkTopology)
+	}
+	return groups, nil
+}
+
+// withGPUs returns a node sharing the allocations of n with only the GPUs given in its inventory.
+func (n *gpuNode) withGPUs(gpuUUIDs []string) *gpuNode {
+	instaslice := *n.Instaslice
+	instaslice.Spec.MigGPUUUID = make(map[string]string, len(gpuUUIDs))
+	for _, gpuUUID := range gpuUUIDs {
+		instaslice.Spec.MigGPUUUID[gpuUUID] = n.Spec.MigGPUUUID[gpuUUID]
+	}
+	return &gpuNode{Instaslice: &instaslice, allocations: n.allocations}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// newTopologyTestNode returns a node whose GPU-1 and GPU-2 sit on NUMA node 0 and GPU-3 and GPU-4 on NUMA node 1,
+// NVLink bridges GPU-1 with GPU-3 and GPU-2 with GPU-4. GPU-5 has no known topology.
+func newTopologyTestNode() *gpuNode {
+	node := newTestNode("node-1", "GPU-1", "GPU-2", "GPU-3", "GPU-4", "GPU-5")
+	numaNode := func(numaNode int32) *int32 { return &numaNode }
+	node.Spec.GPUTopology = map[string]inferencev1alpha1.GPUTopology{
+		"GPU-1": {NUMANode: numaNode(0), NVLinkPeers: []string{"GPU-3"}},
+		"GPU-2": {NUMANode: numaNode(0), NVLinkPeers: []string{"GPU-4"}},
+		"GPU-3": {NUMANode: numaNode(1), NVLinkPeers: []string{"GPU-1"}},
+		"GPU-4": {NUMANode: numaNode(1), NVLinkPeers: []string{"GPU-2"}},
+	}
+	return node
+}
+
+func TestTopologyGroups(t *testing.T) {
+	node := newTopologyTestNode()
+
+	groups, err := topologyGroups(node.Instaslice, NUMATopology)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"GPU-1", "GPU-2"}, {"GPU-3", "GPU-4"}, {"GPU-5"}}, groups)
+	groups, err = topologyGroups(node.Instaslice, NVLinkTopology)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"GPU-1", "GPU-3"}, {"GPU-2", "GPU-4"}, {"GPU-5"}}, groups)
+	_, err = topologyGroups(node.Instaslice, "pcie")
+	assert.EqualError(t, err, `unknown topology "pcie", supported topologies are numa and nvlink`)
+}
+
+func TestReconcilePlacesSlicesOnCloseGPUs(t *testing.T) {
+	ctx := context.Background()
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	for _, tc := range []struct {
+		topology string
+		gpus     []string
+	}{
+		{topology: NUMATopology, gpus: []string{"GPU-3", "GPU-4"}},
+		{topology: NVLinkTopology, gpus: []string{"GPU-2", "GPU-4"}},
+	} {
+		t.Run(tc.topology, func(t *testing.T) {
+			// GPU-1 is taken so neither NUMA node 0 nor the NVLink pair of GPU-1 has room for two 7g slices
+			running, runningAllocation := newRunningTestPod("running", 0, "GPU-1", "7g.40gb", 0, 8)
+			pod := newGatedTestPod("vllm", "pod-1")
+			pod.Annotations = map[string]string{topologyAnnotation: tc.topology}
+			pod.Spec.Containers[0].Resources.Limits = v1.ResourceList{"nvidia.com/mig-7g.40gb": resource.MustParse("2")}
+			fakeClient := runtimefake.NewClientBuilder().WithScheme(s).
+				WithObjects(newTopologyTestNode().Instaslice, newKubeNode("node-1"), running, runningAllocation, pod).Build()
+			r := &InstasliceReconciler{Client: fakeClient, Scheme: s, Recorder: record.NewFakeRecorder(100)}
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "vllm", Namespace: "default"}})
+			assert.NoError(t, err)
+			allocations, err := r.listPodAllocations(ctx, pod)
+			assert.NoError(t, err)
+			var gpus []string
+			for _, allocation := range allocations {
+				gpus = append(gpus, allocation.Spec.GPUUUID)
+			}
+			sort.Strings(gpus)
+			assert.Equal(t, tc.gpus, gpus)
+		})
+	}
+}
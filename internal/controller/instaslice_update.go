@@ -0,0 +1,85 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// Controller and daemonset both write the Instaslice of a node and the allocations placed on it. Single map entries
+// are changed with a JSON merge patch on their key, everything else re-reads the object from the API server through
+// an uncached reader and retries when the resourceVersion moved in between. The informer cache may lag behind for
+// longer than the retries last, a write starting from it would conflict on every attempt.
+
+// patchPreparedEntry sets the prepared entry of a MIG slice on the Instaslice, or removes it when prepared is nil,
+// leaving the entries written concurrently for other slices untouched.
+func patchPreparedEntry(ctx context.Context, c client.Client, instaslice *inferencev1alpha1.Instaslice, migUUID string, prepared *inferencev1alpha1.PreparedDetails) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"prepared": map[string]interface{}{migUUID: prepared},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.Patch(ctx, instaslice, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		return err
+	}
+	// the response is decoded into the existing map, which keeps the removed entry
+	if prepared == nil {
+		delete(instaslice.Spec.Prepared, migUUID)
+	}
+	return nil
+}
+
+// updateInstasliceStatus applies mutate to the status of the latest version of the Instaslice read through reader
+// and writes it with c, retrying on conflicts. Nothing is written when mutate returns false.
+func updateInstasliceStatus(ctx context.Context, reader client.Reader, c client.Client, key types.NamespacedName, mutate func(*inferencev1alpha1.Instaslice) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var instaslice inferencev1alpha1.Instaslice
+		if err := reader.Get(ctx, key, &instaslice); err != nil {
+			return err
+		}
+		if !mutate(&instaslice) {
+			return nil
+		}
+		return c.Status().Update(ctx, &instaslice)
+	})
+}
+
+// updateAllocation applies mutate to the latest version of an allocation read through reader and writes it with c,
+// retrying on conflicts.
+// Nothing is written when mutate returns false.
+func updateAllocation(ctx context.Context, reader client.Reader, c client.Client, key types.NamespacedName, mutate func(*inferencev1alpha1.InstasliceAllocation) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var allocation inferencev1alpha1.InstasliceAllocation
+		if err := reader.Get(ctx, key, &allocation); err != nil {
+			return err
+		}
+		if !mutate(&allocation) {
+			return nil
+		}
+		return c.Update(ctx, &allocation)
+	})
+}
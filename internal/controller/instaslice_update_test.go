@@ -0,0 +1,272 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	runtimefake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func newUpdateTestClient(funcs interceptor.Funcs, objs ...client.Object) client.Client {
+	s := scheme.Scheme
+	_ = inferencev1alpha1.AddToScheme(s)
+	return runtimefake.NewClientBuilder().WithScheme(s).
+		WithStatusSubresource(&inferencev1alpha1.Instaslice{}).
+		WithObjects(objs...).
+		WithInterceptorFuncs(funcs).
+		Build()
+}
+
+func TestConcurrentPreparedEntriesArePreserved(t *testing.T) {
+	instaslice := &inferencev1alpha1.Instaslice{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "default"},
+		Spec: inferencev1alpha1.InstasliceSpec{
+			MigGPUUUID: map[string]string{"GPU-1": "NVIDIA A100-SXM4-40GB"},
+		},
+	}
+	fakeClient := newUpdateTestClient(interceptor.Funcs{}, instaslice)
+	reconciler := &InstaSliceDaemonsetReconciler{Client: fakeClient, Scheme: scheme.Scheme}
+
+	var stale inferencev1alpha1.Instaslice
+	assert.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &stale))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, podUUID := range []string{"pod-uid-1", "pod-uid-2"} {
+		wg.Add(1)
+		go func(i int, podUUID string) {
+			defer wg.Done()
+			allocation := inferencev1alpha1.AllocationDetails{PodUUID: podUUID, Start: uint32(i * 4), Size: 4}
+			errs[i] = reconciler.createPreparedEntry(context.Background(), "3g.20gb", allocation, "GPU-1",
+				uint32(i+1), 0, stale.DeepCopy(), "MIG-"+podUUID)
+		}(i, podUUID)
+	}
+	wg.Wait()
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+
+	var updated inferencev1alpha1.Instaslice
+	assert.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &updated))
+	assert.Len(t, updated.Spec.Prepared, 2)
+	assert.Equal(t, "pod-uid-1", updated.Spec.Prepared["MIG-pod-uid-1"].PodUUID)
+	assert.Equal(t, uint32(4), updated.Spec.Prepared["MIG-pod-uid-2"].Start)
+
+	// removing one entry from a stale copy leaves the other one in place
+	assert.NoError(t, patchPreparedEntry(context.Background(), fakeClient, stale.DeepCopy(), "MIG-pod-uid-1", nil))
+	assert.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &updated))
+	assert.Len(t, updated.Spec.Prepared, 1)
+	assert.Contains(t, updated.Spec.Prepared, "MIG-pod-uid-2")
+}
+
+func TestPatchPreparedEntryRemovesEntryInMemory(t *testing.T) {
+	ctx := context.Background()
+	instaslice := &inferencev1alpha1.Instaslice{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "default"},
+		Spec: inferencev1alpha1.InstasliceSpec{Prepared: map[string]inferencev1alpha1.PreparedDetails{
+			"MIG-1": {PodUUID: "pod-1", Parent: "GPU-1", Start: 0, Size: 1},
+			"MIG-2": {PodUUID: "pod-2", Parent: "GPU-1", Start: 1, Size: 1},
+		}},
+	}
+	// like the API client, decode the response into the object passed in, which reuses its maps
+	fakeClient := newUpdateTestClient(interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			patched := obj.DeepCopyObject().(client.Object)
+			if err := c.Patch(ctx, patched, patch, opts...); err != nil {
+				return err
+			}
+			raw, err := json.Marshal(patched)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(raw, obj)
+		},
+	}, instaslice.DeepCopy())
+
+	assert.NoError(t, patchPreparedEntry(ctx, fakeClient, instaslice, "MIG-1", nil))
+	assert.NotContains(t, instaslice.Spec.Prepared, "MIG-1")
+	assert.Contains(t, instaslice.Spec.Prepared, "MIG-2")
+	var stored inferencev1alpha1.Instaslice
+	assert.NoError(t, fakeClient.Get(ctx, client.ObjectKeyFromObject(instaslice), &stored))
+	assert.NotContains(t, stored.Spec.Prepared, "MIG-1")
+	assert.Contains(t, stored.Spec.Prepared, "MIG-2")
+}
+
+func TestConcurrentAllocationsOnOneNodeArePreserved(t *testing.T) {
+	ctx := context.Background()
+	first, second := newGatedTestPod("first", "pod-uid-1"), newGatedTestPod("second", "pod-uid-2")
+	// the allocations placement starts from are listed by both pods before either creates its own
+	var placementLists atomic.Int32
+	bothListed := make(chan struct{})
+	fakeClient := newUpdateTestClient(interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if err := c.List(ctx, list, opts...); err != nil {
+				return err
+			}
+			listOptions := (&client.ListOptions{}).ApplyOptions(opts)
+			if _, isAllocationList := list.(*inferencev1alpha1.InstasliceAllocationList); isAllocationList && listOptions.LabelSelector == nil {
+				if placementLists.Add(1) == 2 {
+					close(bothListed)
+				}
+				select {
+				case <-bothListed:
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			return nil
+		},
+	}, newTestNode("node-1", "GPU-1").Instaslice, newKubeNode("node-1"), first, second)
+	r := &InstasliceReconciler{Client: fakeClient, Scheme: scheme.Scheme, Recorder: record.NewFakeRecorder(100)}
+	t.Cleanup(func() {
+		pendingPods.remove(client.ObjectKeyFromObject(first))
+		pendingPods.remove(client.ObjectKeyFromObject(second))
+	})
+
+	// both pods are placed on the node at the same time
+	var wg sync.WaitGroup
+	for _, pod := range []*v1.Pod{first, second} {
+		wg.Add(1)
+		go func(key types.NamespacedName) {
+			defer wg.Done()
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+			assert.NoError(t, err)
+		}(client.ObjectKeyFromObject(pod))
+	}
+	wg.Wait()
+	var allocationList inferencev1alpha1.InstasliceAllocationList
+	assert.NoError(t, fakeClient.List(ctx, &allocationList))
+	assert.Len(t, allocationList.Items, 2)
+	starts := map[uint32]bool{}
+	for _, allocation := range allocationList.Items {
+		starts[allocation.Spec.Start] = true
+	}
+	assert.Equal(t, map[uint32]bool{0: true, 4: true}, starts)
+
+	// and their slices are realized at the same time from stale copies
+	for i := range allocationList.Items {
+		wg.Add(1)
+		go func(stale inferencev1alpha1.InstasliceAllocation) {
+			defer wg.Done()
+			assert.NoError(t, setAllocationStatus(ctx, fakeClient, fakeClient, &stale, inferencev1alpha1.AllocationStatusCreated, ""))
+		}(*allocationList.Items[i].DeepCopy())
+	}
+	wg.Wait()
+	assert.NoError(t, fakeClient.List(ctx, &allocationList))
+	assert.Len(t, allocationList.Items, 2)
+	for _, allocation := range allocationList.Items {
+		assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, allocation.Spec.Allocationstatus)
+	}
+}
+
+func TestUpdateAllocationRetriesOnConflict(t *testing.T) {
+	allocations := []client.Object{
+		&inferencev1alpha1.InstasliceAllocation{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-uid-1-vllm-0", Namespace: "default"},
+			Spec:       inferencev1alpha1.AllocationDetails{PodUUID: "pod-uid-1", Allocationstatus: inferencev1alpha1.AllocationStatusCreating},
+		},
+		&inferencev1alpha1.InstasliceAllocation{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-uid-2-vllm-0", Namespace: "default"},
+			Spec:       inferencev1alpha1.AllocationDetails{PodUUID: "pod-uid-2", Allocationstatus: inferencev1alpha1.AllocationStatusCreating},
+		},
+	}
+	var mu sync.Mutex
+	conflicts := map[string]bool{}
+	fakeClient := newUpdateTestClient(interceptor.Funcs{
+		Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			mu.Lock()
+			conflicted := conflicts[obj.GetName()]
+			conflicts[obj.GetName()] = true
+			mu.Unlock()
+			if !conflicted {
+				return errors.NewConflict(schema.GroupResource{Resource: "instasliceallocations"}, obj.GetName(), nil)
+			}
+			return c.Update(ctx, obj, opts...)
+		},
+	}, allocations...)
+
+	var wg sync.WaitGroup
+	for _, allocation := range allocations {
+		wg.Add(1)
+		go func(key types.NamespacedName) {
+			defer wg.Done()
+			assert.NoError(t, updateAllocation(context.Background(), fakeClient, fakeClient, key, func(latest *inferencev1alpha1.InstasliceAllocation) bool {
+				latest.Spec.Allocationstatus = inferencev1alpha1.AllocationStatusCreated
+				return true
+			}))
+		}(client.ObjectKeyFromObject(allocation))
+	}
+	wg.Wait()
+
+	for _, allocation := range allocations {
+		var updated inferencev1alpha1.InstasliceAllocation
+		assert.NoError(t, fakeClient.Get(context.Background(), client.ObjectKeyFromObject(allocation), &updated))
+		assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updated.Spec.Allocationstatus)
+	}
+}
+
+func TestUpdateInstasliceStatusRetriesOnConflict(t *testing.T) {
+	instaslice := &inferencev1alpha1.Instaslice{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Namespace: "default"},
+	}
+	attempts := 0
+	fakeClient := newUpdateTestClient(interceptor.Funcs{
+		SubResourceUpdate: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+			attempts++
+			if attempts == 1 {
+				return errors.NewConflict(schema.GroupResource{Resource: "instaslices"}, obj.GetName(), nil)
+			}
+			return c.Status().Update(ctx, obj, opts...)
+		},
+	}, instaslice)
+
+	key := client.ObjectKeyFromObject(instaslice)
+	err := updateInstasliceStatus(context.Background(), fakeClient, fakeClient, key, func(latest *inferencev1alpha1.Instaslice) bool {
+		latest.Status.GPUs = []inferencev1alpha1.GPUSummary{{GPUUUID: "GPU-1", SlotsFree: 8}}
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// an unchanged status is not written
+	err = updateInstasliceStatus(context.Background(), fakeClient, fakeClient, key, func(latest *inferencev1alpha1.Instaslice) bool {
+		return false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	var updated inferencev1alpha1.Instaslice
+	assert.NoError(t, fakeClient.Get(context.Background(), key, &updated))
+	assert.Equal(t, "GPU-1", updated.Status.GPUs[0].GPUUUID)
+}
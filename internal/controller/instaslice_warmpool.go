@@ -0,0 +1,259 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+// ParseWarmPool parses the number of slices kept ready per profile on every node from a comma separated list
+// of profile=count pairs, e.g. 1g.5gb=2,3g.20gb=1.
+func ParseWarmPool(value string) (map[string]int, error) {
+	pool := make(map[string]int)
+	if strings.TrimSpace(value) == "" {
+		return pool, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		profileName, countValue, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || profileName == "" {
+			return nil, fmt.Errorf("warm pool entry %q is not of the form profile=count", entry)
+		}
+		if _, _, isComputeInstance := computeInstanceSlices(profileName); isComputeInstance {
+			return nil, fmt.Errorf("warm pool profile %s shares a GPU instance, only profiles with their own GPU instance are kept warm", profileName)
+		}
+		count, err := strconv.Atoi(countValue)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("warm pool count of profile %s must be a non-negative integer, got %q", profileName, countValue)
+		}
+		pool[profileName] += count
+	}
+	return pool, nil
+}
+
+// isWarmSlice returns true for a prepared slice of the warm pool no pod has been handed yet.
+func isWarmSlice(prepared inferencev1alpha1.PreparedDetails) bool {
+	return prepared.WarmPool && prepared.PodUUID == ""
+}
+
+// warmSliceStart returns the start of a slice of the profile in the warm pool of a GPU that no allocation claimed yet.
+func warmSliceStart(node *gpuNode, gpuUUID string, profileName string) (uint32, bool) {
+	var starts []uint32
+	for _, prepared := range node.Spec.Prepared {
+		if !isWarmSlice(prepared) || prepared.Parent != gpuUUID || prepared.Profile != profileName {
+			continue
+		}
+		claimed := false
+		for _, allocation := range node.allocations {
+			if allocation.GPUUUID == gpuUUID && allocation.Start < prepared.Start+prepared.Size && prepared.Start < allocation.Start+allocation.Size {
+				claimed = true
+				break
+			}
+		}
+		if !claimed {
+			starts = append(starts, prepared.Start)
+		}
+	}
+	if len(starts) == 0 {
+		return 0, false
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts[0], true
+}
+
+// warmSlicesClaimed counts the allocations that get a slice of the warm pool of the node.
+func warmSlicesClaimed(node *gpuNode, allocations map[string]inferencev1alpha1.AllocationDetails) int {
+	claimed := 0
+	for _, allocation := range allocations {
+		for _, prepared := range node.Spec.Prepared {
+			if isWarmSlice(prepared) && prepared.Parent == allocation.GPUUUID && prepared.Start == allocation.Start &&
+				prepared.Size == allocation.Size && prepared.Profile == allocation.Profile {
+				claimed++
+				break
+			}
+		}
+	}
+	return claimed
+}
+
+// withoutWarmPool returns a node sharing the allocations of n on which the slots of the warm pool are free,
+// a slice placed over them shrinks the pool.
+func (n *gpuNode) withoutWarmPool() *gpuNode {
+	instaslice := *n.Instaslice
+	instaslice.Spec.Prepared = make(map[string]inferencev1alpha1.PreparedDetails, len(n.Spec.Prepared))
+	for migUUID, prepared := range n.Spec.Prepared {
+		if !isWarmSlice(prepared) {
+			instaslice.Spec.Prepared[migUUID] = prepared
+		}
+	}
+	return &gpuNode{Instaslice: &instaslice, allocations: n.allocations}
+}
+
+// reclaimWarmSlices destroys the slices of the warm pool overlapping a placement so the slice of an allocation fits.
+func (r *InstaSliceDaemonsetReconciler) reclaimWarmSlices(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, gpuUUID string, start, size uint32) error {
+	var migUUIDs []string
+	for migUUID, prepared := range instaslice.Spec.Prepared {
+		if isWarmSlice(prepared) && prepared.Parent == gpuUUID && start < prepared.Start+prepared.Size && prepared.Start < start+size {
+			migUUIDs = append(migUUIDs, migUUID)
+		}
+	}
+	sort.Strings(migUUIDs)
+	for _, migUUID := range migUUIDs {
+		if err := r.destroyWarmSlice(ctx, instaslice, migUUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyWarmSlice destroys a slice of the warm pool and removes its prepared entry.
+func (r *InstaSliceDaemonsetReconciler) destroyWarmSlice(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, migUUID string) error {
+	prepared := instaslice.Spec.Prepared[migUUID]
+	if err := r.GPU.DestroySlice(prepared.Parent, prepared.Giinfoid, prepared.Ciinfoid, true); err != nil {
+		log.FromContext(ctx).Error(err, "unable to destroy warm pool slice", "migUUID", migUUID)
+		return err
+	}
+	if err := patchPreparedEntry(ctx, r.Client, instaslice, migUUID, nil); err != nil {
+		log.FromContext(ctx).Error(err, "unable to remove prepared entry of warm pool slice", "migUUID", migUUID)
+		return err
+	}
+	log.FromContext(ctx).Info("destroyed warm pool slice", "migUUID", migUUID, "profile", prepared.Profile, "gpu", prepared.Parent)
+	return nil
+}
+
+// maintainWarmPool creates the slices missing from the warm pool of the node on its free slots and destroys
+// the slices beyond the configured count of their profile.
+func (r *InstaSliceDaemonsetReconciler) maintainWarmPool(ctx context.Context, instaslice *inferencev1alpha1.Instaslice, allocations []inferencev1alpha1.InstasliceAllocation) error {
+	warm := make(map[string][]string)
+	for migUUID, prepared := range instaslice.Spec.Prepared {
+		if isWarmSlice(prepared) {
+			warm[prepared.Profile] = append(warm[prepared.Profile], migUUID)
+		}
+	}
+	if len(r.WarmPool) == 0 && len(warm) == 0 {
+		return nil
+	}
+	if err := r.GPU.Init(); err != nil {
+		return err
+	}
+	profiles := make([]string, 0, len(r.WarmPool)+len(warm))
+	for profileName := range r.WarmPool {
+		profiles = append(profiles, profileName)
+	}
+	for profileName := range warm {
+		if _, configured := r.WarmPool[profileName]; !configured {
+			profiles = append(profiles, profileName)
+		}
+	}
+	sort.Strings(profiles)
+
+	changed := false
+	for _, profileName := range profiles {
+		sort.Strings(warm[profileName])
+		for _, migUUID := range warm[profileName][min(r.WarmPool[profileName], len(warm[profileName])):] {
+			if err := r.destroyWarmSlice(ctx, instaslice, migUUID); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	node := newGpuNode(instaslice, allocations)
+	for _, profileName := range profiles {
+		for missing := r.WarmPool[profileName] - len(warm[profileName]); missing > 0; missing-- {
+			mig, gpuUUID, placement, found := warmPoolPlacement(&node, profileName)
+			if !found {
+				log.FromContext(ctx).Info("no room left for warm pool slices", "profile", profileName, "missing", missing)
+				break
+			}
+			start, size := uint32(placement.Start), uint32(placement.Size)
+			slice, err := r.GPU.CreateSlice(SliceRequest{
+				GPUUUID:        gpuUUID,
+				Profile:        profileName,
+				GIProfileID:    mig.Giprofileid,
+				CIProfileID:    mig.CIProfileID,
+				CIEngProfileID: mig.CIEngProfileID,
+				Start:          start,
+				Size:           size,
+			})
+			if err != nil {
+				log.FromContext(ctx).Error(err, "unable to create warm pool slice", "profile", profileName, "gpu", gpuUUID)
+				return err
+			}
+			prepared := &inferencev1alpha1.PreparedDetails{Profile: profileName, Start: start, Size: size, Parent: gpuUUID,
+				Giinfoid: slice.GIID, Ciinfoid: slice.CIID, GIRefCount: 1, WarmPool: true, Managed: true}
+			if err := patchPreparedEntry(ctx, r.Client, instaslice, slice.MigUUID, prepared); err != nil {
+				log.FromContext(ctx).Error(err, "unable to add prepared entry of warm pool slice", "migUUID", slice.MigUUID)
+				return err
+			}
+			log.FromContext(ctx).Info("created warm pool slice", "migUUID", slice.MigUUID, "profile", profileName, "gpu", gpuUUID)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	nodeName := os.Getenv("NODE_NAME")
+	if err := r.updateNodeCapacity(ctx, nodeName); err != nil {
+		return err
+	}
+	if r.AdvertiseMigResources {
+		return r.advertiseMigResources(ctx, nodeName)
+	}
+	return nil
+}
+
+// warmPoolPlacement returns the placement a slice of the warm pool is created at: the last free placement of the profile
+// on the fullest GPU with room, which keeps empty GPUs and the lower slots available for larger profiles.
+func warmPoolPlacement(node *gpuNode, profileName string) (inferencev1alpha1.Mig, string, inferencev1alpha1.Placement, bool) {
+	gpuUUIDs := make([]string, 0, len(node.Spec.MigGPUUUID))
+	for gpuUUID := range node.Spec.MigGPUUUID {
+		gpuUUIDs = append(gpuUUIDs, gpuUUID)
+	}
+	sort.Strings(gpuUUIDs)
+	var bestMig inferencev1alpha1.Mig
+	var bestPlacement inferencev1alpha1.Placement
+	bestGPU, bestFreeSlots := "", 0
+	for _, gpuUUID := range gpuUUIDs {
+		var mig inferencev1alpha1.Mig
+		for _, candidate := range gpuMigPlacements(node.Instaslice, gpuUUID) {
+			if candidate.Profile == profileName {
+				mig = candidate
+			}
+		}
+		slots := gpuSlotOccupancy(node, gpuUUID)
+		freeSlots := freeSlotCount(slots)
+		found := false
+		var last inferencev1alpha1.Placement
+		for _, placement := range mig.Placements {
+			if (!found || placement.Start > last.Start) && placementFits(slots, placement.Start, placement.Size) {
+				last, found = placement, true
+			}
+		}
+		if found && (bestGPU == "" || freeSlots < bestFreeSlots) {
+			bestMig, bestGPU, bestPlacement, bestFreeSlots = mig, gpuUUID, last, freeSlots
+		}
+	}
+	return bestMig, bestGPU, bestPlacement, bestGPU != ""
+}
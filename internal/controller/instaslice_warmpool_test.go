@@ -0,0 +1,194 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	inferencev1alpha1 "codeflare.dev/instaslice/api/v1alpha1"
+)
+
+func TestParseWarmPool(t *testing.T) {
+	pool, err := ParseWarmPool("1g.5gb=2, 3g.20gb=1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"1g.5gb": 2, "3g.20gb": 1}, pool)
+	pool, err = ParseWarmPool("")
+	assert.NoError(t, err)
+	assert.Empty(t, pool)
+
+	_, err = ParseWarmPool("1g.5gb")
+	assert.EqualError(t, err, `warm pool entry "1g.5gb" is not of the form profile=count`)
+	_, err = ParseWarmPool("1g.5gb=-1")
+	assert.EqualError(t, err, `warm pool count of profile 1g.5gb must be a non-negative integer, got "-1"`)
+	_, err = ParseWarmPool("1c.3g.20gb=1")
+	assert.EqualError(t, err, "warm pool profile 1c.3g.20gb shares a GPU instance, only profiles with their own GPU instance are kept warm")
+}
+
+func TestPlaceSlicesOnWarmPool(t *testing.T) {
+	r := &InstasliceReconciler{}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "vllm", Namespace: "default", UID: "pod-1"}}
+	for _, policy := range []AllocationPolicy{&LeftToRightPolicy{}, &BestFitPolicy{}} {
+		node := newTestNode("node-1", "GPU-1")
+		node.Spec.Prepared = map[string]inferencev1alpha1.PreparedDetails{
+			"MIG-warm": {Profile: "1g.5gb", Start: 6, Size: 1, Parent: "GPU-1", GIRefCount: 1, WarmPool: true},
+		}
+
+		// the slice of the warm pool is handed out before a free placement
+		allocations, err := r.placeSlicesOnNode(node, []sliceRequest{{containerName: "vllm", profileName: "1g.5gb"}}, policy, pod)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(6), allocations["pod-1-vllm-0"].Start)
+		assert.Equal(t, 1, warmSlicesClaimed(node, allocations))
+
+		// a profile that does not fit next to the warm pool takes its place
+		allocations, err = r.placeSlicesOnNode(node, []sliceRequest{{containerName: "vllm", profileName: "7g.40gb"}}, policy, pod)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(0), allocations["pod-1-vllm-0"].Start)
+		assert.Equal(t, 0, warmSlicesClaimed(node, allocations))
+
+		// a claimed slice of the warm pool is not handed out twice
+		node.allocations["pod-0-vllm-0"] = inferencev1alpha1.AllocationDetails{GPUUUID: "GPU-1", Profile: "1g.5gb", Start: 6, Size: 1}
+		_, warm := warmSliceStart(node, "GPU-1", "1g.5gb")
+		assert.False(t, warm)
+	}
+}
+
+// setDGXA100Placements records the placements of the profiles of the backend in the Instaslice of node-1.
+func setDGXA100Placements(t *testing.T, reconciler *InstaSliceDaemonsetReconciler) {
+	ctx := context.Background()
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	placements, err := reconciler.GPU.ListPlacements()
+	assert.NoError(t, err)
+	instaslice.Spec.MigplacementByModel = placements
+	assert.NoError(t, reconciler.Update(ctx, &instaslice))
+}
+
+// warmSlices returns the slices of the warm pool of node-1 keyed by MIG UUID.
+func warmSlices(t *testing.T, reconciler *InstaSliceDaemonsetReconciler) map[string]inferencev1alpha1.PreparedDetails {
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(context.Background(), types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	warm := make(map[string]inferencev1alpha1.PreparedDetails)
+	for migUUID, prepared := range instaslice.Spec.Prepared {
+		if isWarmSlice(prepared) {
+			warm[migUUID] = prepared
+		}
+	}
+	return warm
+}
+
+func TestReconcileHandsOutAndRefillsWarmPool(t *testing.T) {
+	ctx := context.Background()
+	backend := NewDGXA100Backend()
+	reconciler := newDaemonsetTestReconciler(t, backend)
+	reconciler.WarmPool = map[string]int{"1g.5gb": 2}
+	setDGXA100Placements(t, reconciler)
+
+	reconcileNode(t, reconciler)
+	warm := warmSlices(t, reconciler)
+	assert.Len(t, warm, 2)
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 2)
+	var handedOut string
+	var slice inferencev1alpha1.PreparedDetails
+	for migUUID, prepared := range warm {
+		// the slices of the pool fill the last placements of a GPU
+		assert.Contains(t, []uint32{5, 6}, prepared.Start)
+		if handedOut == "" || prepared.Start > slice.Start {
+			handedOut, slice = migUUID, prepared
+		}
+	}
+
+	allocation := newCreatingAllocation("pod-uid-warm", slice.Parent, "1g.5gb", nvml.GPU_INSTANCE_PROFILE_1_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_1_SLICE, slice.Start, slice.Size)
+	assert.NoError(t, reconciler.Create(ctx, allocation))
+	reconcileNode(t, reconciler)
+
+	var instaslice inferencev1alpha1.Instaslice
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "node-1", Namespace: "default"}, &instaslice))
+	assert.Equal(t, inferencev1alpha1.PreparedDetails{Profile: "1g.5gb", Start: slice.Start, Size: 1, Parent: slice.Parent, PodUUID: "pod-uid-warm",
+		Giinfoid: slice.Giinfoid, Ciinfoid: slice.Ciinfoid, GIRefCount: 1, Managed: true}, instaslice.Spec.Prepared[handedOut])
+	var configMap v1.ConfigMap
+	assert.NoError(t, reconciler.Get(ctx, types.NamespacedName{Name: "vllm", Namespace: "default"}, &configMap))
+	assert.Equal(t, handedOut, configMap.Data["NVIDIA_VISIBLE_DEVICES"])
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updatedAllocation.Spec.Allocationstatus)
+	migDevices, err = backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 2)
+
+	// the pool is refilled once the allocation is settled
+	reconcileNode(t, reconciler)
+	assert.Len(t, warmSlices(t, reconciler), 2)
+	assert.NotContains(t, warmSlices(t, reconciler), handedOut)
+	migDevices, err = backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 3)
+
+	// slices of the warm pool are not orphans
+	instaslice = resyncNode(t, reconciler)
+	assert.Empty(t, instaslice.Status.Drift)
+}
+
+func TestReconcileShrinksWarmPool(t *testing.T) {
+	ctx := context.Background()
+	backend := NewDGXA100Backend()
+	reconciler := newDaemonsetTestReconciler(t, backend)
+	reconciler.WarmPool = map[string]int{"1g.5gb": 2}
+	setDGXA100Placements(t, reconciler)
+	reconcileNode(t, reconciler)
+	var gpuUUID string
+	for _, prepared := range warmSlices(t, reconciler) {
+		gpuUUID = prepared.Parent
+	}
+
+	// a whole GPU slice takes the place of the warm pool
+	allocation := newCreatingAllocation("pod-uid-large", gpuUUID, "7g.40gb", nvml.GPU_INSTANCE_PROFILE_7_SLICE, nvml.COMPUTE_INSTANCE_PROFILE_7_SLICE, 0, 8)
+	assert.NoError(t, reconciler.Create(ctx, allocation))
+	reconcileNode(t, reconciler)
+	var updatedAllocation inferencev1alpha1.InstasliceAllocation
+	assert.NoError(t, reconciler.Get(ctx, client.ObjectKeyFromObject(allocation), &updatedAllocation))
+	assert.Equal(t, inferencev1alpha1.AllocationStatusCreated, updatedAllocation.Spec.Allocationstatus)
+	assert.Empty(t, warmSlices(t, reconciler))
+	migDevices, err := backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 1)
+
+	// the pool is created again on another GPU
+	reconcileNode(t, reconciler)
+	warm := warmSlices(t, reconciler)
+	assert.Len(t, warm, 2)
+	for _, prepared := range warm {
+		assert.NotEqual(t, gpuUUID, prepared.Parent)
+	}
+
+	// slices beyond the configured pool are destroyed
+	reconciler.WarmPool = map[string]int{"1g.5gb": 1}
+	reconcileNode(t, reconciler)
+	assert.Len(t, warmSlices(t, reconciler), 1)
+	migDevices, err = backend.ListMigDevices()
+	assert.NoError(t, err)
+	assert.Len(t, migDevices, 2)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// gateName is used both as the scheduling gate and the finalizer that hold a pod until its slice is realized.
+	gateName = "org.instaslice/accelarator"
+	// instasliceResourcePrefix prefixes the per pod extended resource advertised on the node once a slice exists.
+	instasliceResourcePrefix = "org.instaslice/"
+	// migResourcePrefix identifies container limits that request a MIG slice.
+	migResourcePrefix = "nvidia.com/mig-"
+	// mutatePodPath is the path the pod mutating webhook is served on.
+	mutatePodPath = "/mutate-v1-pod"
+	// sliceKeyAnnotation names the capacity resource and configmaps of a pod, it is the pod name unless
+	// the API server only assigns the name after admission.
+	sliceKeyAnnotation = "instaslice.codeflare.dev/slice-key"
+)
+
+// InstasliceWebhook injects the InstaSlice scheduling gate, finalizer, per pod capacity resource
+// and configmap reference into pods requesting MIG slices.
+type InstasliceWebhook struct {
+	decoder *admission.Decoder
+}
+
+//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mpod.instaslice.codeflare.dev,admissionReviewVersions=v1
+
+func (w *InstasliceWebhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &v1.Pod{}
+	if err := w.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !requestsMigSlice(pod) {
+		return admission.Allowed("pod does not request MIG slices")
+	}
+	if _, err := podSliceSize(pod); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	// pods created by controllers only carry a generateName at admission time, the API server names them
+	// afterwards so their capacity resource and configmaps get a key of their own
+	if pod.Name == "" && pod.Annotations[sliceKeyAnnotation] == "" {
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[sliceKeyAnnotation] = string(uuid.NewUUID())
+	}
+
+	mutatePodForInstaslice(pod)
+	log.FromContext(ctx).Info("injected instaslice gate for ", "pod", pod.Name, "generateName", pod.GenerateName, "namespace", req.Namespace)
+
+	marshaledPod, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+}
+
+// requestsMigSlice returns true when any container in the pod has a MIG limit or the pod asks for a slice by size.
+func requestsMigSlice(pod *v1.Pod) bool {
+	for i := range pod.Spec.Containers {
+		if containerRequestsMigSlice(pod, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// containerRequestsMigSlice returns true when the i-th container of the pod gets a slice, a slice requested
+// by size through the pod annotations goes to the first container.
+func containerRequestsMigSlice(pod *v1.Pod, i int) bool {
+	if i == 0 && (pod.Annotations[gpuMemoryAnnotation] != "" || pod.Annotations[gpuComputeAnnotation] != "") {
+		return true
+	}
+	for resourceName := range pod.Spec.Containers[i].Resources.Limits {
+		if strings.HasPrefix(resourceName.String(), migResourcePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// podSliceKey returns the name of the capacity resource and configmaps of a pod.
+func podSliceKey(pod *v1.Pod) string {
+	if key := pod.Annotations[sliceKeyAnnotation]; key != "" {
+		return key
+	}
+	return pod.Name
+}
+
+// podCapacityResource returns the per pod extended resource the node advertises once the slices of the pod exist.
+func podCapacityResource(pod *v1.Pod) v1.ResourceName {
+	return v1.ResourceName(instasliceResourcePrefix + podSliceKey(pod))
+}
+
+// sliceConfigMapName returns the configmap the MIG devices of a container are published in, pods with
+// a single MIG container keep using the slice key of the pod while every container gets its own one otherwise.
+func sliceConfigMapName(pod *v1.Pod, containerName string) string {
+	migContainers := 0
+	for i := range pod.Spec.Containers {
+		if containerRequestsMigSlice(pod, i) {
+			migContainers++
+		}
+	}
+	if migContainers <= 1 {
+		return podSliceKey(pod)
+	}
+	return podSliceKey(pod) + "-" + containerName
+}
+
+// mutatePodForInstaslice adds everything the controller and daemonset expect on a pod,
+// existing entries are left untouched so the mutation is idempotent.
+func mutatePodForInstaslice(pod *v1.Pod) {
+	hasGate := false
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name == gateName {
+			hasGate = true
+		}
+	}
+	if !hasGate {
+		pod.Spec.SchedulingGates = append(pod.Spec.SchedulingGates, v1.PodSchedulingGate{Name: gateName})
+	}
+	controllerutil.AddFinalizer(pod, gateName)
+
+	//node advertises a single unit of the pod resource, only the first MIG container consumes it.
+	capacityResource := podCapacityResource(pod)
+	capacityAdded := false
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if !containerRequestsMigSlice(pod, i) {
+			continue
+		}
+		if _, exists := container.Resources.Limits[capacityResource]; exists {
+			capacityAdded = true
+		}
+	}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if !containerRequestsMigSlice(pod, i) {
+			continue
+		}
+		if !capacityAdded {
+			if container.Resources.Limits == nil {
+				container.Resources.Limits = v1.ResourceList{}
+			}
+			container.Resources.Limits[capacityResource] = resource.MustParse("1")
+			capacityAdded = true
+		}
+		configMapName := sliceConfigMapName(pod, container.Name)
+		hasEnvFrom := false
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil && envFrom.ConfigMapRef.Name == configMapName {
+				hasEnvFrom = true
+			}
+		}
+		if !hasEnvFrom {
+			container.EnvFrom = append(container.EnvFrom, v1.EnvFromSource{
+				ConfigMapRef: &v1.ConfigMapEnvSource{
+					LocalObjectReference: v1.LocalObjectReference{Name: configMapName},
+				},
+			})
+		}
+	}
+}
+
+// SetupWithManager registers the pod mutating webhook with the manager webhook server.
+func (w *InstasliceWebhook) SetupWithManager(mgr ctrl.Manager) error {
+	w.decoder = admission.NewDecoder(mgr.GetScheme())
+	mgr.GetWebhookServer().Register(mutatePodPath, &webhook.Admission{Handler: w})
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestMutatePodForInstaslice(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "vllm-abcde", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name: "vllm",
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							"nvidia.com/mig-3g.20gb": resource.MustParse("1"),
+						},
+					},
+				},
+				{Name: "sidecar"},
+			},
+		},
+	}
+
+	mutatePodForInstaslice(pod)
+	// a second pass must not duplicate anything
+	mutatePodForInstaslice(pod)
+
+	assert.Equal(t, []v1.PodSchedulingGate{{Name: gateName}}, pod.Spec.SchedulingGates)
+	assert.Equal(t, []string{gateName}, pod.Finalizers)
+	limit := pod.Spec.Containers[0].Resources.Limits[v1.ResourceName("org.instaslice/vllm-abcde")]
+	assert.Equal(t, int64(1), limit.Value())
+	assert.Len(t, pod.Spec.Containers[0].EnvFrom, 1)
+	assert.Equal(t, "vllm-abcde", pod.Spec.Containers[0].EnvFrom[0].ConfigMapRef.Name)
+	assert.Empty(t, pod.Spec.Containers[1].EnvFrom)
+	assert.Empty(t, pod.Spec.Containers[1].Resources.Limits)
+}
+
+func TestMutatePodForInstasliceMultipleContainers(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "vllm-abcde", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name: "model",
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{"nvidia.com/mig-3g.20gb": resource.MustParse("1")},
+					},
+				},
+				{
+					Name: "tokenizer",
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{"nvidia.com/mig-1g.5gb": resource.MustParse("1")},
+					},
+				},
+			},
+		},
+	}
+
+	mutatePodForInstaslice(pod)
+
+	assert.Equal(t, "vllm-abcde-model", pod.Spec.Containers[0].EnvFrom[0].ConfigMapRef.Name)
+	assert.Equal(t, "vllm-abcde-tokenizer", pod.Spec.Containers[1].EnvFrom[0].ConfigMapRef.Name)
+	_, exists := pod.Spec.Containers[1].Resources.Limits[v1.ResourceName("org.instaslice/vllm-abcde")]
+	assert.False(t, exists)
+}
+
+func TestMutatePodForInstasliceWithSliceKey(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "vllm-", Namespace: "default", Annotations: map[string]string{sliceKeyAnnotation: "key-1"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name:      "vllm",
+			Resources: v1.ResourceRequirements{Limits: v1.ResourceList{"nvidia.com/mig-1g.5gb": resource.MustParse("1")}},
+		}}},
+	}
+
+	mutatePodForInstaslice(pod)
+
+	assert.Empty(t, pod.Name)
+	_, exists := pod.Spec.Containers[0].Resources.Limits[v1.ResourceName("org.instaslice/key-1")]
+	assert.True(t, exists)
+	assert.Equal(t, "key-1", pod.Spec.Containers[0].EnvFrom[0].ConfigMapRef.Name)
+	assert.Equal(t, "key-1", sliceConfigMapName(pod, "vllm"))
+}
+
+func TestInstasliceWebhookHandle(t *testing.T) {
+	w := &InstasliceWebhook{decoder: admission.NewDecoder(scheme.Scheme)}
+
+	newRequest := func(pod *v1.Pod) admission.Request {
+		raw, err := json.Marshal(pod)
+		assert.NoError(t, err)
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		}}
+	}
+
+	plainPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	}
+	resp := w.Handle(context.Background(), newRequest(plainPod))
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, resp.Patches)
+
+	migPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "vllm-", Namespace: "default"},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name: "vllm",
+			Resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{"nvidia.com/mig-1g.5gb": resource.MustParse("1")},
+			},
+		}}},
+	}
+	resp = w.Handle(context.Background(), newRequest(migPod))
+	assert.True(t, resp.Allowed)
+	patchedPaths := map[string]bool{}
+	var sliceKey string
+	for _, patch := range resp.Patches {
+		patchedPaths[patch.Path] = true
+		if patch.Path == "/metadata/annotations" {
+			sliceKey = patch.Value.(map[string]interface{})[sliceKeyAnnotation].(string)
+		}
+	}
+	// the API server names the pod, its capacity resource and configmap are keyed on the annotation
+	assert.False(t, patchedPaths["/metadata/name"])
+	assert.NotEmpty(t, sliceKey)
+	assert.True(t, patchedPaths["/metadata/finalizers"])
+	assert.True(t, patchedPaths["/spec/schedulingGates"])
+	assert.True(t, patchedPaths["/spec/containers/0/envFrom"])
+
+	sizedPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "sized", Namespace: "default", Annotations: map[string]string{gpuMemoryAnnotation: "10Gi"}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "vllm"}, {Name: "sidecar"}}},
+	}
+	resp = w.Handle(context.Background(), newRequest(sizedPod))
+	assert.True(t, resp.Allowed)
+	patchedPaths = map[string]bool{}
+	for _, patch := range resp.Patches {
+		patchedPaths[patch.Path] = true
+	}
+	assert.True(t, patchedPaths["/spec/containers/0/resources/limits"])
+	assert.True(t, patchedPaths["/spec/containers/0/envFrom"])
+	assert.False(t, patchedPaths["/spec/containers/1/envFrom"])
+
+	sizedPod.Annotations[gpuComputeAnnotation] = "many"
+	resp = w.Handle(context.Background(), newRequest(sizedPod))
+	assert.False(t, resp.Allowed)
+}
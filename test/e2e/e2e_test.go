@@ -19,6 +19,7 @@ package e2e
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -29,6 +30,29 @@ import (
 
 const namespace = "instaslicev2-system"
 
+// projectimage and daemonsetimage store the names of the images used in the example
+const (
+	projectimage   = "example.com/instaslicev2:v0.0.1"
+	daemonsetimage = "example.com/instaslicev2-daemonset:v0.0.1"
+)
+
+// slicePod requests a 1g.5gb slice, it is only scheduled once InstaSlice ungates it.
+const slicePod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: e2e-slice
+  namespace: default
+spec:
+  restartPolicy: Never
+  containers:
+  - name: sleep
+    image: busybox
+    command: ["sleep", "3600"]
+    resources:
+      limits:
+        nvidia.com/mig-1g.5gb: 1
+`
+
 var _ = Describe("controller", Ordered, func() {
 	BeforeAll(func() {
 		By("installing prometheus operator")
@@ -59,25 +83,25 @@ var _ = Describe("controller", Ordered, func() {
 			var controllerPodName string
 			var err error
 
-			// projectimage stores the name of the image used in the example
-			var projectimage = "example.com/instaslicev2:v0.0.1"
-
-			By("building the manager(Operator) image")
-			cmd := exec.Command("make", "docker-build", fmt.Sprintf("IMG=%s", projectimage))
+			By("building the manager(Operator) and daemonset images")
+			cmd := exec.Command("make", "docker-build", fmt.Sprintf("IMG=%s", projectimage), fmt.Sprintf("IMG_DMST=%s", daemonsetimage))
 			_, err = utils.Run(cmd)
 			ExpectWithOffset(1, err).NotTo(HaveOccurred())
 
-			By("loading the the manager(Operator) image on Kind")
+			By("loading the the manager(Operator) and daemonset images on Kind")
 			err = utils.LoadImageToKindClusterWithName(projectimage)
 			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			err = utils.LoadImageToKindClusterWithName(daemonsetimage)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
 
 			By("installing CRDs")
 			cmd = exec.Command("make", "install")
 			_, err = utils.Run(cmd)
 			ExpectWithOffset(1, err).NotTo(HaveOccurred())
 
-			By("deploying the controller-manager")
-			cmd = exec.Command("make", "deploy", fmt.Sprintf("IMG=%s", projectimage))
+			// kind nodes have no GPUs, the daemonset emulates them
+			By("deploying the controller-manager with emulated GPUs")
+			cmd = exec.Command("make", "deploy-emulator", fmt.Sprintf("IMG=%s", projectimage), fmt.Sprintf("IMG_DMST=%s", daemonsetimage))
 			_, err = utils.Run(cmd)
 			ExpectWithOffset(1, err).NotTo(HaveOccurred())
 
@@ -118,5 +142,52 @@ var _ = Describe("controller", Ordered, func() {
 			EventuallyWithOffset(1, verifyControllerUp, time.Minute, time.Second).Should(Succeed())
 
 		})
+
+		It("should ungate a pod on emulated GPUs", func() {
+			By("creating a pod requesting a slice")
+			cmd := exec.Command("kubectl", "apply", "-f", "-")
+			cmd.Stdin = strings.NewReader(slicePod)
+			_, err := utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+			By("validating that the pod is scheduled with its slice")
+			verifyPodScheduled := func() error {
+				cmd := exec.Command("kubectl", "get", "pod", "e2e-slice", "-n", "default", "-o", "jsonpath={.spec.nodeName}")
+				nodeName, err := utils.Run(cmd)
+				if err != nil {
+					return err
+				}
+				if len(nodeName) == 0 {
+					return fmt.Errorf("pod is not scheduled yet")
+				}
+				cmd = exec.Command("kubectl", "get", "configmap", "e2e-slice", "-n", "default", "-o", "jsonpath={.data.NVIDIA_VISIBLE_DEVICES}")
+				devices, err := utils.Run(cmd)
+				if err != nil {
+					return err
+				}
+				if !strings.HasPrefix(string(devices), "MIG-") {
+					return fmt.Errorf("configmap has no MIG device: %q", devices)
+				}
+				return nil
+			}
+			EventuallyWithOffset(1, verifyPodScheduled, 2*time.Minute, time.Second).Should(Succeed())
+
+			By("deleting the pod releases its slice")
+			cmd = exec.Command("kubectl", "delete", "pod", "e2e-slice", "-n", "default", "--wait=false")
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			verifyConfigMapDeleted := func() error {
+				cmd := exec.Command("kubectl", "get", "configmap", "e2e-slice", "-n", "default", "--ignore-not-found", "-o", "name")
+				output, err := utils.Run(cmd)
+				if err != nil {
+					return err
+				}
+				if len(utils.GetNonEmptyLines(string(output))) != 0 {
+					return fmt.Errorf("configmap of the pod still exists")
+				}
+				return nil
+			}
+			EventuallyWithOffset(1, verifyConfigMapDeleted, 2*time.Minute, time.Second).Should(Succeed())
+		})
 	})
 })